@@ -2,47 +2,53 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	ollama "github.com/ollama/ollama/api"
-	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
-)
-
-const (
-	system_prompt_format = `You're game entity. 
-Your name is %s.
-You always give shortest possible answers, like when chatting on Discord. (never use emojis though)
-%s
-
-Here's a list of things you've heard from other entities (linked with your answers when relevant):
-
-%s
-
-Here's a message from another entity (%s), what's your answer?
-
-%s
-`
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
-	// TODO: store agents in JSON file to resume simulation
-	// all data is wiped when restarting server so far.
-	agents       map[string]*Agent // indexed by ID
-	chromaClient *ChromaClient
-	ollamaClient *ollama.Client
+	agents      map[string]*Agent // indexed by ID
+	agentsMutex sync.RWMutex      // protects agents and deletingAgents
+	// IDs of deleted agents, reserved until their collection is removed
+	deletingAgents = make(map[string]bool)
+	memoryStore    MemoryStore
+	ollamaClient   *ollama.Client
 )
 
 type Agent struct {
 	System string `json:"system,omitempty"` // system prompt for the agent
 	Name   string `json:"name,omitempty"`
-	// initial NPC behavior code
-	// agents with no initial code will never try to update it
+	// NPC behavior code, updated by the agent when conversations
+	// should change the way it acts (see BehaviorCodeUpdates).
 	BehaviorCode string `json:"behavior-code,omitempty"`
-	ID           string `json:"id,omitempty"`
+	// previous and current versions of the behavior code
+	BehaviorCodeHistory []BehaviorCodeVersion `json:"behavior-code-history,omitempty"`
+	// set when the agent is created with behavior code, only these
+	// agents update it (code added later with PATCH doesn't change that)
+	BehaviorCodeUpdates bool   `json:"behavior-code-updates,omitempty"`
+	ID                  string `json:"id,omitempty"`
+	// LLM backend ("ollama", "openai"), server's default when empty
+	Backend string `json:"backend,omitempty"`
+	// model used by the agent, backend's default when empty
+	Model string `json:"model,omitempty"`
+	// filter expression restricting memories recalled by the agent
+	// (see filter.go), config's memory filter when empty
+	MemoryFilter string `json:"memory-filter,omitempty"`
+	// memory retrieval settings overridden by the agent, config's when nil
+	Retrieval *RetrievalOverrides `json:"retrieval,omitempty"`
+	// name of the prompt template (see templates.go), config's default when empty
+	PromptTemplate string `json:"prompt-template,omitempty"`
 	// Full system prompt, assembled using generic agent system prompt,
 	// provided system prompt, agent's name & behavior code.
 	FullSystemPrompt string `json:"-"`
@@ -53,176 +59,792 @@ func serveAPI(port string) {
 
 	gin.SetMode(gin.ReleaseMode)
 
-	chromaClient, err = NewChromaClient(CHROMA_DB_HOST_ADDR, CHROMA_DB_TENANT, CHROMA_DB_DATABASE)
+	memoryStore, err = NewMemoryStore(config.Memory.Store)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+
+	ollamaClient, err = newOllamaClient()
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+
+	openAIGenerator, err := NewOpenAIGenerator(config.OpenAI.BaseURL, config.OpenAI.APIKey, config.OpenAI.Model)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+
+	embedder, err = NewEmbedder(config.Embeddings.Backend)
 	if err != nil {
 		fmt.Println("❌", err.Error())
 		return
 	}
 
-	ollamaClient, _ = ollama.ClientFromEnvironment()
+	llmBackends = map[string]TextGenerator{
+		LLM_BACKEND_OLLAMA: NewOllamaGenerator(ollamaClient, config.Ollama.Model),
+		LLM_BACKEND_OPENAI: openAIGenerator,
+	}
+
+	promptTemplates, err = loadPromptTemplates(config.Prompts.Dir)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+	if _, err := getPromptTemplate(""); err != nil {
+		fmt.Println("❌ default", err.Error())
+		return
+	}
+
+	agents, err = loadAgents(config.AgentsFile)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+	fmt.Println("Agents loaded:", len(agents))
+
+	// template files may have been removed since agents were saved
+	for _, agent := range agents {
+		if err := checkPromptTemplate(agent.PromptTemplate); err != nil {
+			fmt.Println("❌ agent "+agent.ID+":", err.Error())
+			return
+		}
+	}
+
+	router := newRouter()
+
+	startConsolidationJob(config.Memory.Consolidation)
+
+	server := &http.Server{Addr: port, Handler: router}
+
+	// stopping on interrupt, so main can close the memory store
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
 
-	agents = make(map[string]*Agent)
-	fmt.Println(agents)
+	fmt.Println("Serving API... (" + port + ")")
+	err = server.ListenAndServe()
+	if err != nil && errors.Is(err, http.ErrServerClosed) == false {
+		fmt.Println("❌", err.Error())
+	}
+}
 
+// Returns router serving API endpoints
+func newRouter() *gin.Engine {
 	router := gin.Default()
+	router.GET("/agents", listAgents)
 	router.POST("/agents", createAgent)
+	router.GET("/agents/:id", getAgent)
+	router.PATCH("/agents/:id", updateAgent)
+	router.DELETE("/agents/:id", deleteAgent)
 	router.POST("/agents/:id/ask", askAgent)
+	router.POST("/agents/:id/ask/stream", askAgentStream)
+	router.GET("/agents/:id/memories", listMemories)
+	router.POST("/agents/:id/reflect", reflectAgent)
+	router.POST("/agents/:id/consolidate", consolidateAgent)
+	router.GET("/agents/:id/conversations/:sender", getConversation)
+	router.DELETE("/agents/:id/conversations/:sender", deleteConversation)
+	router.GET("/prompt-templates", listPromptTemplates)
+	router.POST("/prompt-templates/validate", validatePromptTemplate)
+	router.GET("/ws", serveWebSocket)
+	router.POST("/agents/:id/events", postAgentEvent)
+	router.GET("/collections", listCollections)
+	return router
+}
 
-	fmt.Println("Serving API... (" + port + ")")
-	router.Run(port)
+var (
+	errAgentNameRequired = errors.New("agent name is required")
+	errAgentExists       = errors.New("agent already exists")
+)
+
+// Returns the agent ID derived from name ("Old Bob" -> "old_bob")
+func agentNameKey(name string) string {
+	key := strings.TrimSpace(strings.ToLower(name))
+	return strings.ReplaceAll(key, " ", "_")
 }
 
-func createAgent(c *gin.Context) {
-	var agent Agent
-	if err := c.BindJSON(&agent); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// Returns an agent, other than the one with ID except, whose name has
+// the same key as name ("bob" and "Bob" can't be used by 2 agents).
+// agentsMutex should be locked by caller.
+func agentNamed(name string, except string) *Agent {
+	key := agentNameKey(name)
+	for _, agent := range agents {
+		if agent.ID != except && agentNameKey(agent.Name) == key {
+			return agent
+		}
 	}
+	return nil
+}
 
-	agentID := strings.TrimSpace(strings.ToLower(agent.Name))
-	agentID = strings.ReplaceAll(agentID, " ", "_")
+// Returns an unused agent ID derived from name. IDs don't change when agents
+// are renamed, a suffix is added when the ID is still used ("bob_2"), by an
+// agent, by a collection (orphaned collections keep deleted agents' memories)
+// or by an agent being deleted. agentsMutex should be locked by caller.
+func newAgentID(name string, collections map[string]bool) string {
+	key := agentNameKey(name)
+	agentID := key
+	for n := 2; agents[agentID] != nil || deletingAgents[agentID] || collections[agentID]; n++ {
+		agentID = key + "_" + strconv.Itoa(n)
+	}
+	return agentID
+}
 
-	if oldAgent, exists := agents[agentID]; exists {
-		agent = *oldAgent
-		fmt.Println("⚠️ Agent already exists (not replacing it)")
+// Registers new agent, creating its memory collection.
+// Agent ID is derived from its name (see newAgentID).
+func addAgent(ctx context.Context, agent Agent) (*Agent, error) {
+	if agentNameKey(agent.Name) == "" {
+		return nil, errAgentNameRequired
+	}
 
-	} else {
-		agent.ID = agentID
+	err := checkBackend(agent.Backend)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err := chromaClient.GetCollection(agent.ID)
+	_, err = ParseFilter(agent.MemoryFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	if agent.Retrieval != nil {
+		err = agent.Retrieval.validate()
 		if err != nil {
-			fmt.Println("❌", err.Error())
-			return
+			return nil, err
 		}
+	}
 
-		// Key does not exist, insert it
-		agents[agentID] = &agent
-		fmt.Println("✨ Agent", agent.Name, "created (ID:"+agent.ID+")")
+	err = checkPromptTemplate(agent.PromptTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	// not holding the lock while the memory store is called,
+	// requests to other agents shouldn't wait for it
+	list, err := memoryStore.ListCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collections := make(map[string]bool, len(list))
+	for _, collection := range list {
+		collections[collection.GetName()] = true
+	}
+
+	agentsMutex.RLock()
+	existing := agentNamed(agent.Name, "")
+	agentID := newAgentID(agent.Name, collections)
+	agentsMutex.RUnlock()
+	if existing != nil {
+		return nil, fmt.Errorf("%w (ID:%s)", errAgentExists, existing.ID)
+	}
+
+	agent.ID = agentID
+	agent.BehaviorCodeHistory = nil
+	agent.BehaviorCodeUpdates = agent.BehaviorCode != ""
+	if agent.BehaviorCode != "" {
+		agent.BehaviorCodeHistory = []BehaviorCodeVersion{
+			{Version: 1, Code: agent.BehaviorCode, UpdatedAt: time.Now()},
+		}
+	}
+
+	_, err = memoryStore.GetCollection(ctx, agent.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+
+	// may have been created meanwhile
+	if existing := agentNamed(agent.Name, ""); existing != nil {
+		return nil, fmt.Errorf("%w (ID:%s)", errAgentExists, existing.ID)
+	}
+	if _, exists := agents[agentID]; exists || deletingAgents[agentID] {
+		return nil, fmt.Errorf("%w (ID:%s)", errAgentExists, agentID)
+	}
+
+	agents[agentID] = &agent
+
+	err = saveAgents(config.AgentsFile, agents)
+	if err != nil {
+		// agents file and memory should not disagree
+		delete(agents, agentID)
+		return nil, err
+	}
+
+	fmt.Println("✨ Agent", agent.Name, "created (ID:"+agent.ID+")")
+	return &agent, nil
+}
+
+func createAgent(c *gin.Context) {
+	var req Agent
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agent, err := addAgent(c.Request.Context(), req)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAgentNameRequired), errors.Is(err, errUnknownBackend), errors.Is(err, ErrInvalidArgument):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, errAgentExists):
+			// PATCH /agents/:id should be used to update an existing agent
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			fmt.Println("❌", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
 	}
 
 	c.JSON(http.StatusOK, agent)
 }
 
-type AskAgentReq struct {
-	Sender string `json:"sender,omitempty"` // name of the sender
-	Prompt string `json:"prompt,omitempty"`
+// Returns agent with given ID, or nil if not found
+func getAgentByID(agentID string) *Agent {
+	agentsMutex.RLock()
+	defer agentsMutex.RUnlock()
+	return agents[agentID]
 }
 
-// Agent respond can be something to say, but it can also be a update of its own behavior code
-type AskAgentRes struct {
-	AgentID            string `json:"agent,omitempty"` // name of responding agent
-	Say                string `json:"say,omitempty"`
-	BehaviorCodeUpdate string `json:"behavior-code-update,omitempty"`
+func listAgents(c *gin.Context) {
+	agentsMutex.RLock()
+	list := make([]*Agent, 0, len(agents))
+	for _, agent := range agents {
+		list = append(list, agent)
+	}
+	agentsMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	c.JSON(http.StatusOK, list)
 }
 
-func askAgent(c *gin.Context) {
-	fmt.Println("askAgent")
-	agentID := c.Param("id")
+func getAgent(c *gin.Context) {
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
 
-	var req AskAgentReq
+	c.JSON(http.StatusOK, agent)
+}
+
+// Fields that can be updated with PATCH /agents/:id
+// (nil fields are left untouched)
+type UpdateAgentReq struct {
+	System       *string `json:"system,omitempty"`
+	Name         *string `json:"name,omitempty"`
+	BehaviorCode *string `json:"behavior-code,omitempty"`
+	Backend      *string `json:"backend,omitempty"`
+	Model        *string `json:"model,omitempty"`
+	MemoryFilter *string `json:"memory-filter,omitempty"`
+	// replaces agent's retrieval settings (missing fields use config's)
+	Retrieval *RetrievalOverrides `json:"retrieval,omitempty"`
+	// agent uses config's retrieval settings again
+	ResetRetrieval bool `json:"reset-retrieval,omitempty"`
+	// empty string to use config's default template
+	PromptTemplate *string `json:"prompt-template,omitempty"`
+}
+
+func updateAgent(c *gin.Context) {
+	var req UpdateAgentReq
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if req.Name != nil && agentNameKey(*req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent name can't be empty"})
+		return
+	}
+
+	if req.Backend != nil {
+		if err := checkBackend(*req.Backend); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.MemoryFilter != nil {
+		if _, err := ParseFilter(*req.MemoryFilter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.Retrieval != nil {
+		if err := req.Retrieval.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.PromptTemplate != nil {
+		if err := checkPromptTemplate(*req.PromptTemplate); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+
+	agent, exists := agents[c.Param("id")]
+	if exists == false {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	if req.Name != nil {
+		if existing := agentNamed(*req.Name, agent.ID); existing != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Errorf("%w (ID:%s)", errAgentExists, existing.ID).Error()})
+			return
+		}
+	}
+
+	// Agents are updated with a copy, requests being
+	// processed keep using the previous version.
+	// NOTE: ID doesn't change when renaming agents,
+	// it's used to name the agent's memory collection.
+	updated := *agent
+	if req.System != nil {
+		updated.System = *req.System
+	}
+	if req.Name != nil {
+		updated.Name = *req.Name
+	}
+	if req.BehaviorCode != nil {
+		updated.setBehaviorCode(*req.BehaviorCode, "api")
+	}
+	if req.Backend != nil {
+		updated.Backend = *req.Backend
+	}
+	if req.Model != nil {
+		updated.Model = *req.Model
+	}
+	if req.MemoryFilter != nil {
+		updated.MemoryFilter = *req.MemoryFilter
+	}
+	if req.Retrieval != nil {
+		updated.Retrieval = req.Retrieval
+	}
+	if req.ResetRetrieval {
+		updated.Retrieval = nil
+	}
+	if req.PromptTemplate != nil {
+		updated.PromptTemplate = *req.PromptTemplate
+	}
+
+	agents[updated.ID] = &updated
+
+	err := saveAgents(config.AgentsFile, agents)
+	if err != nil {
+		// agents file and memory should not disagree
+		agents[updated.ID] = agent
+		fmt.Println("❌", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Println("✏️ Agent", updated.Name, "updated (ID:"+updated.ID+")")
+	c.JSON(http.StatusOK, updated)
+}
+
+// Deletes agent, including its memory
+func deleteAgent(c *gin.Context) {
+	agentID := c.Param("id")
+
+	agentsMutex.Lock()
+
 	agent, exists := agents[agentID]
 	if exists == false {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown agent"})
+		agentsMutex.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
 		return
 	}
 
-	resp, err := ollamaClient.Embeddings(context.Background(), &ollama.EmbeddingRequest{
-		Model:  "mxbai-embed-large",
-		Prompt: req.Prompt,
-	})
+	delete(agents, agentID)
+
+	// agents file is saved first: if the collection can't be removed,
+	// it's listed by GET /collections?orphaned=true (memories are kept)
+	err := saveAgents(config.AgentsFile, agents)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		agents[agentID] = agent
+		agentsMutex.Unlock()
+		fmt.Println("❌", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	embedding := resp.Embedding
 
-	agentMem, err := chromaClient.GetCollection(agent.ID)
+	// ID is reserved until the collection is removed, a new agent
+	// using it would get the old memories, or lose its collection
+	deletingAgents[agentID] = true
+
+	agentsMutex.Unlock()
+
+	clearConversations(agentID, nil)
+
+	// not holding the lock while the memory store is called
+	err = memoryStore.RemoveCollection(c.Request.Context(), agentID)
+	// collection may have been removed manually
+	if err != nil && errors.Is(err, ErrNotFound) == false {
+		fmt.Println("⚠️ agent deleted, but not its memory collection (ID:"+agentID+"):", err.Error())
+	}
+
+	agentsMutex.Lock()
+	delete(deletingAgents, agentID)
+	agentsMutex.Unlock()
+
+	fmt.Println("🗑️ Agent deleted (ID:" + agentID + ")")
+	c.Status(http.StatusNoContent)
+}
+
+type CollectionInfo struct {
+	Name     string         `json:"name"`
+	Metadata map[string]any `json:"metadata,omitempty"`
+	Count    int            `json:"count"`
+	// agent owning the collection, empty for orphaned collections
+	AgentID string `json:"agent,omitempty"`
+}
+
+// Lists memory collections, to audit orphaned ones
+// (GET /collections?orphaned=true only lists orphaned collections)
+func listCollections(c *gin.Context) {
+	collections, err := memoryStore.ListCollections(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	embeddings, err := agentMem.Query(ChromaCollectionQuery{
-		Embeddings: [][]float64{
-			embedding,
-		},
-	})
+	orphanedOnly := c.Query("orphaned") == "true"
+
+	list := make([]CollectionInfo, 0, len(collections))
+	for _, collection := range collections {
+		info := CollectionInfo{
+			Name:     collection.GetName(),
+			Metadata: collection.GetMetadata(),
+		}
+		if agent := getAgentByID(info.Name); agent != nil {
+			info.AgentID = agent.ID
+		}
+		if orphanedOnly && info.AgentID != "" {
+			continue
+		}
+		info.Count, err = collection.Count(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list = append(list, info)
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// Lists agent's memories (see Memory), without embeddings.
+// Query parameters:
+// - where: filter expression (see filter.go), e.g. sender == "bob" && doc contains "sword"
+// - limit & offset: pagination
+func listMemories(c *gin.Context) {
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	filter, err := ParseFilter(c.Query("where"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	memories := ""
-	for _, e := range embeddings {
-		memories += "- " + e.Document + "\n"
+	get := ChromaCollectionGet{
+		Where:         filter.Where,
+		WhereDocument: filter.WhereDocument,
+		Include:       []string{INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+	}
+	for param, value := range map[string]*int{"limit": &get.Limit, "offset": &get.Offset} {
+		if str := c.Query(param); str != "" {
+			*value, err = strconv.Atoi(str)
+			if err != nil || *value < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " should be a positive integer"})
+				return
+			}
+		}
 	}
 
-	completeInput := fmt.Sprintf(system_prompt_format, agent.Name, agent.System, memories, req.Sender, req.Prompt)
+	collection, err := memoryStore.GetCollection(c.Request.Context(), agent.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	fmt.Println("COMPLETE INPUT:\n", completeInput)
+	entries, err := collection.Get(c.Request.Context(), get)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidArgument) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
 
-	stream := false
+	c.JSON(http.StatusOK, memoriesFromEntries(entries))
+}
 
-	gReq := &ollama.GenerateRequest{
-		Model:  "llama3",
-		Prompt: completeInput,
-		// System: "Always give shortest possible answers, like when chatting on Discord. Use emojis when possible, but not too much.",
-		// Template: "",
-		Stream: &stream,
-		// Format: "",
-		// Options: map[string]interface{}
+// Makes agent reflect on memories accumulated since its last reflection,
+// whatever their number. Returns new reflections.
+func reflectAgent(c *gin.Context) {
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
 	}
 
-	res := AskAgentRes{
-		AgentID:            agent.ID,
-		Say:                "",
-		BehaviorCodeUpdate: "",
+	if startReflecting(agent.ID) == false {
+		c.JSON(http.StatusConflict, gin.H{"error": "agent is already reflecting"})
+		return
 	}
+	defer stopReflecting(agent.ID)
 
-	ollamaClient.Generate(context.Background(), gReq, func(r ollama.GenerateResponse) error {
-		fmt.Printf("%s", r.Response)
-		res.Say = r.Response
-		return nil
-	})
+	collection, err := memoryStore.GetCollection(c.Request.Context(), agent.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	memory := req.Sender + " said: " + req.Prompt + "\nYOUR ANSWER: " + res.Say
-	hash := md5.New()
-	io.WriteString(hash, memory)
-	hashBytes := hash.Sum(nil)
-	hashString := hex.EncodeToString(hashBytes)
-	// fmt.Println("ID:", hashString)
+	memories, err := memoriesSinceLastReflection(c.Request.Context(), collection)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(memories) == 0 {
+		c.JSON(http.StatusOK, []Memory{})
+		return
+	}
 
-	resp, err = ollamaClient.Embeddings(context.Background(), &ollama.EmbeddingRequest{
-		Model:  "mxbai-embed-large",
-		Prompt: memory,
-	})
+	reflections, err := reflectOnMemories(c.Request.Context(), agent, collection, memories)
+	reflectionDone(agent.ID, len(memories), err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, reflections)
+}
+
+// Consolidates agent's memories, following config's retention policy.
+// POST /agents/:id/consolidate?dry-run=true only reports what would be done.
+func consolidateAgent(c *gin.Context) {
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	dryRun := c.Query("dry-run") == "true"
+
+	if startConsolidating(agent.ID) == false {
+		c.JSON(http.StatusConflict, gin.H{"error": "agent memories are already being consolidated"})
+		return
+	}
+	defer stopConsolidating(agent.ID)
+
+	collection, err := memoryStore.GetCollection(c.Request.Context(), agent.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := consolidateMemories(c.Request.Context(), agent, collection, config.Memory.Consolidation, dryRun)
+	if err != nil {
+		// report describes what was done before the error
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// Returns agent's last exchanges with sender, oldest first
+// (the ones included in prompts, see conversation.go).
+func getConversation(c *gin.Context) {
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	c.JSON(http.StatusOK, conversationTurns(agent.ID, c.Param("sender")))
+}
+
+// Clears agent's conversation with sender,
+// exchanges remain in agent's memory.
+func deleteConversation(c *gin.Context) {
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	sender := c.Param("sender")
+	clearConversations(agent.ID, &sender)
+	c.Status(http.StatusNoContent)
+}
+
+func listPromptTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, sortedPromptTemplates())
+}
+
+// Template to validate, by name or text, and data to render it with
+type ValidatePromptTemplateReq struct {
+	Name string      `json:"name,omitempty"`
+	Text string      `json:"text,omitempty"`
+	Data *PromptData `json:"data,omitempty"` // sample data when nil
+}
+
+// Renders a template, returning the prompt and its estimated number of tokens
+func validatePromptTemplate(c *gin.Context) {
+	var req ValidatePromptTemplateReq
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var tmpl *PromptTemplate
+	var err error
+	if req.Text != "" {
+		tmpl, err = parsePromptTemplate("validation", req.Text)
+	} else {
+		tmpl, err = getPromptTemplate(req.Name)
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	data := samplePromptData()
+	if req.Data != nil {
+		data = *req.Data
+	}
+
+	// execution errors are the validated template's (or data's) fault
+	prompt, err := tmpl.render(data)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	agentMem.Add([]ChromaCollectionEntry{
-		{
-			Embedding: &resp.Embedding,
-			Document:  memory,
-			// Metadatas: map[string]any{"createdAt": 1234},
-			ID: hashString,
-		},
-	})
+	c.JSON(http.StatusOK, gin.H{"prompt": prompt, "tokens": estimateTokens(prompt)})
+}
+
+type AskAgentReq struct {
+	Sender string `json:"sender,omitempty"` // name of the sender
+	Prompt string `json:"prompt,omitempty"`
+	// Optional context, stored with the memory of the exchange
+	ConversationID string `json:"conversation-id,omitempty"`
+	Location       string `json:"location,omitempty"`
+	// game clock, in seconds. When provided, relative times in prompts
+	// ("yesterday Bob told you...") are based on game time.
+	GameTime *float64 `json:"game-time,omitempty"`
+	// world state, available in prompt templates
+	// e.g. {"weather": "rainy", "time-of-day": "evening"}
+	World map[string]any `json:"world,omitempty"`
+}
+
+// Agent respond can be something to say, but it can also be a update of its own behavior code
+type AskAgentRes struct {
+	AgentID            string `json:"agent,omitempty"` // name of responding agent
+	Say                string `json:"say,omitempty"`
+	BehaviorCodeUpdate string `json:"behavior-code-update,omitempty"`
+	// Fields below are only set when the model replied in JSON mode
+	// (config.StructuredOutput), game can use them to animate NPCs.
+	Emotion string `json:"emotion,omitempty"`
+	Action  string `json:"action,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+func askAgent(c *gin.Context) {
+	fmt.Println("askAgent")
+	agentID := c.Param("id")
+
+	var req AskAgentReq
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agent := getAgentByID(agentID)
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	res, err := ask(c.Request.Context(), agent, req, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	pushEvent(agent.ID, WSEvent{Kind: WS_EVENT_AGENT_SAID, Data: res}, nil)
 
 	c.JSON(http.StatusOK, res)
 }
 
-func onAgentResponse(r ollama.GenerateResponse) error {
-	fmt.Printf("%s", r.Response)
-	// if r.Done {
-	// 	fmt.Printf("\n")
-	// 	c <- 0
-	// }
-	return nil
+// Same as askAgent, but streams response using Server-Sent Events:
+// - "chunk" events for each generated chunk (ollama.GenerateResponse)
+// - "done" event with complete AskAgentRes, once memory has been stored
+// (chunks are raw model output, they may be JSON when config.StructuredOutput
+// is enabled, and they may include behavior code updates that are only extracted
+// in the "done" event. When the model has to try again, chunks of the new
+// attempt follow those of the failed one.)
+// - "error" event if something goes wrong after streaming started
+func askAgentStream(c *gin.Context) {
+	agentID := c.Param("id")
+
+	var req AskAgentReq
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agent := getAgentByID(agentID)
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // disables proxy buffering (nginx)
+
+	res, err := ask(c.Request.Context(), agent, req, func(r ollama.GenerateResponse) error {
+		c.SSEvent("chunk", r)
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		c.SSEvent("error", gin.H{"error": err.Error()})
+		c.Writer.Flush()
+		return
+	}
+
+	pushEvent(agent.ID, WSEvent{Kind: WS_EVENT_AGENT_SAID, Data: res}, nil)
+
+	c.SSEvent("done", res)
+	c.Writer.Flush()
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	ollama "github.com/ollama/ollama/api"
+)
+
+// Uses a temporary agents file, no agents and an in-memory store,
+// restored when the test ends
+func setupTestAgents(t *testing.T) {
+	t.Helper()
+	previousAgents, previousStore, previousFile := agents, memoryStore, config.AgentsFile
+	t.Cleanup(func() {
+		agents, memoryStore, config.AgentsFile = previousAgents, previousStore, previousFile
+	})
+
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	agents = make(map[string]*Agent)
+	memoryStore = store
+	config.AgentsFile = filepath.Join(t.TempDir(), "agents.json")
+}
+
+// Text generator replying with given chunks, then failing with err
+// (if not nil). The complete reply is sent at once when not streaming.
+type stubGenerator struct {
+	chunks  []string
+	err     error
+	prompts []string // received
+}
+
+func (g *stubGenerator) Generate(ctx context.Context, req GenerateRequest, fn func(ollama.GenerateResponse) error) error {
+	g.prompts = append(g.prompts, req.Prompt)
+	if req.Stream == false {
+		if g.err != nil {
+			return g.err
+		}
+		return fn(ollama.GenerateResponse{Response: strings.Join(g.chunks, ""), Done: true})
+	}
+	for i, chunk := range g.chunks {
+		err := fn(ollama.GenerateResponse{Response: chunk, Done: g.err == nil && i == len(g.chunks)-1})
+		if err != nil {
+			return err
+		}
+	}
+	return g.err
+}
+
+func (g *stubGenerator) DefaultModel() string {
+	return "stub"
+}
+
+// Sets up agents (see setupTestAgents), hash embeddings, built-in templates
+// and generator as default backend, restored when the test ends.
+// Memories are neither rated nor reflected on.
+func setupTestAPI(t *testing.T, generator TextGenerator) *gin.Engine {
+	t.Helper()
+	setupTestAgents(t)
+
+	previousConfig := *config
+	previousEmbedder, previousBackends, previousTemplates := embedder, llmBackends, promptTemplates
+	t.Cleanup(func() {
+		*config = previousConfig
+		embedder, llmBackends, promptTemplates = previousEmbedder, previousBackends, previousTemplates
+	})
+
+	var err error
+	promptTemplates, err = loadPromptTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder = NewHashEmbedder(64)
+	llmBackends = map[string]TextGenerator{LLM_BACKEND_OLLAMA: generator}
+	config.LLM.Backend = LLM_BACKEND_OLLAMA
+	config.StructuredOutput = false
+	config.Memory.RateImportance = false
+	config.Memory.Reflection.Threshold = 0
+
+	gin.SetMode(gin.TestMode)
+	return newRouter()
+}
+
+// Memory store whose RemoveCollection sends the collection's name
+// to removing, and waits for release to be closed
+type blockingRemoveStore struct {
+	MemoryStore
+	removing chan string
+	release  chan struct{}
+}
+
+func (s *blockingRemoveStore) RemoveCollection(ctx context.Context, name string) error {
+	s.removing <- name
+	<-s.release
+	return s.MemoryStore.RemoveCollection(ctx, name)
+}
+
+func TestNewAgentID(t *testing.T) {
+	previous := agents
+	defer func() { agents = previous }()
+	agents = map[string]*Agent{
+		"bob":   {ID: "bob", Name: "Bob"},
+		"bob_2": {ID: "bob_2", Name: "Robert"},
+	}
+
+	tests := []struct {
+		name        string
+		collections map[string]bool
+		id          string
+	}{
+		{"Old Alice", nil, "old_alice"},
+		{" Bob ", nil, "bob_3"},
+		// orphaned collections aren't reused
+		{"Alice", map[string]bool{"alice": true}, "alice_2"},
+		{"bob", map[string]bool{"bob_3": true}, "bob_4"},
+	}
+
+	for _, test := range tests {
+		if id := newAgentID(test.name, test.collections); id != test.id {
+			t.Errorf("newAgentID(%q, %v) = %q, want %q", test.name, test.collections, id, test.id)
+		}
+	}
+}
+
+func TestAddAgentUnknownPromptTemplate(t *testing.T) {
+	previous := promptTemplates
+	defer func() { promptTemplates = previous }()
+	var err error
+	promptTemplates, err = loadPromptTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = addAgent(context.Background(), Agent{Name: "Bob", PromptTemplate: "nope"})
+	if errors.Is(err, ErrInvalidArgument) == false {
+		t.Errorf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	if err := checkPromptTemplate(""); err != nil {
+		t.Errorf("default template: got error %v", err)
+	}
+	if err := checkPromptTemplate(CHAT_PROMPT_TEMPLATE); err != nil {
+		t.Errorf("%s template: got error %v", CHAT_PROMPT_TEMPLATE, err)
+	}
+}
+
+func TestDeleteAgentReservesID(t *testing.T) {
+	setupTestAgents(t)
+	store := &blockingRemoveStore{
+		MemoryStore: memoryStore,
+		removing:    make(chan string),
+		release:     make(chan struct{}),
+	}
+	memoryStore = store
+	ctx := context.Background()
+
+	bob, err := addAgent(ctx, Agent{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := make(chan int)
+	go func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("DELETE", "/agents/"+bob.ID, nil)
+		c.Params = gin.Params{{Key: "id", Value: bob.ID}}
+		deleteAgent(c)
+		deleted <- c.Writer.Status()
+	}()
+	if name := <-store.removing; name != bob.ID {
+		t.Fatalf("removing collection %s, want %s", name, bob.ID)
+	}
+
+	// created while the old collection is being removed
+	newBob, err := addAgent(ctx, Agent{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBob.ID == bob.ID {
+		t.Errorf("new agent got the ID of the agent being deleted (%s)", bob.ID)
+	}
+
+	close(store.release)
+	if code := <-deleted; code != http.StatusNoContent {
+		t.Errorf("delete status %d, want %d", code, http.StatusNoContent)
+	}
+
+	collections, err := memoryStore.ListCollections(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) != 1 || collections[0].GetName() != newBob.ID {
+		t.Errorf("collections after deletion: %v, want only %s", collections, newBob.ID)
+	}
+
+	// ID can be used again once the collection is removed
+	agentsMutex.RLock()
+	id := newAgentID("Bob", nil)
+	agentsMutex.RUnlock()
+	if id != bob.ID {
+		t.Errorf("ID after deletion %s, want %s", id, bob.ID)
+	}
+}
+
+// Server-Sent Event, see askAgentStream
+type testSSEvent struct {
+	name string
+	data string
+}
+
+func TestAskAgentStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator *stubGenerator
+		events    []string // names
+		data      string   // last event's data
+	}{
+		{
+			"done",
+			&stubGenerator{chunks: []string{"Hello ", "Alice!"}},
+			[]string{"chunk", "chunk", "done"},
+			`{"agent":"bob","say":"Hello Alice!"}`,
+		},
+		{
+			"error",
+			&stubGenerator{chunks: []string{"Hello "}, err: errors.New("model unloaded")},
+			[]string{"chunk", "error"},
+			`{"error":"model unloaded"}`,
+		},
+	}
+
+	for _, test := range tests {
+		router := setupTestAPI(t, test.generator)
+		_, err := addAgent(context.Background(), Agent{Name: "Bob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/agents/bob/ask/stream", strings.NewReader(`{"sender":"Alice","prompt":"Hi!"}`))
+		router.ServeHTTP(w, req)
+		clearConversations("bob", nil)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, http.StatusOK)
+			continue
+		}
+
+		// events are separated by blank lines
+		var events []testSSEvent
+		for _, block := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+			var event testSSEvent
+			for _, line := range strings.Split(block, "\n") {
+				field, value, _ := strings.Cut(line, ":")
+				switch field {
+				case "event":
+					event.name = value
+				case "data":
+					event.data = value
+				default:
+					t.Errorf("%s: unexpected line %q", test.name, line)
+				}
+			}
+			events = append(events, event)
+		}
+
+		var names []string
+		for _, event := range events {
+			names = append(names, event.name)
+		}
+		if reflect.DeepEqual(names, test.events) == false {
+			t.Errorf("%s: events %v, want %v", test.name, names, test.events)
+			continue
+		}
+		for i, chunk := range test.generator.chunks {
+			if strings.Contains(events[i].data, `"response":"`+chunk+`"`) == false {
+				t.Errorf("%s: chunk %d data %s, want response %q", test.name, i, events[i].data, chunk)
+			}
+		}
+		if last := events[len(events)-1]; last.data != test.data {
+			t.Errorf("%s: %s data %s, want %s", test.name, last.name, last.data, test.data)
+		}
+	}
+}
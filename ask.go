@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ollama "github.com/ollama/ollama/api"
+	"time"
+)
+
+// Asks agent to respond to a message, then stores the exchange in agent's memory.
+// When onResponse is not nil, the response is streamed, and onResponse is
+// called for each chunk as it's generated.
+func ask(ctx context.Context, agent *Agent, req AskAgentReq, onResponse func(ollama.GenerateResponse) error) (*AskAgentRes, error) {
+	if agent == nil {
+		return nil, errors.New("agent is nil")
+	}
+
+	embedding, err := embedder.Embed(ctx, req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	agentMem, err := memoryStore.GetCollection(ctx, agent.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkEmbeddingDimension(ctx, agentMem, embedder.Model(), len(embedding))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	recalled, err := recallMemories(ctx, agent, agentMem, embedding, now, req.GameTime)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := getPromptTemplate(agent.PromptTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := agentPromptBudget(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	data := PromptData{
+		Agent:          *agent,
+		Sender:         req.Sender,
+		Message:        req.Prompt,
+		ConversationID: req.ConversationID,
+		Location:       req.Location,
+		World:          req.World,
+		Conversation:   conversationTurns(agent.ID, req.Sender),
+		Memories:       promptMemories(recalled),
+		Now:            now,
+		GameTime:       req.GameTime,
+	}
+
+	res := &AskAgentRes{
+		AgentID: agent.ID,
+	}
+
+	// behavior code update, if any
+	code := ""
+	structured := false
+
+	if config.StructuredOutput {
+		data.BehaviorCode = behaviorCodePrompt(agent, true)
+		completeInput, report, err := assemblePrompt(tmpl, data, structuredPrompt(agent), budget)
+		if err != nil {
+			return nil, err
+		}
+		report.print(agent)
+
+		fmt.Println("COMPLETE INPUT:\n", completeInput)
+
+		for attempt := 0; attempt <= MAX_STRUCTURED_RETRIES; attempt++ {
+			text, err := generate(ctx, agent, completeInput, "json", onResponse)
+			if err != nil {
+				return nil, err
+			}
+			r, err := parseStructuredResponse(text)
+			if err != nil {
+				fmt.Println("⚠️", err.Error(), "(attempt", attempt+1, ")")
+				continue
+			}
+			res.Say = r.Say
+			res.Emotion = r.Emotion
+			res.Action = r.Action
+			res.Target = r.Target
+			code = r.BehaviorCodeUpdate
+			structured = true
+			break
+		}
+	}
+
+	if structured == false {
+		// plain text fallback
+		data.BehaviorCode = behaviorCodePrompt(agent, false)
+		completeInput, report, err := assemblePrompt(tmpl, data, "", budget)
+		if err != nil {
+			return nil, err
+		}
+		report.print(agent)
+
+		fmt.Println("COMPLETE INPUT:\n", completeInput)
+
+		text, err := generate(ctx, agent, completeInput, "", onResponse)
+		if err != nil {
+			return nil, err
+		}
+		res.Say, code = parseBehaviorCodeUpdate(text)
+	}
+
+	// agents with no code never update it
+	if agent.BehaviorCodeUpdates && code != "" && code != agent.BehaviorCode {
+		res.BehaviorCodeUpdate = code
+		_, err := updateAgentBehaviorCode(agent.ID, code, req.Sender)
+		if err != nil {
+			fmt.Println("❌ can't store behavior code:", err.Error())
+		}
+	}
+
+	memory := req.Sender + " said: " + req.Prompt + "\nYOUR ANSWER: " + res.Say
+	if res.Action != "" {
+		memory += "\nYOUR ACTION: " + res.Action
+		if res.Target != "" {
+			memory += " (" + res.Target + ")"
+		}
+	}
+	// unique ID, the same exchange may happen more than once
+	memoryID := newMemoryID(now)
+
+	addConversationTurn(agent.ID, ConversationTurn{
+		Sender:    req.Sender,
+		Message:   req.Prompt,
+		Answer:    res.Say,
+		Action:    res.Action,
+		Target:    res.Target,
+		MemoryID:  memoryID,
+		CreatedAt: now,
+		GameTime:  req.GameTime,
+	})
+
+	memoryEmbedding, err := embedder.Embed(ctx, memory)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Memory{
+		ID:             memoryID,
+		Document:       memory,
+		CreatedAt:      now,
+		GameTime:       req.GameTime,
+		Sender:         req.Sender,
+		AgentID:        agent.ID,
+		ConversationID: req.ConversationID,
+		Location:       req.Location,
+		Kind:           MEMORY_KIND_CONVERSATION,
+	}
+
+	err = agentMem.Add(ctx, []ChromaCollectionEntry{
+		{
+			Embedding: &memoryEmbedding,
+			Document:  m.Document,
+			Metadatas: m.metadata(),
+			ID:        m.ID,
+		},
+	})
+	if err != nil {
+		// not returning an error, the agent did respond
+		fmt.Println("❌ can't store memory:", err.Error())
+	} else {
+		if config.Memory.RateImportance {
+			rateMemoryImportance(agent, agentMem, m)
+		}
+		maybeReflect(agent, agentMem)
+	}
+
+	return res, nil
+}
+
+// Returns filter restricting memories recalled by the agent,
+// config's memory filter if the agent doesn't define one.
+func agentMemoryFilter(agent *Agent) (*Filter, error) {
+	expr := agent.MemoryFilter
+	if expr == "" {
+		expr = config.Memory.Filter
+	}
+	return ParseFilter(expr)
+}
+
+// Generates text for given prompt, using agent's LLM backend.
+// format can be "json" to force the model to reply with valid JSON.
+// onResponse, when not nil, is called for each chunk as it's generated.
+func generate(ctx context.Context, agent *Agent, prompt string, format string, onResponse func(ollama.GenerateResponse) error) (string, error) {
+	generator, model, err := agentGenerator(agent)
+	if err != nil {
+		return "", err
+	}
+
+	gReq := GenerateRequest{
+		Model:       model,
+		Prompt:      prompt,
+		Format:      format,
+		Stream:      onResponse != nil,
+		ContextSize: modelContextSize(model),
+	}
+
+	text := ""
+	err = generator.Generate(ctx, gReq, func(r ollama.GenerateResponse) error {
+		fmt.Printf("%s", r.Response)
+		// when not streaming, there's only one response
+		// with the complete text.
+		text += r.Response
+		if onResponse != nil {
+			return onResponse(r)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return text, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Max number of behavior code versions kept per agent
+	MAX_BEHAVIOR_CODE_HISTORY = 20
+
+	BEHAVIOR_CODE_OPEN_TAG  = "<behavior-code>"
+	BEHAVIOR_CODE_CLOSE_TAG = "</behavior-code>"
+
+	behavior_code_prompt_format = `
+Here's the code currently defining your behavior in the game:
+
+%s
+
+If the message you receive should change the way you act (for example if you're asked to follow someone),
+%s
+`
+	behavior_code_tags_instructions = `write your answer, then the complete updated code between ` + BEHAVIOR_CODE_OPEN_TAG + ` and ` + BEHAVIOR_CODE_CLOSE_TAG + `.
+Don't include the code if your behavior doesn't need to change.`
+	behavior_code_json_instructions = `put the complete updated code in "behavior-code-update".
+Leave it empty if your behavior doesn't need to change.`
+)
+
+type BehaviorCodeVersion struct {
+	Version   int       `json:"version"`
+	Code      string    `json:"code"`
+	UpdatedAt time.Time `json:"updated-at"`
+	// who triggered the update ("api" when updated with PATCH /agents/:id)
+	UpdatedBy string `json:"updated-by,omitempty"`
+}
+
+// Sets agent's behavior code, keeping track of previous versions.
+// Agent should be a copy, not an agent shared with other goroutines.
+func (a *Agent) setBehaviorCode(code string, updatedBy string) {
+	if code == a.BehaviorCode {
+		return
+	}
+
+	// history is copied, previous versions of the agent
+	// may still be in use.
+	history := make([]BehaviorCodeVersion, 0, len(a.BehaviorCodeHistory)+2)
+	history = append(history, a.BehaviorCodeHistory...)
+
+	// agents created before history was introduced
+	if len(history) == 0 && a.BehaviorCode != "" {
+		history = append(history, BehaviorCodeVersion{
+			Version: 1,
+			Code:    a.BehaviorCode,
+		})
+	}
+
+	version := 1
+	if len(history) > 0 {
+		version = history[len(history)-1].Version + 1
+	}
+
+	history = append(history, BehaviorCodeVersion{
+		Version:   version,
+		Code:      code,
+		UpdatedAt: time.Now(),
+		UpdatedBy: updatedBy,
+	})
+
+	if len(history) > MAX_BEHAVIOR_CODE_HISTORY {
+		history = history[len(history)-MAX_BEHAVIOR_CODE_HISTORY:]
+	}
+
+	a.BehaviorCode = code
+	a.BehaviorCodeHistory = history
+}
+
+// Returns the part of the prompt describing agent's behavior code.
+// Empty for agents that don't update their code (see Agent.BehaviorCodeUpdates).
+// structured indicates if the model is asked to reply in JSON.
+func behaviorCodePrompt(agent *Agent, structured bool) string {
+	if agent.BehaviorCodeUpdates == false || agent.BehaviorCode == "" {
+		return ""
+	}
+	instructions := behavior_code_tags_instructions
+	if structured {
+		instructions = behavior_code_json_instructions
+	}
+	return fmt.Sprintf(behavior_code_prompt_format, agent.BehaviorCode, instructions)
+}
+
+// Extracts behavior code update from the model's response.
+// Returns what the agent says (without code) and updated code
+// (empty when behavior doesn't change).
+func parseBehaviorCodeUpdate(response string) (say string, code string) {
+	start := strings.Index(response, BEHAVIOR_CODE_OPEN_TAG)
+	if start < 0 {
+		return response, ""
+	}
+
+	end := strings.Index(response[start:], BEHAVIOR_CODE_CLOSE_TAG)
+	if end < 0 {
+		// unterminated block, considering everything after the tag is code
+		end = len(response)
+	} else {
+		end += start
+	}
+
+	// models tend to wrap code in markdown blocks
+	code = trimCodeFence(response[start+len(BEHAVIOR_CODE_OPEN_TAG) : end])
+
+	say = strings.TrimSpace(response[:start])
+	if end+len(BEHAVIOR_CODE_CLOSE_TAG) <= len(response) {
+		after := strings.TrimSpace(response[end+len(BEHAVIOR_CODE_CLOSE_TAG):])
+		if after != "" {
+			say = strings.TrimSpace(say + " " + after)
+		}
+	}
+
+	return say, code
+}
+
+// Returns s without surrounding spaces and markdown code block
+// ("```lua\n...\n```"), if any
+func trimCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") == false {
+		return s
+	}
+	s = strings.TrimSuffix(s, "```")
+	if i := strings.Index(s, "\n"); i >= 0 {
+		// skips opening line, that may contain language name
+		s = s[i+1:]
+	} else {
+		s = strings.TrimPrefix(s, "```")
+	}
+	return strings.TrimSpace(s)
+}
+
+// Stores updated behavior code for given agent
+func updateAgentBehaviorCode(agentID string, code string, updatedBy string) (*Agent, error) {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+
+	agent, exists := agents[agentID]
+	if exists == false {
+		return nil, errors.New("unknown agent")
+	}
+
+	updated := *agent
+	updated.setBehaviorCode(code, updatedBy)
+	agents[agentID] = &updated
+
+	err := saveAgents(config.AgentsFile, agents)
+	if err != nil {
+		// agents file and memory should not disagree
+		agents[agentID] = agent
+		return nil, err
+	}
+
+	return &updated, nil
+}
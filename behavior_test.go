@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseBehaviorCodeUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		say      string
+		code     string
+	}{
+		{"no code", "Sure, see you later.", "Sure, see you later.", ""},
+		{"tags", "Sure! <behavior-code>follow(alice)</behavior-code>", "Sure!", "follow(alice)"},
+		{"text after code", "Ok <behavior-code>\nfollow(alice)\n</behavior-code> let's go", "Ok let's go", "follow(alice)"},
+		{"unterminated", "Ok <behavior-code>follow(alice)", "Ok", "follow(alice)"},
+		{"fence", "Ok <behavior-code>\n```\nfollow(alice)\n```\n</behavior-code>", "Ok", "follow(alice)"},
+		{"fence with language", "Ok <behavior-code>```lua\nfollow(alice)\nwave()\n```</behavior-code>", "Ok", "follow(alice)\nwave()"},
+		{"single line fence", "Ok <behavior-code>```follow(alice)```</behavior-code>", "Ok", "follow(alice)"},
+		{"empty code", "Ok <behavior-code> </behavior-code>", "Ok", ""},
+	}
+
+	for _, test := range tests {
+		say, code := parseBehaviorCodeUpdate(test.response)
+		if say != test.say || code != test.code {
+			t.Errorf("%s: got %q, %q, want %q, %q", test.name, say, code, test.say, test.code)
+		}
+	}
+}
+
+func TestSetBehaviorCode(t *testing.T) {
+	// agent created before history was introduced
+	agent := Agent{BehaviorCode: "idle()"}
+
+	agent.setBehaviorCode("idle()", "bob")
+	if len(agent.BehaviorCodeHistory) != 0 {
+		t.Fatalf("unchanged code should not be added to history: %v", agent.BehaviorCodeHistory)
+	}
+
+	agent.setBehaviorCode("follow(alice)", "alice")
+	if len(agent.BehaviorCodeHistory) != 2 {
+		t.Fatalf("got %d versions, want 2", len(agent.BehaviorCodeHistory))
+	}
+	last := agent.BehaviorCodeHistory[1]
+	if agent.BehaviorCode != "follow(alice)" || last.Version != 2 || last.Code != "follow(alice)" || last.UpdatedBy != "alice" {
+		t.Errorf("unexpected agent after update: %+v", agent)
+	}
+
+	// previous copies of the agent keep their history
+	previous := agent
+	for i := 0; i < MAX_BEHAVIOR_CODE_HISTORY; i++ {
+		agent.setBehaviorCode("wait("+strconv.Itoa(i)+")", "api")
+	}
+	if len(previous.BehaviorCodeHistory) != 2 || previous.BehaviorCodeHistory[1].Code != "follow(alice)" {
+		t.Errorf("previous agent history changed: %v", previous.BehaviorCodeHistory)
+	}
+	if len(agent.BehaviorCodeHistory) != MAX_BEHAVIOR_CODE_HISTORY {
+		t.Errorf("got %d versions, want %d", len(agent.BehaviorCodeHistory), MAX_BEHAVIOR_CODE_HISTORY)
+	}
+	if last := agent.BehaviorCodeHistory[MAX_BEHAVIOR_CODE_HISTORY-1]; last.Version != MAX_BEHAVIOR_CODE_HISTORY+2 {
+		t.Errorf("last version: %d, want %d", last.Version, MAX_BEHAVIOR_CODE_HISTORY+2)
+	}
+}
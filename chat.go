@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
 var (
@@ -17,7 +18,7 @@ var (
 )
 
 func serveChatCLI() {
-	chromaClient, err := NewChromaClient(CHROMA_DB_HOST_ADDR, CHROMA_DB_TENANT, CHROMA_DB_DATABASE)
+	chromaClient, err := newChromaClient()
 	if err != nil {
 		fmt.Println("❌", err.Error())
 		return
@@ -35,11 +36,31 @@ func serveChatCLI() {
 		return
 	}
 
+	promptTemplates, err = loadPromptTemplates(config.Prompts.Dir)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+
+	chatTemplate, err := getPromptTemplate(CHAT_PROMPT_TEMPLATE)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+
 	c = make(chan int)
 
-	client, _ := ollama.ClientFromEnvironment()
+	client, _ := newOllamaClient()
 	client.Heartbeat(context.Background())
 
+	var generator TextGenerator = NewOllamaGenerator(client, config.Ollama.Model)
+
+	chatEmbedder, err := NewEmbedder(config.Embeddings.Backend)
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		return
+	}
+
 	fmt.Println("COMMANDS: /store, /ask")
 
 	mode := "ask"
@@ -67,19 +88,17 @@ func serveChatCLI() {
 			continue
 		}
 
-		req := &ollama.EmbeddingRequest{
-			Model:  "mxbai-embed-large",
-			Prompt: input,
-			// KeepAlive
-			// Options
+		embedding, err := chatEmbedder.Embed(context.Background(), input)
+		if err != nil {
+			fmt.Println("❌", err.Error())
+			continue
 		}
 
-		resp, err := client.Embeddings(context.Background(), req)
+		err = checkEmbeddingDimension(context.Background(), chromaCollection{memories}, chatEmbedder.Model(), len(embedding))
 		if err != nil {
 			fmt.Println("❌", err.Error())
 			continue
 		}
-		embedding := resp.Embedding
 		// fmt.Println(embedding)
 
 		if mode == "ask" {
@@ -106,25 +125,25 @@ func serveChatCLI() {
 					}
 				*/
 
-				completeInput := "Using this data (provided by the user):\n"
-				for _, e := range embeddings {
-					completeInput += "- " + e.Document + "\n"
+				completeInput, err := chatTemplate.render(PromptData{
+					Message:  input,
+					Memories: promptMemories(memoriesFromEntries(embeddings)),
+					Now:      time.Now(),
+				})
+				if err != nil {
+					fmt.Println("❌", err.Error())
+					c <- 0
+					return
 				}
 
-				completeInput += "\nRespond to this prompt:\n" + input
-
 				fmt.Println("COMPLETE input:", completeInput)
 
-				gReq := &ollama.GenerateRequest{
-					Model:  "llama3",
+				gReq := GenerateRequest{
 					Prompt: completeInput,
 					System: "Always give shortest possible answers, like when chatting on Discord. Use emojis when possible, but not too much.",
-					// Template: "",
-					Stream: &stream,
-					// Format: "",
-					// Options: map[string]interface{}
+					Stream: stream,
 				}
-				client.Generate(context.Background(), gReq, onResponse)
+				generator.Generate(context.Background(), gReq, onResponse)
 			}()
 			<-c
 		} else if mode == "store" {
@@ -134,9 +153,9 @@ func serveChatCLI() {
 			hashString := hex.EncodeToString(hashBytes)
 			fmt.Println("ID:", hashString)
 
-			memories.Add([]ChromaCollectionEntry{
+			memories.Upsert([]ChromaCollectionEntry{
 				{
-					Embedding: &resp.Embedding,
+					Embedding: &embedding,
 					Document:  input,
 					// Metadatas: map[string]any{"createdAt": 1234},
 					ID: hashString,
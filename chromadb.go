@@ -2,26 +2,99 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	API_ROOT = "/api/v1"
+	API_ROOT = "/api"
+
+	// REST API versions.
+	// v1: /api/v1/collections/{name}?tenant={t}&database={d}
+	// v2: /api/v2/tenants/{t}/databases/{d}/collections/{name}
+	CHROMA_API_V1 = "v1"
+	CHROMA_API_V2 = "v2"
 )
 
 type ChromaClient struct {
-	baseURL    *url.URL
+	baseURL    *url.URL // server URL + API_ROOT, without version
 	tenant     string
 	database   string
 	httpClient *http.Client
+	options    ChromaClientOptions
+
+	apiVersionMutex sync.Mutex // protects fields below
+	apiVersion      string     // detected on first request if not set in options
+	// detection in progress, shared by concurrent requests (nil if none)
+	apiVersionDetection *chromaAPIVersionDetection
+}
+
+type chromaAPIVersionDetection struct {
+	done    chan struct{} // closed once detection is over
+	version string
+	err     error
+}
+
+type ChromaClientOptions struct {
+	// Timeout for each HTTP request (0 means no timeout)
+	Timeout time.Duration
+	// Number of retries for idempotent requests failing with
+	// connection or server errors
+	MaxRetries int
+	// Delay before first retry, doubled for each retry
+	RetryBackoff time.Duration
+	// Optional, see ChromaTokenAuth & ChromaBasicAuth
+	Auth ChromaAuth
+	// CHROMA_API_V1 or CHROMA_API_V2, detected using heartbeat
+	// endpoints when empty
+	APIVersion string
+}
+
+func DefaultChromaClientOptions() ChromaClientOptions {
+	return ChromaClientOptions{
+		Timeout:      30 * time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 200 * time.Millisecond,
+	}
+}
+
+// Adds authentication to requests sent to Chroma
+type ChromaAuth interface {
+	Authenticate(req *http.Request)
+}
+
+// Token authentication. Chroma accepts "Authorization: Bearer <token>"
+// (default) or "X-Chroma-Token: <token>" depending on server config.
+type ChromaTokenAuth struct {
+	Token  string
+	Header string // "Authorization" when empty
+}
+
+func (a ChromaTokenAuth) Authenticate(req *http.Request) {
+	if a.Header == "" || strings.EqualFold(a.Header, "Authorization") {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		return
+	}
+	req.Header.Set(a.Header, a.Token)
+}
+
+type ChromaBasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a ChromaBasicAuth) Authenticate(req *http.Request) {
+	req.SetBasicAuth(a.Username, a.Password)
 }
 
 type ChromaTenant struct {
@@ -41,6 +114,25 @@ type ChromaCollection struct {
 	Database string        `json:"database,omitempty"`
 	client   *ChromaClient `json:"-"` // keeps reference on Client
 	// Metadata field allows to customize the distance method https://docs.trychroma.com/usage-guide#changing-the-distance-function
+	// (using HNSW_SPACE_KEY when creating the collection)
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+const (
+	// collection metadata key defining distance function,
+	// can only be set when creating the collection.
+	HNSW_SPACE_KEY = "hnsw:space"
+	// prefix of HNSW index settings, same as HNSW_SPACE_KEY
+	HNSW_KEY_PREFIX = "hnsw:"
+
+	HNSW_SPACE_L2     = "l2" // squared L2, Chroma's default
+	HNSW_SPACE_COSINE = "cosine"
+	HNSW_SPACE_IP     = "ip" // inner product
+)
+
+type chromaCollectionUpdate struct {
+	NewName     string         `json:"new_name,omitempty"`
+	NewMetadata map[string]any `json:"new_metadata,omitempty"`
 }
 
 type ChromaCollectionEntry struct {
@@ -74,12 +166,40 @@ type ChromaCollectionBatchEntries struct {
 type ChromaCollectionQuery struct {
 	Embeddings [][]float64 `json:"query_embeddings,omitempty"`
 	// Texts []string `json:"query_texts,omitempty"` // not supported yet
-	NResults      int            `json:"n_results,omitempty"`
-	Where         *Where         `json:"where,omitempty"`
-	WhereDocument *WhereDocument `json:"where_document,omitempty"`
+	NResults      int           `json:"n_results,omitempty"`
+	Where         Where         `json:"where,omitempty"`
+	WhereDocument WhereDocument `json:"where_document,omitempty"`
+}
+
+type ChromaCollectionGet struct {
+	IDs           []string      `json:"ids,omitempty"`
+	Where         Where         `json:"where,omitempty"`
+	WhereDocument WhereDocument `json:"where_document,omitempty"`
+	Limit         int           `json:"limit,omitempty"`
+	Offset        int           `json:"offset,omitempty"`
+	// Chroma's default is documents & metadatas
+	Include []string `json:"include,omitempty"`
+}
+
+// Values for ChromaCollectionGet.Include
+const (
+	INCLUDE_EMBEDDINGS = "embeddings"
+	INCLUDE_DOCUMENTS  = "documents"
+	INCLUDE_METADATAS  = "metadatas"
+)
+
+// Entries to delete, using IDs and/or filters
+type ChromaCollectionDelete struct {
+	IDs           []string      `json:"ids,omitempty"`
+	Where         Where         `json:"where,omitempty"`
+	WhereDocument WhereDocument `json:"where_document,omitempty"`
 }
 
 func NewChromaClient(baseURLStr, tenant, database string) (*ChromaClient, error) {
+	return NewChromaClientWithOptions(baseURLStr, tenant, database, DefaultChromaClientOptions())
+}
+
+func NewChromaClientWithOptions(baseURLStr, tenant, database string, options ChromaClientOptions) (*ChromaClient, error) {
 
 	// Base URL
 	baseURL, err := url.Parse(baseURLStr)
@@ -87,9 +207,15 @@ func NewChromaClient(baseURLStr, tenant, database string) (*ChromaClient, error)
 		return nil, errors.New("Error parsing base URL:" + err.Error())
 	}
 
+	switch options.APIVersion {
+	case "", CHROMA_API_V1, CHROMA_API_V2:
+	default:
+		return nil, errors.New("unknown Chroma API version: " + options.APIVersion)
+	}
+
 	baseURL.Path = path.Join(baseURL.Path, API_ROOT)
 
-	if DEBUG {
+	if config.Debug {
 		fmt.Println("CLIENT URL:", baseURL.String())
 	}
 
@@ -97,49 +223,171 @@ func NewChromaClient(baseURLStr, tenant, database string) (*ChromaClient, error)
 		baseURL:    baseURL,
 		tenant:     tenant,
 		database:   database,
-		httpClient: &http.Client{},
+		httpClient: &http.Client{Timeout: options.Timeout},
+		options:    options,
+		apiVersion: options.APIVersion,
 	}, nil
 }
 
+// Returns REST API version used to talk to the server
+// (CHROMA_API_V1 or CHROMA_API_V2), detecting it if necessary.
+func (c *ChromaClient) APIVersion() (string, error) {
+	return c.APIVersionContext(context.Background())
+}
+
+// Same as APIVersion, using given context.
+// Concurrent requests share the same detection, each one
+// only waiting for it as long as its context allows.
+func (c *ChromaClient) APIVersionContext(ctx context.Context) (string, error) {
+	c.apiVersionMutex.Lock()
+	if c.apiVersion != "" {
+		c.apiVersionMutex.Unlock()
+		return c.apiVersion, nil
+	}
+	detection := c.apiVersionDetection
+	if detection == nil {
+		detection = &chromaAPIVersionDetection{done: make(chan struct{})}
+		c.apiVersionDetection = detection
+		go c.detectAPIVersion(detection)
+	}
+	c.apiVersionMutex.Unlock()
+
+	select {
+	case <-detection.done:
+		return detection.version, detection.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Detects API version, not holding the lock while requests are made.
+// Not using a request's context: detection is shared, and bounded by
+// client timeout & retries. Detection starts over after failures.
+func (c *ChromaClient) detectAPIVersion(detection *chromaAPIVersionDetection) {
+	detection.version, detection.err = c.requestAPIVersion(context.Background())
+
+	c.apiVersionMutex.Lock()
+	if detection.err == nil {
+		c.apiVersion = detection.version
+	}
+	c.apiVersionDetection = nil
+	c.apiVersionMutex.Unlock()
+
+	close(detection.done)
+}
+
+// Requests heartbeat endpoints to find the API version.
+func (c *ChromaClient) requestAPIVersion(ctx context.Context) (string, error) {
+	// Newer servers still expose v1 endpoints for a while,
+	// but v2 is preferred when available. Old servers don't
+	// know about v2, recent ones removed v1 (410 Gone).
+	// Servers requiring auth may reject unknown endpoints before
+	// routing them, v1 is tried when v2 is refused.
+	var authErr error
+	for _, version := range []string{CHROMA_API_V2, CHROMA_API_V1} {
+		url := *c.baseURL
+		url.Path = path.Join(url.Path, version, "heartbeat")
+
+		err := c.request(ctx, "GET", url, true, nil, nil, http.StatusOK)
+		if err != nil {
+			var chromaErr *ChromaError
+			if errors.As(err, &chromaErr) && (chromaErr.StatusCode == http.StatusNotFound || chromaErr.StatusCode == http.StatusGone) {
+				continue
+			}
+			if errors.Is(err, ErrUnauthorized) {
+				if authErr == nil {
+					authErr = err
+				}
+				continue
+			}
+			return "", err
+		}
+
+		if config.Debug {
+			fmt.Println("CHROMA API:", version)
+		}
+		return version, nil
+	}
+
+	if authErr != nil {
+		return "", fmt.Errorf("can't detect API version, check Chroma credentials: %w", authErr)
+	}
+	return "", errors.New("chroma: server doesn't support API " + CHROMA_API_V1 + " or " + CHROMA_API_V2)
+}
+
+// Returns Chroma server version (e.g. "0.5.20")
+func (c *ChromaClient) Version() (string, error) {
+	return c.VersionContext(context.Background())
+}
+
+// Same as Version, using given context
+func (c *ChromaClient) VersionContext(ctx context.Context) (string, error) {
+	url, err := c.apiURL(ctx, "version")
+	if err != nil {
+		return "", err
+	}
+
+	var version string
+	err = c.request(ctx, "GET", url, true, nil, &version, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
 func (c *ChromaClient) Check() error {
+	return c.CheckContext(context.Background())
+}
+
+// Same as Check, using given context
+func (c *ChromaClient) CheckContext(ctx context.Context) error {
 
-	tenant, err := c.GetTenant()
+	version, err := c.VersionContext(ctx)
+	if err != nil {
+		return err
+	}
+	if config.Debug {
+		fmt.Println("VERSION:", version)
+	}
+
+	tenant, err := c.GetTenantContext(ctx)
 	if err != nil {
 		return err
 	}
 	if tenant == nil {
 		return errors.New("tenant is nil")
 	}
-	if DEBUG {
+	if config.Debug {
 		fmt.Println("TENANT:")
 		printStruct(tenant)
 	}
 
-	database, err := c.GetDatabase()
+	database, err := c.GetDatabaseContext(ctx)
 	if err != nil {
 		return err
 	}
 	if database == nil {
 		return errors.New("database is nil")
 	}
-	if DEBUG {
+	if config.Debug {
 		fmt.Println("DATABASE:")
 		printStruct(database)
 	}
 
-	testCollection, err := c.GetCollection("test_collection")
+	testCollection, err := c.GetCollectionContext(ctx, "test_collection")
 	if err != nil {
 		return err
 	}
 	if testCollection == nil {
 		return errors.New("collection is nil")
 	}
-	if DEBUG {
+	if config.Debug {
 		fmt.Println("COLLECTION:")
 		printStruct(testCollection)
 	}
 
-	err = testCollection.Add([]ChromaCollectionEntry{
+	err = testCollection.AddContext(ctx, []ChromaCollectionEntry{
 		{
 			Embedding: &[]float64{1.0, 1.0, 1.0},
 			Document:  "test2",
@@ -152,7 +400,7 @@ func (c *ChromaClient) Check() error {
 		return err
 	}
 
-	results, err := testCollection.Query(ChromaCollectionQuery{
+	results, err := testCollection.QueryContext(ctx, ChromaCollectionQuery{
 		Embeddings: [][]float64{
 			{1.0, 1.0, 0.999},
 		},
@@ -164,12 +412,12 @@ func (c *ChromaClient) Check() error {
 	if results == nil {
 		return errors.New("results is nil")
 	}
-	if DEBUG {
+	if config.Debug {
 		fmt.Println("RESULTS:")
 		printStruct(results)
 	}
 
-	err = c.RemoveCollection("test_collection")
+	err = c.RemoveCollectionContext(ctx, "test_collection")
 	if err != nil {
 		return err
 	}
@@ -179,256 +427,538 @@ func (c *ChromaClient) Check() error {
 
 // Gets tenant, creating it if not found
 func (c *ChromaClient) GetTenant() (*ChromaTenant, error) {
-	url := *c.baseURL
-
-	url.Path = path.Join(url.Path, "tenants", c.tenant)
-	// fmt.Println("GetTenant URL:", url.String())
+	return c.GetTenantContext(context.Background())
+}
 
-	resp, err := c.httpClient.Get(url.String())
+// Same as GetTenant, using given context
+func (c *ChromaClient) GetTenantContext(ctx context.Context) (*ChromaTenant, error) {
+	url, err := c.apiURL(ctx, "tenants", c.tenant)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
+	var tenant ChromaTenant
+	err = c.request(ctx, "GET", url, true, nil, &tenant, http.StatusOK)
+	if err == nil {
+		return &tenant, nil
+	}
+	if errors.Is(err, ErrNotFound) == false {
+		return nil, err
+	}
 
-		// status code not super reliable...  checking content of returned message too.
-		// (got a 500 with a "not found" error message)
-		// {"error":"NotFoundError('Tenant new_tenant not found')"}
-		if resp.StatusCode == http.StatusNotFound || strings.Contains(string(body), "not found") {
-			url := *c.baseURL
-			url.Path = path.Join(url.Path, "tenants")
-			// fmt.Println("URL:", url.String())
+	url, err = c.apiURL(ctx, "tenants")
+	if err != nil {
+		return nil, err
+	}
 
-			tenant := ChromaTenant{Name: c.tenant}
+	tenant = ChromaTenant{Name: c.tenant}
 
-			payload, err := json.Marshal(tenant)
-			if err != nil {
-				return nil, err
-			}
+	err = c.request(ctx, "POST", url, false, tenant, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
 
-			// fmt.Println("payload:", string(payload))
+	return &tenant, nil
+}
 
-			resp, err := c.httpClient.Post(url.String(), "application/json", bytes.NewBuffer(payload))
-			if err != nil {
-				return nil, err
-			}
-			defer resp.Body.Close()
+// Gets database, creating it if not found
+func (c *ChromaClient) GetDatabase() (*ChromaDatabase, error) {
+	return c.GetDatabaseContext(context.Background())
+}
 
-			if resp.StatusCode != http.StatusOK {
-				// fmt.Printf("STATUS: %d\n", resp.StatusCode)
-				// body, _ := ioutil.ReadAll(resp.Body)
-				// fmt.Println("BODY:", string(body))
-				return nil, errors.New("failed to create tenant")
-			}
+// Same as GetDatabase, using given context
+func (c *ChromaClient) GetDatabaseContext(ctx context.Context) (*ChromaDatabase, error) {
+	url, err := c.databasesURL(ctx, c.database)
+	if err != nil {
+		return nil, err
+	}
 
-			return &tenant, nil
-		}
+	var database ChromaDatabase
+	err = c.request(ctx, "GET", url, true, nil, &database, http.StatusOK)
+	if err == nil {
+		return &database, nil
+	}
+	if errors.Is(err, ErrNotFound) == false {
+		return nil, err
+	}
 
-		return nil, errors.New("non-supported HTTP status:" + strconv.Itoa(resp.StatusCode))
+	url, err = c.databasesURL(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	decoder := json.NewDecoder(resp.Body)
-	var tenant ChromaTenant
-	err = decoder.Decode(&tenant)
+	database = ChromaDatabase{Name: c.database}
+
+	err = c.request(ctx, "POST", url, false, database, nil, http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tenant, nil
+	return &database, nil
 }
 
-// Gets database, creating it if not found
-func (c *ChromaClient) GetDatabase() (*ChromaDatabase, error) {
-	url := *c.baseURL
+// Removes collection
+func (c *ChromaClient) RemoveCollection(name string) error {
+	return c.RemoveCollectionContext(context.Background(), name)
+}
 
-	url.Path = path.Join(url.Path, "databases", c.database)
-	query := url.Query()
-	query.Set("tenant", c.tenant)
-	url.RawQuery = query.Encode()
-	// fmt.Println("GetDatabase URL:", url.String())
+// Same as RemoveCollection, using given context
+func (c *ChromaClient) RemoveCollectionContext(ctx context.Context, name string) error {
+	url, err := c.collectionsURL(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if config.Debug {
+		fmt.Println("RemoveCollection:", url.String())
+	}
+
+	return c.request(ctx, "DELETE", url, true, nil, nil, http.StatusOK)
+}
+
+// Gets collection, creating it if not found
+func (c *ChromaClient) GetCollection(name string) (*ChromaCollection, error) {
+	return c.GetCollectionContext(context.Background(), name)
+}
 
-	resp, err := c.httpClient.Get(url.String())
+// Same as GetCollection, using given context
+func (c *ChromaClient) GetCollectionContext(ctx context.Context, name string) (*ChromaCollection, error) {
+	return c.GetCollectionWithMetadataContext(ctx, name, nil)
+}
+
+// Gets collection, creating it with given metadata if not found.
+// Metadata is ignored if the collection already exists.
+func (c *ChromaClient) GetCollectionWithMetadata(name string, metadata map[string]any) (*ChromaCollection, error) {
+	return c.GetCollectionWithMetadataContext(context.Background(), name, metadata)
+}
+
+// Same as GetCollectionWithMetadata, using given context
+func (c *ChromaClient) GetCollectionWithMetadataContext(ctx context.Context, name string, metadata map[string]any) (*ChromaCollection, error) {
+	url, err := c.collectionsURL(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
+	var collection ChromaCollection
+	err = c.request(ctx, "GET", url, true, nil, &collection, http.StatusOK)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) == false {
+			return nil, err
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
+		url, err = c.collectionsURL(ctx)
 		if err != nil {
 			return nil, err
 		}
 
-		// status code not super reliable...  checking content of returned message too.
-		// (got a 500 with a "not found" error message)
-		if resp.StatusCode == http.StatusNotFound || strings.Contains(string(body), "not found") {
-			url := *c.baseURL
-			url.Path = path.Join(url.Path, "databases")
-			query := url.Query()
-			query.Set("tenant", c.tenant)
-			url.RawQuery = query.Encode()
-			// fmt.Println(">> URL:", url.String())
-
-			database := ChromaDatabase{Name: c.database}
-
-			payload, err := json.Marshal(database)
+		collection = ChromaCollection{Name: name, Metadata: metadata}
+		err = c.request(ctx, "POST", url, false, collection, &collection, http.StatusOK)
+		if errors.Is(err, ErrAlreadyExists) {
+			// created concurrently since the first request
+			url, err = c.collectionsURL(ctx, name)
 			if err != nil {
 				return nil, err
 			}
+			collection = ChromaCollection{}
+			err = c.request(ctx, "GET", url, true, nil, &collection, http.StatusOK)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			// fmt.Println("payload:", string(payload))
-
-			resp, err := c.httpClient.Post(url.String(), "application/json", bytes.NewBuffer(payload))
-			if err != nil {
-				return nil, err
-			}
-			defer resp.Body.Close()
+	collection.client = c
 
-			if resp.StatusCode != http.StatusOK {
-				// fmt.Printf("STATUS: %d\n", resp.StatusCode)
-				// body, _ := ioutil.ReadAll(resp.Body)
-				// fmt.Println("BODY:", string(body))
-				return nil, errors.New("failed to create database")
-			}
+	return &collection, nil
+}
 
-			return &database, nil
-		}
+// Lists collections in client's tenant & database
+func (c *ChromaClient) ListCollections() ([]*ChromaCollection, error) {
+	return c.ListCollectionsContext(context.Background())
+}
 
-		return nil, errors.New("non-supported HTTP status:" + strconv.Itoa(resp.StatusCode))
+// Same as ListCollections, using given context
+func (c *ChromaClient) ListCollectionsContext(ctx context.Context) ([]*ChromaCollection, error) {
+	url, err := c.collectionsURL(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	decoder := json.NewDecoder(resp.Body)
-	var database ChromaDatabase
-	err = decoder.Decode(&database)
+	var collections []*ChromaCollection
+	err = c.request(ctx, "GET", url, true, nil, &collections, http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
 
-	return &database, nil
+	for _, collection := range collections {
+		collection.client = c
+	}
+
+	return collections, nil
 }
 
-// Removes collection
-func (c *ChromaClient) RemoveCollection(name string) error {
+// Renames collection and/or replaces its metadata.
+// Empty name and nil metadata are left untouched.
+// NOTE: distance function (HNSW_SPACE_KEY) can't be changed.
+func (c *ChromaClient) ModifyCollection(id string, newName string, newMetadata map[string]any) error {
+	return c.ModifyCollectionContext(context.Background(), id, newName, newMetadata)
+}
+
+// Same as ModifyCollection, using given context
+func (c *ChromaClient) ModifyCollectionContext(ctx context.Context, id string, newName string, newMetadata map[string]any) error {
+	url, err := c.collectionURL(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return c.request(ctx, "PUT", url, true, chromaCollectionUpdate{
+		NewName:     newName,
+		NewMetadata: newMetadata,
+	}, nil, http.StatusOK)
+}
+
+// Returns URL for given path elements, prefixed with
+// API root & version (e.g. /api/v2/tenants).
+func (c *ChromaClient) apiURL(ctx context.Context, elem ...string) (url.URL, error) {
 	url := *c.baseURL
+	version, err := c.APIVersionContext(ctx)
+	if err != nil {
+		return url, err
+	}
+	url.Path = path.Join(append([]string{url.Path, version}, elem...)...)
+	return url, nil
+}
+
+// Returns URL for databases endpoint, in client's tenant.
+// Path elements are appended to the path.
+func (c *ChromaClient) databasesURL(ctx context.Context, elem ...string) (url.URL, error) {
+	version, err := c.APIVersionContext(ctx)
+	if err != nil {
+		return url.URL{}, err
+	}
+	if version == CHROMA_API_V1 {
+		url, err := c.apiURL(ctx, append([]string{"databases"}, elem...)...)
+		query := url.Query()
+		query.Set("tenant", c.tenant)
+		url.RawQuery = query.Encode()
+		return url, err
+	}
+	return c.apiURL(ctx, append([]string{"tenants", c.tenant, "databases"}, elem...)...)
+}
+
+// Returns URL for collections endpoint, in client's tenant & database
+// (query parameters for v1, path for v2).
+// Path elements are appended to the path.
+func (c *ChromaClient) collectionsURL(ctx context.Context, elem ...string) (url.URL, error) {
+	version, err := c.APIVersionContext(ctx)
+	if err != nil {
+		return url.URL{}, err
+	}
+	if version == CHROMA_API_V1 {
+		url, err := c.apiURL(ctx, append([]string{"collections"}, elem...)...)
+		query := url.Query()
+		query.Set("tenant", c.tenant)
+		query.Set("database", c.database)
+		url.RawQuery = query.Encode()
+		return url, err
+	}
+	return c.apiURL(ctx, append([]string{"tenants", c.tenant, "databases", c.database, "collections"}, elem...)...)
+}
+
+// Returns URL for endpoints of collection with given ID.
+// v1 doesn't need tenant & database, IDs are unique.
+func (c *ChromaClient) collectionURL(ctx context.Context, id string, elem ...string) (url.URL, error) {
+	version, err := c.APIVersionContext(ctx)
+	if err != nil {
+		return url.URL{}, err
+	}
+	if version == CHROMA_API_V1 {
+		return c.apiURL(ctx, append([]string{"collections", id}, elem...)...)
+	}
+	return c.collectionsURL(ctx, append([]string{id}, elem...)...)
+}
+
+// Sends request to Chroma, with JSON encoded payload (if not nil),
+// decoding JSON response in result (if not nil).
+// Returns a *ChromaError if response status is not one of the expected ones.
+// Idempotent requests are retried on connection and server errors.
+func (c *ChromaClient) request(ctx context.Context, method string, url url.URL, idempotent bool, payload any, result any, expectedStatus ...int) error {
+	var data []byte
+	if payload != nil {
+		var err error
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	attempts := 1
+	if idempotent {
+		attempts += c.options.MaxRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			// exponential backoff, with jitter
+			backoff := c.options.RetryBackoff * time.Duration(1<<(attempt-1))
+			backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+			if config.Debug {
+				fmt.Println("⚠️ retrying Chroma request in", backoff.String()+":", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		err = c.doRequest(ctx, method, url, data, result, expectedStatus...)
+		if err == nil || isRetryable(ctx, err) == false {
+			return err
+		}
+	}
 
-	url.Path = path.Join(url.Path, "collections", name)
-	query := url.Query()
-	query.Set("tenant", c.tenant)
-	query.Set("database", c.database)
-	url.RawQuery = query.Encode()
+	return err
+}
 
-	fmt.Println("RemoveCollection:", url.String())
+func (c *ChromaClient) doRequest(ctx context.Context, method string, url url.URL, data []byte, result any, expectedStatus ...int) error {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
 
-	req, err := http.NewRequest("DELETE", url.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), body)
 	if err != nil {
 		return err
 	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.options.Auth != nil {
+		c.options.Auth.Authenticate(req)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
-
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("RemoveCollection: wrong HTTP status:" + strconv.Itoa(resp.StatusCode))
+
+	ok := false
+	for _, status := range expectedStatus {
+		if resp.StatusCode == status {
+			ok = true
+			break
+		}
+	}
+	if ok == false {
+		return newChromaError(resp)
 	}
 
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Server errors and connection errors can be retried,
+// unless the context is done.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var chromaErr *ChromaError
+	if errors.As(err, &chromaErr) {
+		return errors.Is(err, ErrServer)
+	}
+	// decoding errors are not worth retrying
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return false
+	}
+	// connection errors, timeouts...
+	return true
+}
+
+// Replaces collection metadata.
+// HNSW settings (HNSW_KEY_PREFIX) can't be part of it, they're kept.
+func (c *ChromaCollection) SetMetadata(metadata map[string]any) error {
+	return c.SetMetadataContext(context.Background(), metadata)
+}
+
+// Same as SetMetadata, using given context
+func (c *ChromaCollection) SetMetadataContext(ctx context.Context, metadata map[string]any) error {
+	err := c.client.ModifyCollectionContext(ctx, c.ID, "", metadata)
+	if err != nil {
+		return err
+	}
+	c.Metadata = withHNSWSettings(metadata, c.Metadata)
 	return nil
 }
 
-// Gets collection, creating it if not found
-func (c *ChromaClient) GetCollection(name string) (*ChromaCollection, error) {
-	url := *c.baseURL
+// Returns a copy of metadata, with HNSW settings from previous metadata
+func withHNSWSettings(metadata map[string]any, previous map[string]any) map[string]any {
+	m := make(map[string]any, len(metadata))
+	for k, v := range metadata {
+		m[k] = v
+	}
+	for k, v := range previous {
+		if strings.HasPrefix(k, HNSW_KEY_PREFIX) {
+			m[k] = v
+		}
+	}
+	return m
+}
 
-	url.Path = path.Join(url.Path, "collections", name)
-	query := url.Query()
-	query.Set("tenant", c.tenant)
-	query.Set("database", c.database)
-	url.RawQuery = query.Encode()
-	// fmt.Println("GetCollection URL:", url.String())
+// Renames collection
+func (c *ChromaCollection) Rename(name string) error {
+	return c.RenameContext(context.Background(), name)
+}
 
-	resp, err := c.httpClient.Get(url.String())
+// Same as Rename, using given context
+func (c *ChromaCollection) RenameContext(ctx context.Context, name string) error {
+	if name == "" {
+		return errors.New("collection name can't be empty")
+	}
+	err := c.client.ModifyCollectionContext(ctx, c.ID, name, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	c.Name = name
+	return nil
+}
 
-	defer resp.Body.Close()
+// Adds entries, fails if one of the IDs already exists
+func (c *ChromaCollection) Add(entries []ChromaCollectionEntry) error {
+	return c.AddContext(context.Background(), entries)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
+// Same as Add, using given context
+func (c *ChromaCollection) AddContext(ctx context.Context, entries []ChromaCollectionEntry) error {
+	return c.post(ctx, "add", toCollectionEntries(entries, false), nil, http.StatusCreated)
+}
 
-		// status code not super reliable...  checking content of returned message too.
-		// (got a 500 with a "not found" error message)
-		// {"error":"ValueError('Collection npcs does not exist.')"}
-		if resp.StatusCode == http.StatusNotFound || strings.Contains(string(body), "does not exist") {
-			url := *c.baseURL
-			url.Path = path.Join(url.Path, "collections")
-			query := url.Query()
-			query.Set("tenant", c.tenant)
-			query.Set("database", c.database)
-			url.RawQuery = query.Encode()
-			fmt.Println(">> URL:", url.String())
-
-			collection := ChromaCollection{Name: name}
-
-			payload, err := json.Marshal(collection)
-			if err != nil {
-				return nil, err
-			}
+// Adds entries, replacing the ones with same IDs
+func (c *ChromaCollection) Upsert(entries []ChromaCollectionEntry) error {
+	return c.UpsertContext(context.Background(), entries)
+}
 
-			// fmt.Println("payload:", string(payload))
+// Same as Upsert, using given context
+func (c *ChromaCollection) UpsertContext(ctx context.Context, entries []ChromaCollectionEntry) error {
+	return c.post(ctx, "upsert", toCollectionEntries(entries, false), nil, http.StatusOK, http.StatusCreated)
+}
 
-			resp, err := c.httpClient.Post(url.String(), "application/json", bytes.NewBuffer(payload))
-			if err != nil {
-				return nil, err
-			}
-			defer resp.Body.Close()
+// Updates existing entries.
+// Embeddings are only updated if all entries provide one,
+// documents & metadatas if at least one entry provides them.
+func (c *ChromaCollection) Update(entries []ChromaCollectionEntry) error {
+	return c.UpdateContext(context.Background(), entries)
+}
 
-			if resp.StatusCode != http.StatusOK {
-				// fmt.Printf("STATUS: %d\n", resp.StatusCode)
-				return nil, errors.New("failed to create database")
-			}
+// Same as Update, using given context
+func (c *ChromaCollection) UpdateContext(ctx context.Context, entries []ChromaCollectionEntry) error {
+	return c.post(ctx, "update", toCollectionEntries(entries, true), nil, http.StatusOK)
+}
 
-			decoder := json.NewDecoder(resp.Body)
-			var createdCollection ChromaCollection
-			err = decoder.Decode(&createdCollection)
-			if err != nil {
-				return nil, err
-			}
+// Gets entries by IDs and/or filters
+func (c *ChromaCollection) Get(get ChromaCollectionGet) ([]ChromaCollectionEntry, error) {
+	return c.GetContext(context.Background(), get)
+}
 
-			createdCollection.client = c
+// Same as Get, using given context
+func (c *ChromaCollection) GetContext(ctx context.Context, get ChromaCollectionGet) ([]ChromaCollectionEntry, error) {
+	var entries ChromaCollectionEntries
+	err := c.post(ctx, "get", get, &entries, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return fromCollectionEntries(entries), nil
+}
 
-			return &createdCollection, nil
-		}
+// Returns the first entries of the collection (with embeddings)
+func (c *ChromaCollection) Peek(limit int) ([]ChromaCollectionEntry, error) {
+	return c.PeekContext(context.Background(), limit)
+}
 
-		return nil, errors.New("non-supported HTTP status:" + strconv.Itoa(resp.StatusCode))
+// Same as Peek, using given context
+func (c *ChromaCollection) PeekContext(ctx context.Context, limit int) ([]ChromaCollectionEntry, error) {
+	if limit <= 0 {
+		limit = 10 // same default as Chroma
 	}
+	return c.GetContext(ctx, ChromaCollectionGet{
+		Limit:   limit,
+		Include: []string{INCLUDE_EMBEDDINGS, INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+	})
+}
 
-	decoder := json.NewDecoder(resp.Body)
-	var collection ChromaCollection
-	err = decoder.Decode(&collection)
+// Deletes entries by IDs and/or filters, returns IDs of deleted entries
+// (only returned by some Chroma versions)
+func (c *ChromaCollection) Delete(del ChromaCollectionDelete) ([]string, error) {
+	return c.DeleteContext(context.Background(), del)
+}
+
+// Same as Delete, using given context
+func (c *ChromaCollection) DeleteContext(ctx context.Context, del ChromaCollectionDelete) ([]string, error) {
+	if len(del.IDs) == 0 && del.Where == nil && del.WhereDocument == nil {
+		// would delete everything
+		return nil, fmt.Errorf("%w: Delete: IDs or filter required", ErrInvalidArgument)
+	}
+
+	// list of IDs, null, or {} with v2
+	var response json.RawMessage
+	err := c.post(ctx, "delete", del, &response, http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
 
-	collection.client = c
+	var deleted []string
+	if bytes.HasPrefix(bytes.TrimSpace(response), []byte("[")) {
+		err = json.Unmarshal(response, &deleted)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
 
-	return &collection, nil
+// Returns number of entries in collection
+func (c *ChromaCollection) Count() (int, error) {
+	return c.CountContext(context.Background())
 }
 
-func (c *ChromaCollection) Add(entries []ChromaCollectionEntry) error {
+// Same as Count, using given context
+func (c *ChromaCollection) CountContext(ctx context.Context) (int, error) {
+	url, err := c.client.collectionURL(ctx, c.ID, "count")
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = c.client.request(ctx, "GET", url, true, nil, &count, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Posts payload to collection endpoint, decoding response in result if not nil.
+// All collection endpoints are idempotent, except "add".
+func (c *ChromaCollection) post(ctx context.Context, endpoint string, payload any, result any, expectedStatus ...int) error {
+	url, err := c.client.collectionURL(ctx, c.ID, endpoint)
+	if err != nil {
+		return err
+	}
+	return c.client.request(ctx, "POST", url, endpoint != "add", payload, result, expectedStatus...)
+}
 
+// Converts entries to Chroma's columnar format.
+// When partial is true, embeddings are only included if all entries
+// have one, documents & metadatas if at least one entry has them.
+func toCollectionEntries(entries []ChromaCollectionEntry, partial bool) *ChromaCollectionEntries {
 	len := len(entries)
 
 	collectionEntries := &ChromaCollectionEntries{
@@ -438,65 +968,61 @@ func (c *ChromaCollection) Add(entries []ChromaCollectionEntry) error {
 		IDs:        make([]string, len),
 	}
 
+	allEmbeddings, anyDocument, anyMetadata := true, false, false
+
 	for i, entry := range entries {
 		collectionEntries.Embeddings[i] = entry.Embedding
 		collectionEntries.Documents[i] = entry.Document
 		collectionEntries.Metadatas[i] = entry.Metadatas
 		collectionEntries.IDs[i] = entry.ID
-	}
-
-	url := *c.client.baseURL
-	url.Path = path.Join(url.Path, "collections", c.ID, "add")
 
-	payload, err := json.Marshal(collectionEntries)
-	if err != nil {
-		return err
+		allEmbeddings = allEmbeddings && entry.Embedding != nil
+		anyDocument = anyDocument || entry.Document != ""
+		anyMetadata = anyMetadata || entry.Metadatas != nil
 	}
 
-	// fmt.Println("collection.add payload:", string(payload))
-
-	resp, err := c.client.httpClient.Post(url.String(), "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		return errors.New("HTTP status:" + strconv.Itoa(resp.StatusCode))
+	if partial {
+		if allEmbeddings == false {
+			collectionEntries.Embeddings = nil
+		}
+		if anyDocument == false {
+			collectionEntries.Documents = nil
+		}
+		if anyMetadata == false {
+			collectionEntries.Metadatas = nil
+		}
 	}
 
-	return nil
+	return collectionEntries
 }
 
-func (c *ChromaCollection) Query(query ChromaCollectionQuery) ([]ChromaCollectionEntry, error) {
-
-	url := *c.client.baseURL
-	url.Path = path.Join(url.Path, "collections", c.ID, "query")
-
-	payload, err := json.Marshal(query)
-	if err != nil {
-		return nil, err
-	}
-
-	// fmt.Println("collection.query payload:", string(payload))
-
-	resp, err := c.client.httpClient.Post(url.String(), "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, err
+// Converts entries from Chroma's columnar format
+func fromCollectionEntries(entries ChromaCollectionEntries) []ChromaCollectionEntry {
+	results := make([]ChromaCollectionEntry, len(entries.IDs))
+	for i, id := range entries.IDs {
+		results[i].ID = id
+		if i < len(entries.Embeddings) {
+			results[i].Embedding = entries.Embeddings[i]
+		}
+		if i < len(entries.Documents) {
+			results[i].Document = entries.Documents[i]
+		}
+		if i < len(entries.Metadatas) {
+			results[i].Metadatas = entries.Metadatas[i]
+		}
 	}
-	defer resp.Body.Close()
+	return results
+}
 
-	// body, err := ioutil.ReadAll(resp.Body)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// fmt.Println("body:", string(body))
+func (c *ChromaCollection) Query(query ChromaCollectionQuery) ([]ChromaCollectionEntry, error) {
+	return c.QueryContext(context.Background(), query)
+}
 
+// Same as Query, using given context
+func (c *ChromaCollection) QueryContext(ctx context.Context, query ChromaCollectionQuery) ([]ChromaCollectionEntry, error) {
 	// {"ids":[["","foo"]],"distances":[[1.0000000000000019e-6,1.0000000000000019e-6]],"metadatas":[[null,{"createdAt":1234}]],"embeddings":null,"documents":[["","test"]],"uris":null,"data":null}
-
-	decoder := json.NewDecoder(resp.Body)
 	var entries ChromaCollectionBatchEntries
-	err = decoder.Decode(&entries)
+	err := c.post(ctx, "query", query, &entries, http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
@@ -513,9 +1039,15 @@ func (c *ChromaCollection) Query(query ChromaCollectionQuery) ([]ChromaCollectio
 		results[i] = ChromaCollectionEntry{
 			Embedding: nil,
 			ID:        entries.IDs[0][i],
-			Document:  entries.Documents[0][i],
-			Distance:  entries.Distances[0][i],
-			Metadatas: entries.Metadatas[0][i],
+		}
+		if len(entries.Documents) > 0 && i < len(entries.Documents[0]) {
+			results[i].Document = entries.Documents[0][i]
+		}
+		if len(entries.Distances) > 0 && i < len(entries.Distances[0]) {
+			results[i].Distance = entries.Distances[0][i]
+		}
+		if len(entries.Metadatas) > 0 && i < len(entries.Metadatas[0]) {
+			results[i].Metadatas = entries.Metadatas[0][i]
 		}
 	}
 
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Request received by test Chroma server
+type testChromaRequest struct {
+	method string
+	path   string
+	body   map[string]any // decoded JSON payload, nil if empty
+}
+
+// Fake Chroma server, recording requests and answering
+// with given handler.
+type testChromaServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []testChromaRequest
+}
+
+// Starts test Chroma server, closed when the test ends.
+// Heartbeat requests are answered without calling handler.
+func newTestChromaServer(t *testing.T, handler http.HandlerFunc) (*testChromaServer, *ChromaClient) {
+	s := &testChromaServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/heartbeat") {
+			w.Write([]byte(`{"nanosecond heartbeat":1}`))
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		req := testChromaRequest{method: r.Method, path: r.URL.Path}
+		if len(data) > 0 {
+			err = json.Unmarshal(data, &req.body)
+			if err != nil {
+				t.Errorf("%s %s: can't decode payload: %v", r.Method, r.URL.Path, err)
+			}
+		}
+		s.mutex.Lock()
+		s.requests = append(s.requests, req)
+		s.mutex.Unlock()
+
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	client, err := NewChromaClient(s.URL, "tenant", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, client
+}
+
+// Returns requests received so far
+func (s *testChromaServer) received() []testChromaRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]testChromaRequest{}, s.requests...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestChromaCollectionRequests(t *testing.T) {
+	embedding := []float64{1, 0}
+
+	tests := []struct {
+		name     string
+		call     func(c *ChromaCollection) (any, error)
+		status   int
+		response any
+		endpoint string
+		want     any            // result
+		wantBody map[string]any // keys not listed must be absent
+	}{
+		{
+			name: "add",
+			call: func(c *ChromaCollection) (any, error) {
+				return nil, c.Add([]ChromaCollectionEntry{{ID: "a", Document: "hello", Embedding: &embedding}})
+			},
+			status:   http.StatusCreated,
+			endpoint: "add",
+			wantBody: map[string]any{
+				"ids":        []any{"a"},
+				"documents":  []any{"hello"},
+				"embeddings": []any{[]any{1.0, 0.0}},
+				"metadatas":  []any{nil},
+			},
+		},
+		{
+			name: "update without embeddings",
+			call: func(c *ChromaCollection) (any, error) {
+				return nil, c.Update([]ChromaCollectionEntry{
+					{ID: "a", Embedding: &embedding},
+					{ID: "b", Metadatas: map[string]any{"k": "v"}},
+				})
+			},
+			status:   http.StatusOK,
+			endpoint: "update",
+			wantBody: map[string]any{
+				"ids":       []any{"a", "b"},
+				"metadatas": []any{nil, map[string]any{"k": "v"}},
+			},
+		},
+		{
+			name: "get",
+			call: func(c *ChromaCollection) (any, error) {
+				return c.Get(ChromaCollectionGet{IDs: []string{"a", "b"}})
+			},
+			status: http.StatusOK,
+			response: map[string]any{
+				"ids":       []string{"a", "b"},
+				"documents": []string{"hello", "world"},
+				"metadatas": []any{nil, map[string]any{"k": "v"}},
+			},
+			endpoint: "get",
+			want: []ChromaCollectionEntry{
+				{ID: "a", Document: "hello"},
+				{ID: "b", Document: "world", Metadatas: map[string]any{"k": "v"}},
+			},
+			wantBody: map[string]any{"ids": []any{"a", "b"}},
+		},
+		{
+			name: "peek",
+			call: func(c *ChromaCollection) (any, error) {
+				return c.Peek(0)
+			},
+			status:   http.StatusOK,
+			response: map[string]any{"ids": []string{}},
+			endpoint: "get",
+			want:     []ChromaCollectionEntry{},
+			wantBody: map[string]any{
+				"limit":   10.0,
+				"include": []any{INCLUDE_EMBEDDINGS, INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+			},
+		},
+		{
+			name: "delete",
+			call: func(c *ChromaCollection) (any, error) {
+				return c.Delete(ChromaCollectionDelete{IDs: []string{"a"}})
+			},
+			status:   http.StatusOK,
+			response: []string{"a"},
+			endpoint: "delete",
+			want:     []string{"a"},
+			wantBody: map[string]any{"ids": []any{"a"}},
+		},
+		{
+			name: "count",
+			call: func(c *ChromaCollection) (any, error) {
+				return c.Count()
+			},
+			status:   http.StatusOK,
+			response: 42,
+			endpoint: "count",
+			want:     42,
+		},
+	}
+
+	for _, test := range tests {
+		server, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, test.status, test.response)
+		})
+		collection := &ChromaCollection{ID: "collection-id", client: client}
+
+		got, err := test.call(collection)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.want != nil && reflect.DeepEqual(got, test.want) == false {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+
+		requests := server.received()
+		if len(requests) != 1 {
+			t.Errorf("%s: got %d requests, want 1", test.name, len(requests))
+			continue
+		}
+		if strings.HasSuffix(requests[0].path, "/collections/collection-id/"+test.endpoint) == false {
+			t.Errorf("%s: got path %s, want %s endpoint", test.name, requests[0].path, test.endpoint)
+		}
+		if test.wantBody != nil && reflect.DeepEqual(requests[0].body, test.wantBody) == false {
+			t.Errorf("%s: got payload %v, want %v", test.name, requests[0].body, test.wantBody)
+		}
+	}
+}
+
+func TestChromaCollectionErrors(t *testing.T) {
+	server, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "InvalidArgumentError", "message": "bad request"})
+	})
+	collection := &ChromaCollection{ID: "collection-id", client: client}
+
+	// would delete everything, not sent
+	_, err := collection.Delete(ChromaCollectionDelete{})
+	if err == nil {
+		t.Errorf("delete without IDs or filter: got no error")
+	}
+	if n := len(server.received()); n != 0 {
+		t.Errorf("delete without IDs or filter: got %d requests, want 0", n)
+	}
+
+	err = collection.Add([]ChromaCollectionEntry{{ID: "a"}})
+	if err == nil {
+		t.Errorf("add: got no error for status 400")
+	}
+	_, err = collection.Get(ChromaCollectionGet{})
+	if err == nil {
+		t.Errorf("get: got no error for status 400")
+	}
+	_, err = collection.Count()
+	if err == nil {
+		t.Errorf("count: got no error for status 400")
+	}
+}
+
+func TestChromaCollectionManagement(t *testing.T) {
+	server, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/collections/missing"):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "NotFoundError", "message": "Collection missing does not exist."})
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/collections"):
+			writeJSON(w, http.StatusOK, []map[string]any{{"name": "a", "id": "id-a"}, {"name": "b", "id": "id-b"}})
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/collections"):
+			var collection map[string]any
+			json.NewDecoder(r.Body).Decode(&collection)
+			collection["id"] = "id-missing"
+			writeJSON(w, http.StatusOK, collection)
+		case r.Method == "PUT":
+			writeJSON(w, http.StatusOK, nil)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			writeJSON(w, http.StatusBadRequest, nil)
+		}
+	})
+
+	collections, err := client.ListCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) != 2 || collections[0].ID != "id-a" || collections[1].Name != "b" {
+		t.Errorf("list: got %v, want collections a and b", collections)
+	}
+	for _, collection := range collections {
+		if collection.client != client {
+			t.Errorf("list: collection %s doesn't reference client", collection.Name)
+		}
+	}
+
+	// created with metadata when not found
+	metadata := map[string]any{HNSW_SPACE_KEY: HNSW_SPACE_COSINE}
+	collection, err := client.GetCollectionWithMetadata("missing", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collection.ID != "id-missing" || collection.client != client {
+		t.Errorf("create: got %v, want collection id-missing", collection)
+	}
+	requests := server.received()
+	created := requests[len(requests)-1]
+	want := map[string]any{"name": "missing", "metadata": map[string]any{HNSW_SPACE_KEY: HNSW_SPACE_COSINE}}
+	if reflect.DeepEqual(created.body, want) == false {
+		t.Errorf("create: got payload %v, want %v", created.body, want)
+	}
+
+	err = collection.Rename("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collection.Name != "renamed" {
+		t.Errorf("rename: got name %s, want renamed", collection.Name)
+	}
+	err = collection.SetMetadata(map[string]any{"createdAt": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = collection.Rename("")
+	if err == nil {
+		t.Errorf("rename: got no error for empty name")
+	}
+
+	requests = server.received()
+	updates := requests[len(requests)-2:]
+	wantUpdates := []map[string]any{
+		{"new_name": "renamed"},
+		{"new_metadata": map[string]any{"createdAt": 1.0}},
+	}
+	for i, update := range updates {
+		if update.method != "PUT" || strings.HasSuffix(update.path, "/collections/id-missing") == false {
+			t.Errorf("update %d: got %s %s, want PUT on collection", i, update.method, update.path)
+		}
+		if reflect.DeepEqual(update.body, wantUpdates[i]) == false {
+			t.Errorf("update %d: got payload %v, want %v", i, update.body, wantUpdates[i])
+		}
+	}
+}
+
+func TestChromaGetCollectionCreatedConcurrently(t *testing.T) {
+	created := false
+	server, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if created == false {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "NotFoundError", "message": "Collection npcs does not exist."})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"name": "npcs", "id": "id-npcs"})
+		case "POST":
+			// created by someone else in between
+			created = true
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "UniqueConstraintError", "message": "Collection npcs already exists"})
+		}
+	})
+
+	collection, err := client.GetCollection("npcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collection.ID != "id-npcs" || collection.client != client {
+		t.Errorf("got %v, want collection id-npcs", collection)
+	}
+
+	var methods []string
+	for _, req := range server.received() {
+		methods = append(methods, req.method)
+	}
+	want := []string{"GET", "POST", "GET"}
+	if reflect.DeepEqual(methods, want) == false {
+		t.Errorf("got requests %v, want %v", methods, want)
+	}
+}
+
+func TestChromaRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		call     func(c *ChromaCollection) error
+		statuses []int // returned in order, then 200
+		requests int
+		err      error
+	}{
+		{
+			name:     "idempotent, server errors",
+			call:     func(c *ChromaCollection) error { _, err := c.Count(); return err },
+			statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable},
+			requests: 3,
+		},
+		{
+			name:     "idempotent, too many server errors",
+			call:     func(c *ChromaCollection) error { _, err := c.Count(); return err },
+			statuses: []int{500, 500, 500, 500, 500},
+			requests: 4, // MaxRetries + 1
+			err:      ErrServer,
+		},
+		{
+			name:     "idempotent, client error",
+			call:     func(c *ChromaCollection) error { _, err := c.Get(ChromaCollectionGet{}); return err },
+			statuses: []int{http.StatusBadRequest},
+			requests: 1,
+			err:      ErrInvalidArgument,
+		},
+		{
+			name:     "not idempotent",
+			call:     func(c *ChromaCollection) error { return c.Add([]ChromaCollectionEntry{{ID: "a"}}) },
+			statuses: []int{http.StatusServiceUnavailable},
+			requests: 1,
+			err:      ErrServer,
+		},
+		{
+			name:     "upsert",
+			call:     func(c *ChromaCollection) error { return c.Upsert([]ChromaCollectionEntry{{ID: "a"}}) },
+			statuses: []int{http.StatusServiceUnavailable},
+			requests: 2,
+		},
+	}
+
+	for _, test := range tests {
+		var server *testChromaServer
+		server, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+			n := len(server.received())
+			if n <= len(test.statuses) {
+				writeJSON(w, test.statuses[n-1], map[string]string{"error": "Error", "message": "failed"})
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, "/add") {
+				writeJSON(w, http.StatusCreated, nil)
+				return
+			}
+			writeJSON(w, http.StatusOK, 0)
+		})
+		client.options.RetryBackoff = time.Millisecond
+		collection := &ChromaCollection{ID: "collection-id", client: client}
+
+		err := test.call(collection)
+		if test.err == nil && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.err != nil && errors.Is(err, test.err) == false {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if n := len(server.received()); n != test.requests {
+			t.Errorf("%s: got %d requests, want %d", test.name, n, test.requests)
+		}
+	}
+}
+
+func TestChromaRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		writeJSON(w, http.StatusServiceUnavailable, nil)
+	})
+	client.options.RetryBackoff = time.Hour
+	collection := &ChromaCollection{ID: "collection-id", client: client}
+
+	_, err := collection.CountContext(ctx)
+	if errors.Is(err, context.Canceled) == false {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if n := len(server.received()); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestChromaStatusChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		call   func(c *ChromaCollection) error
+		status int
+		ok     bool
+	}{
+		{"add created", func(c *ChromaCollection) error { return c.Add(nil) }, http.StatusCreated, true},
+		{"add ok", func(c *ChromaCollection) error { return c.Add(nil) }, http.StatusOK, false},
+		{"upsert ok", func(c *ChromaCollection) error { return c.Upsert(nil) }, http.StatusOK, true},
+		{"upsert created", func(c *ChromaCollection) error { return c.Upsert(nil) }, http.StatusCreated, true},
+		{"update created", func(c *ChromaCollection) error { return c.Update(nil) }, http.StatusCreated, false},
+		{"rename no content", func(c *ChromaCollection) error { return c.Rename("b") }, http.StatusNoContent, false},
+	}
+
+	for _, test := range tests {
+		_, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, test.status, nil)
+		})
+		client.options.MaxRetries = 0
+		collection := &ChromaCollection{ID: "collection-id", client: client}
+
+		err := test.call(collection)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		var chromaErr *ChromaError
+		if test.ok == false && (errors.As(err, &chromaErr) == false || chromaErr.StatusCode != test.status) {
+			t.Errorf("%s: got error %v, want *ChromaError with status %d", test.name, err, test.status)
+		}
+	}
+}
+
+func TestChromaAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   ChromaAuth
+		header string
+		want   string
+	}{
+		{"token", ChromaTokenAuth{Token: "secret"}, "Authorization", "Bearer secret"},
+		{"token header", ChromaTokenAuth{Token: "secret", Header: "X-Chroma-Token"}, "X-Chroma-Token", "secret"},
+		{"basic", ChromaBasicAuth{Username: "user", Password: "pass"}, "Authorization", "Basic dXNlcjpwYXNz"},
+		{"none", nil, "Authorization", ""},
+	}
+
+	for _, test := range tests {
+		var got string
+		_, client := newTestChromaServer(t, func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Get(test.header)
+			writeJSON(w, http.StatusOK, 0)
+		})
+		client.options.Auth = test.auth
+		collection := &ChromaCollection{ID: "collection-id", client: client}
+
+		_, err := collection.Count()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s header %q, want %q", test.name, test.header, got, test.want)
+		}
+	}
+}
+
+func TestChromaTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	options := DefaultChromaClientOptions()
+	options.Timeout = 10 * time.Millisecond
+	options.MaxRetries = 0
+	client, err := NewChromaClientWithOptions(server.URL, "tenant", "database", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := &ChromaCollection{ID: "collection-id", client: client}
+
+	start := time.Now()
+	_, err = collection.Count()
+	if err == nil {
+		t.Errorf("got no error, want timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("got response after %s, want timeout", elapsed)
+	}
+}
+
+func TestChromaURLs(t *testing.T) {
+	tests := []struct {
+		version     string
+		databases   string
+		collections string
+		collection  string
+	}{
+		{
+			CHROMA_API_V1,
+			"/api/v1/databases/db?tenant=t",
+			"/api/v1/collections/npcs?database=db&tenant=t",
+			"/api/v1/collections/id/add",
+		},
+		{
+			CHROMA_API_V2,
+			"/api/v2/tenants/t/databases/db",
+			"/api/v2/tenants/t/databases/db/collections/npcs",
+			"/api/v2/tenants/t/databases/db/collections/id/add",
+		},
+	}
+
+	for _, test := range tests {
+		options := DefaultChromaClientOptions()
+		options.APIVersion = test.version
+		client, err := NewChromaClientWithOptions("http://chroma:8000", "t", "db", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+
+		urls := []struct {
+			build func() (url.URL, error)
+			want  string
+		}{
+			{func() (url.URL, error) { return client.databasesURL(ctx, "db") }, test.databases},
+			{func() (url.URL, error) { return client.collectionsURL(ctx, "npcs") }, test.collections},
+			{func() (url.URL, error) { return client.collectionURL(ctx, "id", "add") }, test.collection},
+		}
+		for _, u := range urls {
+			got, err := u.build()
+			if err != nil {
+				t.Errorf("%s: %v", test.version, err)
+				continue
+			}
+			if got.Host != "chroma:8000" || got.RequestURI() != u.want {
+				t.Errorf("%s: got %s, want %s", test.version, got.String(), u.want)
+			}
+		}
+	}
+
+	_, err := NewChromaClientWithOptions("http://chroma:8000", "t", "db", ChromaClientOptions{APIVersion: "v3"})
+	if err == nil {
+		t.Errorf("v3: got no error")
+	}
+}
+
+func TestChromaAPIVersionDetection(t *testing.T) {
+	tests := []struct {
+		name    string
+		v2, v1  int // heartbeat statuses
+		version string
+		err     error
+	}{
+		{"v2", http.StatusOK, http.StatusOK, CHROMA_API_V2, nil},
+		{"v1 only", http.StatusNotFound, http.StatusOK, CHROMA_API_V1, nil},
+		{"v1 removed", http.StatusOK, http.StatusGone, CHROMA_API_V2, nil},
+		{"v2 refused", http.StatusUnauthorized, http.StatusOK, CHROMA_API_V1, nil},
+		{"unauthorized", http.StatusUnauthorized, http.StatusForbidden, "", ErrUnauthorized},
+		{"unsupported", http.StatusNotFound, http.StatusGone, "", nil},
+		{"client error", http.StatusBadRequest, http.StatusOK, "", ErrInvalidArgument},
+	}
+
+	for _, test := range tests {
+		var heartbeats atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			heartbeats.Add(1)
+			switch r.URL.Path {
+			case "/api/v2/heartbeat":
+				writeJSON(w, test.v2, nil)
+			case "/api/v1/heartbeat":
+				writeJSON(w, test.v1, nil)
+			default:
+				t.Errorf("%s: unexpected request: %s", test.name, r.URL.Path)
+			}
+		}))
+
+		client, err := NewChromaClient(server.URL, "t", "db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err := client.APIVersion()
+		if version != test.version {
+			t.Errorf("%s: got version %q, want %q", test.name, version, test.version)
+		}
+		if test.version == "" && err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+		if test.err != nil && errors.Is(err, test.err) == false {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+
+		// detected once, retried after failures
+		n := heartbeats.Load()
+		client.APIVersion()
+		if test.version != "" && heartbeats.Load() != n {
+			t.Errorf("%s: version detected again", test.name)
+		}
+		if test.version == "" && heartbeats.Load() == n {
+			t.Errorf("%s: failed detection not retried", test.name)
+		}
+
+		server.Close()
+	}
+}
+
+func TestChromaAPIVersionSharedDetection(t *testing.T) {
+	var heartbeats atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heartbeats.Add(1)
+		<-release
+		writeJSON(w, http.StatusOK, nil)
+	}))
+	defer server.Close()
+
+	client, err := NewChromaClient(server.URL, "t", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gives up waiting when its context is done,
+	// without stopping the detection
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.APIVersionContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) == false {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	var wg sync.WaitGroup
+	versions := make([]string, 10)
+	for i := range versions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			versions[i], _ = client.APIVersion()
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, version := range versions {
+		if version != CHROMA_API_V2 {
+			t.Errorf("request %d: got version %q, want %q", i, version, CHROMA_API_V2)
+		}
+	}
+	if n := heartbeats.Load(); n != 1 {
+		t.Errorf("got %d heartbeat requests, want 1", n)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error kinds, to be used with errors.Is.
+// Also used by non-Chroma memory stores.
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrAlreadyExists   = errors.New("already exists")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrUnauthorized    = errors.New("unauthorized") // missing or invalid credentials
+	ErrServer          = errors.New("server error")
+)
+
+// Error returned by Chroma, to be used with errors.As.
+// errors.Is(err, ErrNotFound) (or other kinds) can be used to check its kind.
+type ChromaError struct {
+	StatusCode int
+	Type       string // error type reported by Chroma, e.g. "NotFoundError"
+	Message    string
+	Kind       error // ErrNotFound, ErrAlreadyExists, ErrInvalidArgument, ErrUnauthorized or ErrServer
+}
+
+func (e *ChromaError) Error() string {
+	s := "chroma: " + e.Kind.Error() + " (HTTP " + strconv.Itoa(e.StatusCode)
+	if e.Type != "" {
+		s += ", " + e.Type
+	}
+	s += ")"
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+func (e *ChromaError) Unwrap() error {
+	return e.Kind
+}
+
+// Builds ChromaError from response with unexpected status.
+// Chroma error bodies come in different shapes depending on versions:
+// {"error":"NotFoundError('Tenant new_tenant not found')"}
+// {"error":"ValueError('Collection npcs does not exist.')"}
+// {"error":"NotFoundError","message":"Collection npcs does not exist."}
+// {"detail":[...]} (request validation)
+func newChromaError(resp *http.Response) *ChromaError {
+	e := &ChromaError{
+		StatusCode: resp.StatusCode,
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	var errorBody struct {
+		Error   string          `json:"error"`
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+	}
+
+	if json.Unmarshal(body, &errorBody) == nil && (errorBody.Error != "" || errorBody.Message != "" || errorBody.Detail != nil) {
+		e.Type = errorBody.Error
+		e.Message = errorBody.Message
+
+		// "Type('message')"
+		if i := strings.Index(e.Type, "("); i > 0 && strings.HasSuffix(e.Type, ")") {
+			msg := e.Type[i+1 : len(e.Type)-1]
+			msg = strings.Trim(msg, "'\"")
+			if e.Message == "" {
+				e.Message = msg
+			}
+			e.Type = e.Type[:i]
+		}
+
+		if e.Message == "" && errorBody.Detail != nil {
+			e.Message = string(errorBody.Detail)
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	e.Kind = chromaErrorKind(e.StatusCode, e.Type, e.Message)
+
+	return e
+}
+
+// Status code not super reliable (got a 500 with a "not found" error message),
+// error type and message are considered first.
+func chromaErrorKind(statusCode int, errorType string, message string) error {
+	switch errorType {
+	case "NotFoundError", "InvalidCollectionException", "NoSuchCollectionError":
+		return ErrNotFound
+	case "UniqueConstraintError", "IDAlreadyExistsError", "DuplicateIDError", "AlreadyExistsError":
+		return ErrAlreadyExists
+	case "InvalidArgumentError", "InvalidDimensionException", "InvalidUUIDError", "InvalidHTTPVersion", "TypeError":
+		return ErrInvalidArgument
+	case "AuthorizationError", "AuthenticationError":
+		return ErrUnauthorized
+	case "ValueError":
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "does not exist") || strings.Contains(lower, "not found") {
+			return ErrNotFound
+		}
+		if strings.Contains(lower, "already exists") {
+			return ErrAlreadyExists
+		}
+		return ErrInvalidArgument
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound, statusCode == http.StatusGone:
+		return ErrNotFound
+	case statusCode == http.StatusConflict:
+		return ErrAlreadyExists
+	case statusCode == http.StatusBadRequest, statusCode == http.StatusUnprocessableEntity:
+		return ErrInvalidArgument
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	}
+
+	return ErrServer
+}
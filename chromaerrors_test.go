@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewChromaError(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		kind    error
+		errType string
+		message string
+	}{
+		{404, `{"error":"NotFoundError('Tenant new_tenant not found')"}`, ErrNotFound, "NotFoundError", "Tenant new_tenant not found"},
+		{500, `{"error":"ValueError('Collection npcs does not exist.')"}`, ErrNotFound, "ValueError", "Collection npcs does not exist."},
+		{500, `{"error":"ValueError('Collection npcs already exists')"}`, ErrAlreadyExists, "ValueError", "Collection npcs already exists"},
+		{500, `{"error":"ValueError('Expected metadata to be a dict')"}`, ErrInvalidArgument, "ValueError", "Expected metadata to be a dict"},
+		{400, `{"error":"NotFoundError","message":"Collection npcs does not exist."}`, ErrNotFound, "NotFoundError", "Collection npcs does not exist."},
+		{409, `{"error":"UniqueConstraintError","message":"Collection npcs already exists"}`, ErrAlreadyExists, "UniqueConstraintError", "Collection npcs already exists"},
+		{400, `{"error":"InvalidDimensionException","message":"Embedding dimension 3 does not match collection dimensionality 2"}`, ErrInvalidArgument, "InvalidDimensionException", "Embedding dimension 3 does not match collection dimensionality 2"},
+		{422, `{"detail":[{"loc":["body","ids"],"msg":"field required"}]}`, ErrInvalidArgument, "", `[{"loc":["body","ids"],"msg":"field required"}]`},
+		{401, `{"error":"AuthorizationError","message":"Unauthorized"}`, ErrUnauthorized, "AuthorizationError", "Unauthorized"},
+		{403, `Forbidden`, ErrUnauthorized, "", "Forbidden"},
+		{409, `{}`, ErrAlreadyExists, "", "{}"},
+		{404, `Not Found`, ErrNotFound, "", "Not Found"},
+		{410, `{"error":"Gone"}`, ErrNotFound, "Gone", ""},
+		{500, "Internal Server Error\n", ErrServer, "", "Internal Server Error"},
+		{503, ``, ErrServer, "", ""},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{
+			StatusCode: test.status,
+			Body:       io.NopCloser(strings.NewReader(test.body)),
+		}
+		e := newChromaError(resp)
+		if e.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.body, e.StatusCode, test.status)
+		}
+		if errors.Is(e, test.kind) == false {
+			t.Errorf("%s: got kind %v, want %v", test.body, e.Kind, test.kind)
+		}
+		if e.Type != test.errType {
+			t.Errorf("%s: got type %q, want %q", test.body, e.Type, test.errType)
+		}
+		if e.Message != test.message {
+			t.Errorf("%s: got message %q, want %q", test.body, e.Message, test.message)
+		}
+	}
+}
+
+func TestChromaErrorAs(t *testing.T) {
+	var err error = &ChromaError{StatusCode: 404, Type: "NotFoundError", Message: "gone", Kind: ErrNotFound}
+	err = errors.Join(errors.New("wrapped"), err)
+
+	var chromaErr *ChromaError
+	if errors.As(err, &chromaErr) == false || chromaErr.StatusCode != 404 {
+		t.Errorf("got %v, want *ChromaError with status 404", err)
+	}
+	if errors.Is(err, ErrNotFound) == false || errors.Is(err, ErrServer) {
+		t.Errorf("got %v, want ErrNotFound kind only", err)
+	}
+	want := "chroma: not found (HTTP 404, NotFoundError): gone"
+	if chromaErr.Error() != want {
+		t.Errorf("got %q, want %q", chromaErr.Error(), want)
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_CONFIG_FILE = "config.yaml"
+	// prefix for environment variables overriding config
+	// e.g. NPCS_CHROMA_HOST=http://chroma:8000
+	ENV_PREFIX = "NPCS_"
+)
+
+var (
+	config = defaultConfig()
+)
+
+// Server configuration.
+// Values are read from config file (YAML), then overridden by environment
+// variables, then by command line flags.
+type Config struct {
+	Port             string `yaml:"port"`
+	Debug            bool   `yaml:"debug"`
+	AgentsFile       string `yaml:"agents-file"`       // where agents are stored to resume simulation
+	StructuredOutput bool   `yaml:"structured-output"` // agents reply in JSON (say, emotion, action...)
+
+	// prompt templates (text/template), see templates.go
+	Prompts struct {
+		// directory of *.tmpl files, named after the file,
+		// loaded in addition to built-in templates ("default", "chat")
+		// which they can replace
+		Dir string `yaml:"dir"`
+		// template used by agents that don't pick one
+		Default string `yaml:"default"`
+	} `yaml:"prompts"`
+
+	Chroma struct {
+		Host     string `yaml:"host"`
+		Tenant   string `yaml:"tenant"`
+		Database string `yaml:"database"`
+		// REST API version ("v1" or "v2"), detected when empty
+		APIVersion string `yaml:"api-version"`
+		// per request timeout (0 to disable)
+		Timeout time.Duration `yaml:"timeout"`
+		// idempotent requests failing with server or connection
+		// errors are retried, with exponential backoff
+		MaxRetries   int           `yaml:"max-retries"`
+		RetryBackoff time.Duration `yaml:"retry-backoff"`
+		// token auth (Authorization: Bearer by default, or X-Chroma-Token)
+		Token      string `yaml:"token"`
+		AuthHeader string `yaml:"auth-header"`
+		// basic auth, used when no token is set
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"chroma"`
+
+	Memory struct {
+		Store string `yaml:"store"` // "chroma" or "memory"
+		File  string `yaml:"file"`  // in-memory store persistence ("" to disable)
+		// distance function for new collections ("l2", "cosine", "ip")
+		Distance string `yaml:"distance"`
+		// filter expression restricting recalled memories, for agents
+		// that don't define one, e.g. sender != "narrator" (see filter.go)
+		Filter string `yaml:"filter"`
+		// memories are scored using relevance, recency & importance
+		Retrieval RetrievalSettings `yaml:"retrieval"`
+		// when enabled, the agent's model rates the importance of each
+		// new memory, in the background (one more request per exchange)
+		RateImportance bool `yaml:"rate-importance"`
+
+		// agents reflect on their memories to derive insights (see reflection.go)
+		Reflection struct {
+			// number of new memories triggering a reflection (0 to disable)
+			Threshold   int `yaml:"threshold"`
+			MaxInsights int `yaml:"max-insights"` // per reflection
+			// reflections included first in prompts
+			// (counted in retrieval results)
+			Results int `yaml:"results"`
+		} `yaml:"reflection"`
+
+		// last exchanges with each sender, included in prompts
+		// before recalled memories (see conversation.go)
+		Conversation struct {
+			Turns int `yaml:"turns"` // kept per agent & sender (0 to disable)
+			// oldest turns are left out of prompts beyond this budget (0: no limit)
+			MaxTokens int `yaml:"max-tokens"`
+		} `yaml:"conversation"`
+
+		// old, unimportant memories are summarized (see consolidation.go)
+		Consolidation ConsolidationSettings `yaml:"consolidation"`
+	} `yaml:"memory"`
+
+	LLM struct {
+		Backend string `yaml:"backend"` // default backend, agents can pick a different one
+		// context window used with each model, in tokens, indexed by model
+		// name ("llama3" also applies to "llama3:8b"). Prompts are trimmed
+		// to fit (see prompt.go), it's also Ollama's num_ctx.
+		ContextSizes map[string]int `yaml:"context-sizes"`
+		ContextSize  int            `yaml:"context-size"` // for models not in context-sizes
+		// tokens reserved for the model's answer
+		ResponseTokens int `yaml:"response-tokens"`
+	} `yaml:"llm"`
+
+	Ollama struct {
+		Host  string `yaml:"host"` // OLLAMA_HOST or default Ollama address when empty
+		Model string `yaml:"model"`
+	} `yaml:"ollama"`
+
+	OpenAI struct {
+		BaseURL string `yaml:"base-url"`
+		APIKey  string `yaml:"api-key"`
+		Model   string `yaml:"model"`
+	} `yaml:"openai"`
+
+	Embeddings struct {
+		Backend       string `yaml:"backend"`
+		Model         string `yaml:"model"`
+		HashDimension int    `yaml:"hash-dimension"` // only used by "hash" embedding backend
+	} `yaml:"embeddings"`
+}
+
+func defaultConfig() *Config {
+	c := &Config{
+		Port:             ":7777",
+		Debug:            true,
+		AgentsFile:       "agents.json",
+		StructuredOutput: true,
+	}
+	c.Prompts.Default = DEFAULT_PROMPT_TEMPLATE
+	c.Chroma.Host = "http://localhost:9999"
+	c.Chroma.Tenant = "npcs"
+	c.Chroma.Database = "npcs"
+	c.Chroma.Timeout = 30 * time.Second
+	c.Chroma.MaxRetries = 3
+	c.Chroma.RetryBackoff = 200 * time.Millisecond
+	c.Memory.Store = MEMORY_STORE_CHROMA
+	c.Memory.File = "memories.json"
+	c.Memory.Distance = HNSW_SPACE_COSINE
+	c.Memory.Retrieval = RetrievalSettings{
+		Results:         10,
+		OverFetch:       3,
+		Relevance:       1,
+		Recency:         1,
+		Importance:      1,
+		RecencyHalfLife: 24,
+	}
+	c.Memory.Reflection.Threshold = 20
+	c.Memory.Reflection.MaxInsights = 3
+	c.Memory.Reflection.Results = 3
+	c.Memory.Conversation.Turns = 10
+	c.Memory.Conversation.MaxTokens = 1000
+	c.Memory.Consolidation = ConsolidationSettings{
+		MinAge:         7 * 24 * time.Hour,
+		MaxImportance:  5,
+		Kinds:          []string{MEMORY_KIND_CONVERSATION},
+		MaxDistance:    0.3,
+		MinClusterSize: 3,
+		MaxClusterSize: 10,
+		MaxCandidates:  1000,
+	}
+	c.LLM.Backend = LLM_BACKEND_OLLAMA
+	c.LLM.ContextSizes = map[string]int{"llama3": 8192}
+	c.LLM.ContextSize = 2048
+	c.LLM.ResponseTokens = 512
+	c.Ollama.Model = "llama3"
+	c.OpenAI.BaseURL = "http://localhost:8080/v1"
+	c.OpenAI.APIKey = os.Getenv("OPENAI_API_KEY")
+	c.OpenAI.Model = "llama3"
+	c.Embeddings.Backend = EMBEDDING_BACKEND_OLLAMA
+	c.Embeddings.Model = "mxbai-embed-large"
+	c.Embeddings.HashDimension = 256
+	return c
+}
+
+// Setting that can be overridden with an environment variable and a flag
+type setting struct {
+	name  string // flag name, also used to derive env var name
+	usage string
+	value any // *string, *bool, *int, *float64 or *time.Duration
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"port", "address the API listens on", &c.Port},
+		{"debug", "verbose logs", &c.Debug},
+		{"agents-file", "file where agents are stored", &c.AgentsFile},
+		{"structured-output", "agents reply in JSON", &c.StructuredOutput},
+		{"prompts-dir", "directory of prompt templates (*.tmpl)", &c.Prompts.Dir},
+		{"prompts-default", "default prompt template", &c.Prompts.Default},
+		{"chroma-host", "Chroma server address", &c.Chroma.Host},
+		{"chroma-tenant", "Chroma tenant", &c.Chroma.Tenant},
+		{"chroma-database", "Chroma database", &c.Chroma.Database},
+		{"chroma-api-version", "Chroma REST API version (v1, v2, detected when empty)", &c.Chroma.APIVersion},
+		{"chroma-timeout", "Chroma request timeout (e.g. 30s, 0 to disable)", &c.Chroma.Timeout},
+		{"chroma-max-retries", "retries for failing idempotent Chroma requests", &c.Chroma.MaxRetries},
+		{"chroma-retry-backoff", "delay before first Chroma retry (e.g. 200ms)", &c.Chroma.RetryBackoff},
+		{"chroma-token", "Chroma auth token", &c.Chroma.Token},
+		{"chroma-auth-header", "Chroma token header (Authorization or X-Chroma-Token)", &c.Chroma.AuthHeader},
+		{"chroma-username", "Chroma basic auth username", &c.Chroma.Username},
+		{"chroma-password", "Chroma basic auth password", &c.Chroma.Password},
+		{"memory-store", "memory store (chroma, memory)", &c.Memory.Store},
+		{"memory-file", "in-memory store file", &c.Memory.File},
+		{"memory-distance", "distance function for new collections (l2, cosine, ip)", &c.Memory.Distance},
+		{"memory-filter", "default filter expression for recalled memories", &c.Memory.Filter},
+		{"memory-retrieval-results", "number of memories included in prompts", &c.Memory.Retrieval.Results},
+		{"memory-retrieval-over-fetch", "memories fetched by distance before reranking (factor)", &c.Memory.Retrieval.OverFetch},
+		{"memory-retrieval-relevance", "relevance weight", &c.Memory.Retrieval.Relevance},
+		{"memory-retrieval-recency", "recency weight", &c.Memory.Retrieval.Recency},
+		{"memory-retrieval-importance", "importance weight", &c.Memory.Retrieval.Importance},
+		{"memory-retrieval-recency-half-life", "hours after which recency is halved", &c.Memory.Retrieval.RecencyHalfLife},
+		{"memory-rate-importance", "rate importance of new memories with the agent's model", &c.Memory.RateImportance},
+		{"memory-reflection-threshold", "new memories triggering a reflection (0 to disable)", &c.Memory.Reflection.Threshold},
+		{"memory-reflection-max-insights", "max insights per reflection", &c.Memory.Reflection.MaxInsights},
+		{"memory-reflection-results", "reflections included first in prompts", &c.Memory.Reflection.Results},
+		{"memory-conversation-turns", "exchanges kept per agent & sender (0 to disable)", &c.Memory.Conversation.Turns},
+		{"memory-conversation-max-tokens", "token budget of conversations in prompts (0: no limit)", &c.Memory.Conversation.MaxTokens},
+		{"memory-consolidation-min-age", "memories younger than this are never consolidated (e.g. 168h)", &c.Memory.Consolidation.MinAge},
+		{"memory-consolidation-max-importance", "memories more important than this are never consolidated", &c.Memory.Consolidation.MaxImportance},
+		{"memory-consolidation-max-distance", "max cosine distance between clustered memories", &c.Memory.Consolidation.MaxDistance},
+		{"memory-consolidation-min-cluster-size", "smaller clusters are not consolidated", &c.Memory.Consolidation.MinClusterSize},
+		{"memory-consolidation-max-cluster-size", "max memories per summary", &c.Memory.Consolidation.MaxClusterSize},
+		{"memory-consolidation-max-candidates", "memories clustered per consolidation, oldest first", &c.Memory.Consolidation.MaxCandidates},
+		{"memory-consolidation-interval", "periodic consolidation of all agents (e.g. 24h, 0 to disable)", &c.Memory.Consolidation.Interval},
+		{"llm-backend", "default LLM backend (ollama, openai)", &c.LLM.Backend},
+		{"llm-context-size", "context window of models not listed in config (tokens)", &c.LLM.ContextSize},
+		{"llm-response-tokens", "tokens reserved for model answers", &c.LLM.ResponseTokens},
+		{"ollama-host", "Ollama server address", &c.Ollama.Host},
+		{"ollama-model", "default Ollama model", &c.Ollama.Model},
+		{"openai-base-url", "OpenAI compatible API base URL", &c.OpenAI.BaseURL},
+		{"openai-api-key", "OpenAI compatible API key", &c.OpenAI.APIKey},
+		{"openai-model", "default OpenAI compatible model", &c.OpenAI.Model},
+		{"embeddings-backend", "embedding backend (ollama, openai, hash)", &c.Embeddings.Backend},
+		{"embeddings-model", "embedding model", &c.Embeddings.Model},
+		{"embeddings-hash-dimension", "hash embedder dimension", &c.Embeddings.HashDimension},
+	}
+}
+
+// Env var name for setting, e.g. "chroma-host" -> "NPCS_CHROMA_HOST"
+func (s setting) env() string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+func (s setting) set(str string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = str
+	case *bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *int:
+		i, err := strconv.Atoi(str)
+		if err != nil {
+			return err
+		}
+		*v = i
+	case *float64:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		*v = f
+	case *time.Duration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		*v = d
+	}
+	return nil
+}
+
+// Flag value, applied to its setting after config file and
+// environment variables. Boolean settings can be set with "-name".
+type settingFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *settingFlag) Set(str string) error {
+	f.value = str
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Loads configuration, using command line arguments
+// (without program name).
+func loadConfig(args []string) (*Config, error) {
+	c := defaultConfig()
+
+	flags := flag.NewFlagSet("ai-npcs", flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file (default "+DEFAULT_CONFIG_FILE+" if it exists, env: "+ENV_PREFIX+"CONFIG)")
+	flagValues := make(map[string]*settingFlag)
+	for _, s := range c.settings() {
+		_, isBool := s.value.(*bool)
+		flagValues[s.name] = &settingFlag{isBool: isBool}
+		flags.Var(flagValues[s.name], s.name, s.usage+" (env: "+s.env()+")")
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// config file
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(ENV_PREFIX + "CONFIG")
+	}
+	if path != "" {
+		err = c.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(DEFAULT_CONFIG_FILE); err == nil {
+		err = c.loadFile(DEFAULT_CONFIG_FILE)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// environment variables
+	for _, s := range c.settings() {
+		if str, exists := os.LookupEnv(s.env()); exists {
+			err = s.set(str)
+			if err != nil {
+				return nil, errors.New(s.env() + ": " + err.Error())
+			}
+		}
+	}
+
+	// flags (only the ones explicitly set)
+	settings := make(map[string]setting)
+	for _, s := range c.settings() {
+		settings[s.name] = s
+	}
+	flags.Visit(func(f *flag.Flag) {
+		s, exists := settings[f.Name]
+		if exists == false || err != nil {
+			return
+		}
+		err = s.set(flagValues[f.Name].value)
+		if err != nil {
+			err = errors.New("-" + f.Name + ": " + err.Error())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true) // typos should not be silently ignored
+	err = decoder.Decode(c)
+	if err != nil && errors.Is(err, io.EOF) == false {
+		return errors.New("can't parse " + path + ": " + err.Error())
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Port == "" {
+		return errors.New("config: port can't be empty")
+	}
+	if c.AgentsFile == "" {
+		return errors.New("config: agents-file can't be empty")
+	}
+
+	// templates are loaded on startup, making sure the default one exists
+	if c.Prompts.Default == "" {
+		return errors.New("config: prompts default can't be empty")
+	}
+
+	switch c.Memory.Store {
+	case MEMORY_STORE_CHROMA:
+		if c.Chroma.Tenant == "" || c.Chroma.Database == "" {
+			return errors.New("config: chroma tenant and database can't be empty")
+		}
+		switch c.Chroma.APIVersion {
+		case "", CHROMA_API_V1, CHROMA_API_V2:
+		default:
+			return errors.New("config: unknown chroma api-version: " + c.Chroma.APIVersion)
+		}
+		if c.Chroma.Timeout < 0 || c.Chroma.MaxRetries < 0 || c.Chroma.RetryBackoff < 0 {
+			return errors.New("config: chroma timeout, max-retries and retry-backoff can't be negative")
+		}
+		if c.Chroma.MaxRetries > 0 && c.Chroma.RetryBackoff == 0 {
+			return errors.New("config: chroma retry-backoff can't be 0 when retries are enabled")
+		}
+		err := checkURL("chroma host", c.Chroma.Host)
+		if err != nil {
+			return err
+		}
+	case MEMORY_STORE_INMEMORY:
+	default:
+		return errors.New("config: unknown memory store: " + c.Memory.Store)
+	}
+
+	switch c.Memory.Distance {
+	case HNSW_SPACE_L2, HNSW_SPACE_COSINE, HNSW_SPACE_IP:
+	default:
+		return errors.New("config: unknown memory distance: " + c.Memory.Distance)
+	}
+
+	if _, err := ParseFilter(c.Memory.Filter); err != nil {
+		return errors.New("config: memory filter: " + err.Error())
+	}
+
+	if err := c.Memory.Retrieval.validate(); err != nil {
+		return errors.New("config: memory: " + err.Error())
+	}
+
+	if c.Memory.Reflection.Threshold < 0 || c.Memory.Reflection.Results < 0 {
+		return errors.New("config: memory reflection threshold and results can't be negative")
+	}
+	if c.Memory.Reflection.MaxInsights < 1 {
+		return errors.New("config: memory reflection max-insights should be positive")
+	}
+
+	if c.Memory.Conversation.Turns < 0 || c.Memory.Conversation.MaxTokens < 0 {
+		return errors.New("config: memory conversation turns and max-tokens can't be negative")
+	}
+
+	if err := c.Memory.Consolidation.validate(); err != nil {
+		return errors.New("config: memory consolidation: " + err.Error())
+	}
+
+	switch c.LLM.Backend {
+	case LLM_BACKEND_OLLAMA, LLM_BACKEND_OPENAI:
+	default:
+		return errors.New("config: unknown LLM backend: " + c.LLM.Backend)
+	}
+
+	if c.LLM.ResponseTokens < 0 {
+		return errors.New("config: llm response-tokens can't be negative")
+	}
+	if c.LLM.ContextSize <= c.LLM.ResponseTokens {
+		return errors.New("config: llm context-size should be greater than response-tokens")
+	}
+	for model, size := range c.LLM.ContextSizes {
+		if size <= c.LLM.ResponseTokens {
+			return errors.New("config: llm context size of " + model + " should be greater than response-tokens")
+		}
+	}
+
+	switch c.Embeddings.Backend {
+	case EMBEDDING_BACKEND_OLLAMA, EMBEDDING_BACKEND_OPENAI:
+		if c.Embeddings.Model == "" {
+			return errors.New("config: embeddings model can't be empty")
+		}
+	case EMBEDDING_BACKEND_HASH:
+		if c.Embeddings.HashDimension < 1 {
+			return errors.New("config: embeddings hash-dimension should be positive")
+		}
+	default:
+		return errors.New("config: unknown embeddings backend: " + c.Embeddings.Backend)
+	}
+
+	if c.Ollama.Host != "" {
+		err := checkURL("ollama host", c.Ollama.Host)
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkURL("openai base-url", c.OpenAI.BaseURL)
+}
+
+func checkURL(name, str string) error {
+	u, err := url.Parse(str)
+	if err != nil {
+		return errors.New("config: " + name + ": " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("config: " + name + " should be an http(s) URL: " + str)
+	}
+	return nil
+}
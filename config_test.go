@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "port: \":8000\"\n" +
+		"chroma:\n" +
+		"  host: http://file:8000\n" +
+		"ollama:\n" +
+		"  model: file-model\n" +
+		"embeddings:\n" +
+		"  model: file-embeddings\n"
+	err := os.WriteFile(path, []byte(yaml), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ENV_PREFIX+"CONFIG", path)
+	t.Setenv(ENV_PREFIX+"CHROMA_HOST", "http://env:8000")
+	t.Setenv(ENV_PREFIX+"OLLAMA_MODEL", "env-model")
+
+	c, err := loadConfig([]string{"-ollama-model=flag-model"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"default", c.AgentsFile, defaultConfig().AgentsFile},
+		{"file", c.Port, ":8000"},
+		{"file", c.Embeddings.Model, "file-embeddings"},
+		{"env over file", c.Chroma.Host, "http://env:8000"},
+		{"flag over env", c.Ollama.Model, "flag-model"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknownField := filepath.Join(dir, "unknown.yaml")
+	err := os.WriteFile(unknownField, []byte("prot: \":8000\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"missing file", nil, []string{"-config=" + filepath.Join(dir, "missing.yaml")}},
+		{"unknown field", nil, []string{"-config=" + unknownField}},
+		{"invalid env", map[string]string{ENV_PREFIX + "DEBUG": "maybe"}, nil},
+		{"invalid flag", nil, []string{"-embeddings-hash-dimension=many"}},
+		{"invalid value", nil, []string{"-memory-store=disk"}},
+		{"unknown flag", nil, []string{"-nope=1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(ENV_PREFIX+"CONFIG", "")
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadConfig(test.args)
+			if err == nil {
+				t.Errorf("%s: got no error", test.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Consolidation: old, low-importance memories that are similar to each
+// other are clustered, each cluster is replaced with a summary written
+// by the agent's model (MEMORY_KIND_SUMMARY), and the originals are deleted.
+// Retention policies are defined in config.Memory.Consolidation.
+
+const (
+	// memories fetched per request when listing candidates
+	CONSOLIDATION_PAGE_SIZE = 500
+
+	summary_prompt_format = `You're %s, a game entity.
+Summarize these memories in a few short sentences, from your point of view.
+Keep names, facts, promises and anything that could matter later, drop small talk.
+Only respond with the summary.
+
+%s`
+)
+
+var (
+	// agents being consolidated, only one consolidation at a time per agent
+	consolidating = make(map[string]bool)
+	// last candidate considered by each agent's previous consolidation,
+	// the next one continues with more recent candidates
+	consolidationCursors = make(map[string]memoryCursor)
+	// protects consolidating & consolidationCursors
+	consolidatingMutex sync.Mutex
+)
+
+// Retention policy, see config.example.yaml
+type ConsolidationSettings struct {
+	// memories younger than this are never consolidated
+	MinAge time.Duration `yaml:"min-age"`
+	// memories more important than this are never consolidated
+	// (memories with no rating have DEFAULT_IMPORTANCE)
+	MaxImportance int `yaml:"max-importance"`
+	// kinds of memories that can be consolidated
+	// (memories stored before kinds were introduced always can)
+	Kinds []string `yaml:"kinds"`
+	// memories are clustered when their cosine distance
+	// to the first memory of the cluster is below MaxDistance
+	MaxDistance float64 `yaml:"max-distance"`
+	// smaller clusters are left untouched
+	MinClusterSize int `yaml:"min-cluster-size"`
+	MaxClusterSize int `yaml:"max-cluster-size"`
+	// candidates clustered per consolidation, oldest first (clustering is
+	// quadratic), following consolidations continue with the next ones
+	MaxCandidates int `yaml:"max-candidates"`
+	// periodic consolidation of all agents (0 to disable)
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (s ConsolidationSettings) validate() error {
+	if s.MinAge < 0 || s.Interval < 0 {
+		return errors.New("min-age and interval can't be negative")
+	}
+	if s.MaxDistance <= 0 {
+		return errors.New("max-distance should be positive")
+	}
+	if s.MinClusterSize < 2 || s.MaxClusterSize < s.MinClusterSize {
+		return errors.New("min-cluster-size should be at least 2, and max-cluster-size at least min-cluster-size")
+	}
+	if s.MaxCandidates < s.MinClusterSize {
+		return errors.New("max-candidates should be at least min-cluster-size")
+	}
+	return nil
+}
+
+type ConsolidationReport struct {
+	AgentID string `json:"agent"`
+	DryRun  bool   `json:"dry-run"`
+	// memories matching retention policy, considered
+	// by this consolidation (see MaxCandidates)
+	Candidates int                    `json:"candidates"`
+	Clusters   []ConsolidationCluster `json:"clusters"`
+	// number of deleted memories (0 when dry run)
+	Deleted int `json:"deleted"`
+}
+
+type ConsolidationCluster struct {
+	Memories []Memory `json:"memories"`
+	// nil when dry run
+	Summary *Memory `json:"summary,omitempty"`
+}
+
+func startConsolidating(agentID string) bool {
+	consolidatingMutex.Lock()
+	defer consolidatingMutex.Unlock()
+	if consolidating[agentID] {
+		return false
+	}
+	consolidating[agentID] = true
+	return true
+}
+
+func stopConsolidating(agentID string) {
+	consolidatingMutex.Lock()
+	defer consolidatingMutex.Unlock()
+	delete(consolidating, agentID)
+}
+
+// Consolidates agent's memories. With dryRun, nothing is generated
+// nor deleted, the report shows which memories would be summarized.
+func consolidateMemories(ctx context.Context, agent *Agent, collection MemoryCollection, settings ConsolidationSettings, dryRun bool) (*ConsolidationReport, error) {
+	consolidatingMutex.Lock()
+	after := consolidationCursors[agent.ID]
+	consolidatingMutex.Unlock()
+
+	candidates, next, err := consolidationCandidates(ctx, collection, settings, time.Now(), after)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun == false {
+		consolidatingMutex.Lock()
+		consolidationCursors[agent.ID] = next
+		consolidatingMutex.Unlock()
+	}
+
+	report := &ConsolidationReport{
+		AgentID:    agent.ID,
+		DryRun:     dryRun,
+		Candidates: len(candidates),
+		Clusters:   make([]ConsolidationCluster, 0),
+	}
+
+	for _, cluster := range clusterMemories(candidates, settings) {
+		// embeddings are not needed in reports
+		memories := make([]Memory, len(cluster))
+		for i, entry := range cluster {
+			memories[i] = memoryFromEntry(entry)
+		}
+
+		c := ConsolidationCluster{Memories: memories}
+		if dryRun == false {
+			c.Summary, err = summarizeMemories(ctx, agent, collection, memories)
+			if err != nil {
+				return report, err
+			}
+			report.Deleted += len(memories)
+		}
+		report.Clusters = append(report.Clusters, c)
+	}
+
+	if config.Debug && dryRun == false && len(report.Clusters) > 0 {
+		fmt.Println("🧹 Agent", agent.Name, "consolidated", report.Deleted, "memories into", len(report.Clusters), "summaries")
+	}
+
+	return report, nil
+}
+
+// Returns up to settings.MaxCandidates memories that can be consolidated
+// (with embeddings), oldest first, after given cursor (from the start if
+// zero). next is the cursor to start from next time, zero once all
+// candidates were returned. Only metadata is listed for the whole collection.
+func consolidationCandidates(ctx context.Context, collection MemoryCollection, settings ConsolidationSettings, now time.Time, after memoryCursor) (candidates []ChromaCollectionEntry, next memoryCursor, err error) {
+	kinds := make(map[string]bool)
+	for _, kind := range settings.Kinds {
+		kinds[kind] = true
+	}
+
+	memories := make([]Memory, 0)
+	for offset := 0; ; offset += CONSOLIDATION_PAGE_SIZE {
+		entries, err := collection.Get(ctx, ChromaCollectionGet{
+			Limit:   CONSOLIDATION_PAGE_SIZE,
+			Offset:  offset,
+			Include: []string{INCLUDE_METADATAS},
+		})
+		if err != nil {
+			return nil, next, err
+		}
+
+		for _, entry := range entries {
+			m := memoryFromEntry(entry)
+			if m.Kind != "" && kinds[m.Kind] == false {
+				continue
+			}
+			if m.CreatedAt.IsZero() == false && now.Sub(m.CreatedAt) < settings.MinAge {
+				continue
+			}
+			// memory IDs are never empty, zero cursor is before all memories
+			if after.before(memoryCursorOf(m)) == false {
+				continue
+			}
+			if m.importanceOrDefault() > settings.MaxImportance {
+				continue
+			}
+			memories = append(memories, m)
+		}
+
+		if len(entries) < CONSOLIDATION_PAGE_SIZE {
+			break
+		}
+	}
+
+	// memories with no creation time come first, they're the oldest
+	sort.Slice(memories, func(i, j int) bool {
+		return memoryCursorOf(memories[i]).before(memoryCursorOf(memories[j]))
+	})
+	if len(memories) > settings.MaxCandidates {
+		memories = memories[:settings.MaxCandidates]
+		next = memoryCursorOf(memories[len(memories)-1])
+	}
+	if len(memories) == 0 {
+		return []ChromaCollectionEntry{}, next, nil
+	}
+
+	ids := make([]string, len(memories))
+	for i, m := range memories {
+		ids[i] = m.ID
+	}
+	entries, err := collection.Get(ctx, ChromaCollectionGet{
+		IDs:     ids,
+		Include: []string{INCLUDE_EMBEDDINGS, INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+	})
+	if err != nil {
+		return nil, next, err
+	}
+
+	// in candidates order, memories deleted meanwhile are skipped
+	byID := make(map[string]ChromaCollectionEntry, len(entries))
+	for _, entry := range entries {
+		byID[entry.ID] = entry
+	}
+	candidates = make([]ChromaCollectionEntry, 0, len(entries))
+	for _, id := range ids {
+		entry, exists := byID[id]
+		if exists == false || entry.Embedding == nil || len(*entry.Embedding) == 0 {
+			continue
+		}
+		candidates = append(candidates, entry)
+	}
+
+	return candidates, next, nil
+}
+
+// Greedy clustering: each memory not in a cluster yet starts a new one,
+// gathering following memories close enough to it.
+// Clusters smaller than settings.MinClusterSize are dropped.
+func clusterMemories(entries []ChromaCollectionEntry, settings ConsolidationSettings) [][]ChromaCollectionEntry {
+	clustered := make([]bool, len(entries))
+	clusters := make([][]ChromaCollectionEntry, 0)
+
+	for i, seed := range entries {
+		if clustered[i] {
+			continue
+		}
+
+		members := []int{i}
+		for j := i + 1; j < len(entries) && len(members) < settings.MaxClusterSize; j++ {
+			if clustered[j] || len(*entries[j].Embedding) != len(*seed.Embedding) {
+				continue
+			}
+			if cosineDistance(*seed.Embedding, *entries[j].Embedding) <= settings.MaxDistance {
+				members = append(members, j)
+			}
+		}
+
+		if len(members) < settings.MinClusterSize {
+			continue
+		}
+
+		cluster := make([]ChromaCollectionEntry, len(members))
+		for k, member := range members {
+			clustered[member] = true
+			cluster[k] = entries[member]
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters
+}
+
+// Replaces memories with a summary written by the agent's model.
+// The summary is stored before deleting the originals, and replaces
+// them in the sources of other reflections & summaries.
+func summarizeMemories(ctx context.Context, agent *Agent, collection MemoryCollection, memories []Memory) (*Memory, error) {
+	now := time.Now()
+
+	list := ""
+	for _, m := range memories {
+		list += m.promptLine(now, nil)
+	}
+
+	text, err := generate(ctx, agent, fmt.Sprintf(summary_prompt_format, agent.Name, list), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	document := strings.TrimSpace(text)
+	if document == "" {
+		return nil, errors.New("model returned an empty summary")
+	}
+
+	// summary keeps the context shared by all memories,
+	// the time of the latest one and the highest importance
+	summary := Memory{
+		Document:       document,
+		AgentID:        agent.ID,
+		Kind:           MEMORY_KIND_SUMMARY,
+		Sender:         memories[0].Sender,
+		ConversationID: memories[0].ConversationID,
+		Location:       memories[0].Location,
+	}
+	ids := make([]string, len(memories))
+	for i, m := range memories {
+		ids[i] = m.ID
+		if m.CreatedAt.After(summary.CreatedAt) {
+			summary.CreatedAt = m.CreatedAt
+		}
+		if m.GameTime != nil && (summary.GameTime == nil || *m.GameTime > *summary.GameTime) {
+			summary.GameTime = m.GameTime
+		}
+		summary.Importance = max(summary.Importance, m.Importance)
+		if m.Sender != summary.Sender {
+			summary.Sender = ""
+		}
+		if m.ConversationID != summary.ConversationID {
+			summary.ConversationID = ""
+		}
+		if m.Location != summary.Location {
+			summary.Location = ""
+		}
+	}
+	summary.Sources = ids
+
+	hash := md5.New()
+	io.WriteString(hash, MEMORY_KIND_SUMMARY+strings.Join(ids, ","))
+	summary.ID = hex.EncodeToString(hash.Sum(nil))
+
+	embedding, err := embedder.Embed(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+
+	err = collection.Upsert(ctx, []ChromaCollectionEntry{
+		{
+			ID:        summary.ID,
+			Embedding: &embedding,
+			Document:  summary.Document,
+			Metadatas: summary.metadata(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = replaceSources(ctx, collection, ids, summary.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = collection.Delete(ctx, ChromaCollectionDelete{IDs: ids})
+	if err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+// Replaces given memory IDs with newID in the sources
+// of reflections & summaries (other than newID).
+func replaceSources(ctx context.Context, collection MemoryCollection, ids []string, newID string) error {
+	replaced := make(map[string]bool)
+	for _, id := range ids {
+		replaced[id] = true
+	}
+
+	entries, err := collection.Get(ctx, ChromaCollectionGet{
+		Where: WhereField{
+			Name:     MEMORY_KIND,
+			Operator: In,
+			Value:    []string{MEMORY_KIND_REFLECTION, MEMORY_KIND_SUMMARY},
+		},
+		Include: []string{INCLUDE_METADATAS},
+	})
+	if err != nil {
+		return err
+	}
+
+	updates := make([]ChromaCollectionEntry, 0)
+	for _, entry := range entries {
+		m := memoryFromEntry(entry)
+		if m.ID == newID {
+			continue
+		}
+
+		sources := make([]string, 0, len(m.Sources))
+		changed := false
+		for _, source := range m.Sources {
+			if replaced[source] {
+				source = newID
+				changed = true
+			}
+			if slices.Contains(sources, source) == false {
+				sources = append(sources, source)
+			}
+		}
+		if changed == false {
+			continue
+		}
+
+		m.Sources = sources
+		updates = append(updates, ChromaCollectionEntry{ID: m.ID, Metadatas: m.metadata()})
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return collection.Update(ctx, updates)
+}
+
+// Consolidates memories of all agents every settings.Interval
+func startConsolidationJob(settings ConsolidationSettings) {
+	if settings.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(settings.Interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			agentsMutex.RLock()
+			list := make([]*Agent, 0, len(agents))
+			for _, agent := range agents {
+				list = append(list, agent)
+			}
+			agentsMutex.RUnlock()
+
+			for _, agent := range list {
+				if startConsolidating(agent.ID) == false {
+					continue
+				}
+				ctx := context.Background()
+				collection, err := memoryStore.GetCollection(ctx, agent.ID)
+				if err == nil {
+					_, err = consolidateMemories(ctx, agent, collection, settings, false)
+				}
+				stopConsolidating(agent.ID)
+				if err != nil {
+					fmt.Println("❌ consolidation (agent "+agent.ID+"):", err.Error())
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func clusterIDs(clusters [][]ChromaCollectionEntry) [][]string {
+	ids := make([][]string, len(clusters))
+	for i, cluster := range clusters {
+		ids[i] = make([]string, len(cluster))
+		for j, entry := range cluster {
+			ids[i][j] = entry.ID
+		}
+	}
+	return ids
+}
+
+func TestClusterMemories(t *testing.T) {
+	settings := ConsolidationSettings{MaxDistance: 0.3, MinClusterSize: 2, MaxClusterSize: 3}
+
+	tests := []struct {
+		name      string
+		documents []string
+		settings  ConsolidationSettings
+		clusters  [][]string
+	}{
+		{
+			"similar memories",
+			[]string{"bob sells swords", "alice likes apples", "bob sells swords", "alice likes apples"},
+			settings,
+			[][]string{{"bob sells swords", "bob sells swords"}, {"alice likes apples", "alice likes apples"}},
+		},
+		{
+			"clusters smaller than min-cluster-size are dropped",
+			[]string{"bob sells swords", "alice likes apples", "bob sells swords", "the mayor is away"},
+			ConsolidationSettings{MaxDistance: 0.3, MinClusterSize: 3, MaxClusterSize: 3},
+			[][]string{},
+		},
+		{
+			"max-cluster-size",
+			[]string{"bob sells swords", "bob sells swords", "bob sells swords", "bob sells swords", "bob sells swords"},
+			settings,
+			[][]string{{"bob sells swords", "bob sells swords", "bob sells swords"}, {"bob sells swords", "bob sells swords"}},
+		},
+		{
+			"distance to the first memory of the cluster",
+			[]string{"bob sells swords", "bob sells swords and shields", "bob sells swords"},
+			ConsolidationSettings{MaxDistance: 0.1, MinClusterSize: 2, MaxClusterSize: 10},
+			[][]string{{"bob sells swords", "bob sells swords"}},
+		},
+		{
+			"no memories",
+			[]string{},
+			settings,
+			[][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		clusters := clusterMemories(hashEmbeddedEntries(t, test.documents...), test.settings)
+		if ids := clusterIDs(clusters); reflect.DeepEqual(ids, test.clusters) == false {
+			t.Errorf("%s: got %v, want %v", test.name, ids, test.clusters)
+		}
+	}
+}
+
+func TestConsolidationCandidates(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 old memories (oldest first), a recent one, an important one & a reflection
+	memories := make([]Memory, 0)
+	for i := 0; i < 5; i++ {
+		memories = append(memories, Memory{
+			ID:        "old-" + strconv.Itoa(i),
+			CreatedAt: now.Add(-time.Duration(100-i) * time.Hour),
+			Kind:      MEMORY_KIND_CONVERSATION,
+		})
+	}
+	memories = append(memories,
+		Memory{ID: "recent", CreatedAt: now.Add(-time.Hour), Kind: MEMORY_KIND_CONVERSATION},
+		Memory{ID: "important", CreatedAt: now.Add(-200 * time.Hour), Kind: MEMORY_KIND_CONVERSATION, Importance: 9},
+		Memory{ID: "reflection", CreatedAt: now.Add(-200 * time.Hour), Kind: MEMORY_KIND_REFLECTION},
+	)
+	entries := hashEmbeddedEntries(t, "bob sells swords")
+	for _, m := range memories {
+		entries = append(entries, ChromaCollectionEntry{ID: m.ID, Document: m.ID, Embedding: entries[0].Embedding, Metadatas: m.metadata()})
+	}
+	err = collection.Add(ctx, entries[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := ConsolidationSettings{
+		MinAge:        24 * time.Hour,
+		MaxImportance: 5,
+		Kinds:         []string{MEMORY_KIND_CONVERSATION},
+		MaxCandidates: 2,
+	}
+
+	// batches of 2 candidates, oldest first, then starting over
+	want := [][]string{{"old-0", "old-1"}, {"old-2", "old-3"}, {"old-4"}, {"old-0", "old-1"}}
+	var after memoryCursor
+	for _, ids := range want {
+		candidates, next, err := consolidationCandidates(ctx, collection, settings, now, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := clusterIDs([][]ChromaCollectionEntry{candidates})[0]; reflect.DeepEqual(got, ids) == false {
+			t.Fatalf("candidates after %v: got %v, want %v", after, got, ids)
+		}
+		for _, c := range candidates {
+			if c.Embedding == nil || c.Document == "" {
+				t.Errorf("candidate %s should have its embedding & document", c.ID)
+			}
+		}
+		after = next
+	}
+}
+
+func TestConsolidationCandidatesSameTime(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// batch boundaries between memories created at the same
+	// time, including memories with no creation time
+	old := now.Add(-100 * time.Hour).Truncate(time.Second)
+	memories := []Memory{
+		{ID: "zero-b", Kind: MEMORY_KIND_CONVERSATION},
+		{ID: "zero-a", Kind: MEMORY_KIND_CONVERSATION},
+		{ID: "zero-c", Kind: MEMORY_KIND_CONVERSATION},
+		{ID: "old-c", CreatedAt: old, Kind: MEMORY_KIND_CONVERSATION},
+		{ID: "old-a", CreatedAt: old, Kind: MEMORY_KIND_CONVERSATION},
+		{ID: "old-b", CreatedAt: old, Kind: MEMORY_KIND_CONVERSATION},
+	}
+	entries := hashEmbeddedEntries(t, "bob sells swords")
+	for _, m := range memories {
+		entries = append(entries, ChromaCollectionEntry{ID: m.ID, Document: m.ID, Embedding: entries[0].Embedding, Metadatas: m.metadata()})
+	}
+	err = collection.Add(ctx, entries[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := ConsolidationSettings{
+		MinAge:        24 * time.Hour,
+		MaxImportance: 5,
+		Kinds:         []string{MEMORY_KIND_CONVERSATION},
+		MaxCandidates: 2,
+	}
+
+	want := [][]string{{"zero-a", "zero-b"}, {"zero-c", "old-a"}, {"old-b", "old-c"}, {"zero-a", "zero-b"}}
+	var after memoryCursor
+	for _, ids := range want {
+		candidates, next, err := consolidationCandidates(ctx, collection, settings, now, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := clusterIDs([][]ChromaCollectionEntry{candidates})[0]; reflect.DeepEqual(got, ids) == false {
+			t.Fatalf("candidates after %v: got %v, want %v", after, got, ids)
+		}
+		after = next
+	}
+}
+
+func TestReplaceSources(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memories := []Memory{
+		{ID: "r1", Kind: MEMORY_KIND_REFLECTION, Sources: []string{"a", "b", "c"}},
+		{ID: "r2", Kind: MEMORY_KIND_REFLECTION, Sources: []string{"c"}, Metadata: map[string]any{"custom": "kept"}},
+		{ID: "s1", Kind: MEMORY_KIND_SUMMARY, Sources: []string{"b"}},
+		{ID: "s2", Kind: MEMORY_KIND_SUMMARY, Sources: []string{"a", "b"}},
+	}
+	entries := hashEmbeddedEntries(t, "bob sells swords")
+	for _, m := range memories {
+		entries = append(entries, ChromaCollectionEntry{ID: m.ID, Document: m.ID, Embedding: entries[0].Embedding, Metadatas: m.metadata()})
+	}
+	err = collection.Add(ctx, entries[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// s2 replaces a & b
+	err = replaceSources(ctx, collection, []string{"a", "b"}, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = collection.Get(ctx, ChromaCollectionGet{Include: []string{INCLUDE_METADATAS}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string][]string)
+	for _, m := range memoriesFromEntries(entries) {
+		sources[m.ID] = m.Sources
+		if m.ID == "r2" && m.Metadata["custom"] != "kept" {
+			t.Errorf("r2 metadata not kept: %v", m.Metadata)
+		}
+	}
+
+	want := map[string][]string{
+		"r1": {"s2", "c"},
+		"r2": {"c"},
+		"s1": {"s2"},
+		"s2": {"a", "b"},
+	}
+	if reflect.DeepEqual(sources, want) == false {
+		t.Errorf("got %v, want %v", sources, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Short-term memory: the last exchanges between an agent and each sender,
+// included in prompts in order, before recalled memories. Vector search
+// alone loses the thread of a conversation when the previous line isn't
+// semantically close to the new message.
+// Buffers are kept in process, they're lost when the server restarts
+// (exchanges remain in long-term memory).
+
+var (
+	conversations      = make(map[conversationKey][]ConversationTurn)
+	conversationsMutex sync.RWMutex
+)
+
+type conversationKey struct {
+	agentID string
+	sender  string
+}
+
+// Exchange between an agent and a sender
+type ConversationTurn struct {
+	Sender  string `json:"sender,omitempty"`
+	Message string `json:"message"`
+	Answer  string `json:"answer"`
+	Action  string `json:"action,omitempty"`
+	Target  string `json:"target,omitempty"`
+	// ID of the memory storing the exchange,
+	// recalled memories already in the buffer are skipped
+	MemoryID  string    `json:"memory-id,omitempty"`
+	CreatedAt time.Time `json:"created-at"`
+	GameTime  *float64  `json:"game-time,omitempty"`
+}
+
+// Appends turn to agent's conversation with turn.Sender,
+// keeping the last config.Memory.Conversation.Turns turns.
+func addConversationTurn(agentID string, turn ConversationTurn) {
+	n := config.Memory.Conversation.Turns
+	if n <= 0 {
+		return
+	}
+
+	conversationsMutex.Lock()
+	defer conversationsMutex.Unlock()
+
+	key := conversationKey{agentID: agentID, sender: turn.Sender}
+	turns := append(conversations[key], turn)
+	if len(turns) > n {
+		// copy, so the dropped turns can be garbage collected
+		turns = append([]ConversationTurn(nil), turns[len(turns)-n:]...)
+	}
+	conversations[key] = turns
+}
+
+// Returns agent's conversation with sender, oldest turn first
+func conversationTurns(agentID, sender string) []ConversationTurn {
+	conversationsMutex.RLock()
+	defer conversationsMutex.RUnlock()
+
+	turns := conversations[conversationKey{agentID: agentID, sender: sender}]
+	// callers can't see turns appended later
+	return append(make([]ConversationTurn, 0, len(turns)), turns...)
+}
+
+// Removes agent's conversation with sender, or all
+// agent's conversations when sender is nil.
+func clearConversations(agentID string, sender *string) {
+	conversationsMutex.Lock()
+	defer conversationsMutex.Unlock()
+
+	for key := range conversations {
+		if key.agentID == agentID && (sender == nil || key.sender == *sender) {
+			delete(conversations, key)
+		}
+	}
+}
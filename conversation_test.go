@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConversationBuffer(t *testing.T) {
+	turns := config.Memory.Conversation.Turns
+	config.Memory.Conversation.Turns = 2
+	defer func() { config.Memory.Conversation.Turns = turns }()
+	defer clearConversations("test-bob", nil)
+	defer clearConversations("test-carl", nil)
+
+	messages := func(turns []ConversationTurn) []string {
+		messages := []string{}
+		for _, turn := range turns {
+			messages = append(messages, turn.Message)
+		}
+		return messages
+	}
+
+	addConversationTurn("test-bob", ConversationTurn{Sender: "Alice", Message: "1"})
+	addConversationTurn("test-bob", ConversationTurn{Sender: "Dave", Message: "other sender"})
+	addConversationTurn("test-carl", ConversationTurn{Sender: "Alice", Message: "other agent"})
+	addConversationTurn("test-bob", ConversationTurn{Sender: "Alice", Message: "2"})
+
+	got := conversationTurns("test-bob", "Alice")
+	addConversationTurn("test-bob", ConversationTurn{Sender: "Alice", Message: "3"})
+
+	// returned turns are not affected by later turns
+	if want := []string{"1", "2"}; reflect.DeepEqual(messages(got), want) == false {
+		t.Errorf("got %v, want %v", messages(got), want)
+	}
+	// oldest turns dropped
+	got = conversationTurns("test-bob", "Alice")
+	if want := []string{"2", "3"}; reflect.DeepEqual(messages(got), want) == false {
+		t.Errorf("got %v, want %v", messages(got), want)
+	}
+	if got := conversationTurns("test-bob", "Nobody"); len(got) != 0 {
+		t.Errorf("unknown sender: got %v, want no turns", messages(got))
+	}
+
+	sender := "Alice"
+	clearConversations("test-bob", &sender)
+	if got := conversationTurns("test-bob", "Alice"); len(got) != 0 {
+		t.Errorf("cleared sender: got %v, want no turns", messages(got))
+	}
+	if got := conversationTurns("test-bob", "Dave"); len(got) != 1 {
+		t.Errorf("other sender: got %v, want 1 turn", messages(got))
+	}
+
+	clearConversations("test-bob", nil)
+	if got := conversationTurns("test-bob", "Dave"); len(got) != 0 {
+		t.Errorf("cleared agent: got %v, want no turns", messages(got))
+	}
+	if got := conversationTurns("test-carl", "Alice"); len(got) != 1 {
+		t.Errorf("other agent: got %v, want 1 turn", messages(got))
+	}
+
+	// disabled
+	config.Memory.Conversation.Turns = 0
+	addConversationTurn("test-bob", ConversationTurn{Sender: "Alice", Message: "4"})
+	if got := conversationTurns("test-bob", "Alice"); len(got) != 0 {
+		t.Errorf("disabled: got %v, want no turns", messages(got))
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ollama "github.com/ollama/ollama/api"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	EMBEDDING_BACKEND_OLLAMA = "ollama"
+	EMBEDDING_BACKEND_OPENAI = "openai" // OpenAI compatible /v1/embeddings
+	EMBEDDING_BACKEND_HASH   = "hash"   // deterministic, offline (tests)
+
+	// collection metadata keys
+	EMBEDDING_MODEL_KEY     = "embedding_model"
+	EMBEDDING_DIMENSION_KEY = "embedding_dimension"
+)
+
+var (
+	embedder Embedder
+
+	errDimensionMismatch = fmt.Errorf("%w: embedding dimension mismatch", ErrInvalidArgument)
+)
+
+// Computes embeddings for memories and queries
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float64, error)
+	// Model name, recorded in collection metadata
+	Model() string
+}
+
+func NewEmbedder(backend string) (Embedder, error) {
+	switch backend {
+	case EMBEDDING_BACKEND_OLLAMA:
+		client, err := newOllamaClient()
+		if err != nil {
+			return nil, err
+		}
+		return NewOllamaEmbedder(client, config.Embeddings.Model), nil
+	case EMBEDDING_BACKEND_OPENAI:
+		return NewOpenAIEmbedder(config.OpenAI.BaseURL, config.OpenAI.APIKey, config.Embeddings.Model)
+	case EMBEDDING_BACKEND_HASH:
+		return NewHashEmbedder(config.Embeddings.HashDimension), nil
+	}
+	return nil, errors.New("unknown embedding backend: " + backend)
+}
+
+// Makes sure collection only contains embeddings with given dimension,
+// recording embedding model & dimension in collection's metadata the
+// first time it's used.
+func checkEmbeddingDimension(ctx context.Context, collection MemoryCollection, model string, dimension int) error {
+	collectionMetadata := collection.GetMetadata()
+
+	if v, exists := collectionMetadata[EMBEDDING_DIMENSION_KEY]; exists {
+		var collectionDimension int
+		switch v := v.(type) {
+		case float64:
+			collectionDimension = int(v)
+		case int:
+			collectionDimension = v
+		}
+
+		if collectionDimension != dimension {
+			return fmt.Errorf("%w: collection %s contains %d-dimension embeddings (%v), got %d (%s)",
+				errDimensionMismatch, collection.GetName(), collectionDimension, collectionMetadata[EMBEDDING_MODEL_KEY], dimension, model)
+		}
+
+		if collectionModel, ok := collectionMetadata[EMBEDDING_MODEL_KEY].(string); ok && collectionModel != model {
+			fmt.Println("⚠️ collection", collection.GetName(), "embeddings computed with", collectionModel, "- now using", model)
+		}
+
+		return nil
+	}
+
+	// HNSW settings can't be modified, Chroma rejects them
+	metadata := make(map[string]any)
+	for k, v := range collectionMetadata {
+		if strings.HasPrefix(k, HNSW_KEY_PREFIX) {
+			continue
+		}
+		metadata[k] = v
+	}
+	metadata[EMBEDDING_MODEL_KEY] = model
+	metadata[EMBEDDING_DIMENSION_KEY] = dimension
+
+	return collection.SetMetadata(ctx, metadata)
+}
+
+type OllamaEmbedder struct {
+	client *ollama.Client
+	model  string
+}
+
+func NewOllamaEmbedder(client *ollama.Client, model string) *OllamaEmbedder {
+	return &OllamaEmbedder{
+		client: client,
+		model:  model,
+	}
+}
+
+func (e *OllamaEmbedder) Model() string {
+	return e.model
+}
+
+func (e *OllamaEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	resp, err := e.client.Embeddings(ctx, &ollama.EmbeddingRequest{
+		Model:  e.model,
+		Prompt: text,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Embedding) == 0 {
+		return nil, errors.New("empty embedding (is " + e.model + " an embedding model?)")
+	}
+	return resp.Embedding, nil
+}
+
+// Deterministic embedder, hashing words into a fixed number of buckets.
+// Only similar words make similar vectors, it's meant for tests and
+// offline use, not for meaningful semantic search.
+type HashEmbedder struct {
+	dimension int
+}
+
+func NewHashEmbedder(dimension int) *HashEmbedder {
+	return &HashEmbedder{dimension: dimension}
+}
+
+func (e *HashEmbedder) Model() string {
+	return "hash-" + strconv.Itoa(e.dimension)
+}
+
+func (e *HashEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	if e.dimension < 1 {
+		return nil, errors.New("hash embedder dimension should be positive")
+	}
+
+	embedding := make([]float64, e.dimension)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return unicode.IsLetter(r) == false && unicode.IsNumber(r) == false
+	})
+
+	for _, word := range words {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		sum := h.Sum64()
+		// low bits pick the bucket, high bit the sign
+		// (limits bias introduced by collisions)
+		sign := 1.0
+		if sum>>63 == 1 {
+			sign = -1.0
+		}
+		embedding[sum%uint64(e.dimension)] += sign
+	}
+
+	// normalized, so distances don't depend on text length
+	norm := 0.0
+	for _, v := range embedding {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range embedding {
+			embedding[i] /= norm
+		}
+	}
+
+	return embedding, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHashEmbedder(t *testing.T) {
+	ctx := context.Background()
+	embedder := NewHashEmbedder(64)
+
+	if model := embedder.Model(); model != "hash-64" {
+		t.Errorf("model: %s, want hash-64", model)
+	}
+
+	embed := func(text string) []float64 {
+		t.Helper()
+		embedding, err := embedder.Embed(ctx, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(embedding) != 64 {
+			t.Fatalf("%q: dimension %d, want 64", text, len(embedding))
+		}
+		return embedding
+	}
+
+	// deterministic, ignoring case & punctuation
+	sword := embed("Bob sells swords!")
+	if reflect.DeepEqual(sword, embed("bob sells SWORDS")) == false {
+		t.Error("same words should have the same embedding")
+	}
+
+	// normalized
+	norm := 0.0
+	for _, v := range sword {
+		norm += v * v
+	}
+	if math.Abs(norm-1) > 1e-9 {
+		t.Errorf("norm: %f, want 1", norm)
+	}
+
+	// shared words make closer vectors
+	// (embeddings are normalized, dot product is cosine similarity)
+	dot := func(a, b []float64) float64 {
+		d := 0.0
+		for i := range a {
+			d += a[i] * b[i]
+		}
+		return d
+	}
+	if dot(sword, embed("bob sells apples")) <= dot(sword, embed("the tournament is tomorrow")) {
+		t.Error("texts sharing words should be closer")
+	}
+
+	// no words, no direction
+	for _, v := range embed("...") {
+		if v != 0 {
+			t.Fatal("embedding without words should be zero")
+		}
+	}
+
+	_, err := NewHashEmbedder(0).Embed(ctx, "bob")
+	if err == nil {
+		t.Error("expected error with dimension 0")
+	}
+}
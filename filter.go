@@ -0,0 +1,749 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter expressions, a text syntax for Where & WhereDocument filters:
+//
+//	speaker == "bob" && createdAt > 1700000000 && doc contains "sword"
+//
+// Metadata conditions: <field> <op> <value>, with op one of
+// ==, !=, >, >=, <, <=, in, not in. Values are double quoted strings
+// (Go escapes), numbers, true, false, or lists for in & not in: ["bob", "alice"].
+// Field names that are not simple identifiers (letters, digits, _ . :)
+// or that are keywords can be quoted with backticks: `doc` == 1
+// (backticks in quoted names are doubled: `a``b` is the field a`b)
+//
+// Document conditions: doc contains "text", doc not contains "text"
+//
+// Conditions are combined with && (or "and") and || (or "or"),
+// && having precedence over ||. Parentheses can be used for grouping.
+// Chroma applies metadata & document filters separately, so document
+// and metadata conditions can't be mixed in a || group.
+
+type Filter struct {
+	Where         Where
+	WhereDocument WhereDocument
+}
+
+// Error found in filter expression, with its position.
+// errors.Is(err, ErrInvalidArgument) is true.
+type FilterError struct {
+	Offset int // byte offset in expression
+	Line   int // starting at 1
+	Column int // starting at 1, in runes
+	Msg    string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("filter: %d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+func (e *FilterError) Unwrap() error {
+	return ErrInvalidArgument
+}
+
+const (
+	FILTER_DOCUMENT = "doc" // keyword for document conditions
+)
+
+// Parses filter expression. An empty expression returns an empty filter.
+func ParseFilter(expr string) (*Filter, error) {
+	p := &filterParser{lexer: filterLexer{src: expr}}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == filterEOF {
+		return &Filter{}, nil
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != filterEOF {
+		return nil, p.errorf(p.tok.pos, "unexpected %s", p.tok)
+	}
+
+	return &Filter{Where: node.where, WhereDocument: node.doc}, nil
+}
+
+// Formats filter as text, that can be parsed with ParseFilter
+func (f Filter) String() string {
+	both := f.Where != nil && f.WhereDocument != nil
+	parts := make([]string, 0, 2)
+	if f.Where != nil {
+		parts = append(parts, formatWhere(f.Where, both))
+	}
+	if f.WhereDocument != nil {
+		parts = append(parts, formatWhereDocument(f.WhereDocument, both))
+	}
+	return strings.Join(parts, " && ")
+}
+
+// Formats metadata filter as a filter expression
+func FormatWhere(w Where) string {
+	return formatWhere(w, false)
+}
+
+// Formats document filter as a filter expression
+func FormatWhereDocument(w WhereDocument) string {
+	return formatWhereDocument(w, false)
+}
+
+// inAnd indicates if w is an operand of &&,
+// meaning || groups need parentheses.
+func formatWhere(w Where, inAnd bool) string {
+	switch w := w.(type) {
+	case WhereField:
+		return formatFilterName(w.Name) + " " + formatFilterOperator(w.Operator) + " " + formatFilterValue(w.Value)
+	case WhereAnd:
+		if len(w.Entries) == 1 {
+			return formatWhere(w.Entries[0], inAnd)
+		}
+		parts := make([]string, len(w.Entries))
+		for i, e := range w.Entries {
+			parts[i] = formatWhere(e, true)
+		}
+		return strings.Join(parts, " && ")
+	case WhereOr:
+		if len(w.Entries) == 1 {
+			return formatWhere(w.Entries[0], inAnd)
+		}
+		parts := make([]string, len(w.Entries))
+		for i, e := range w.Entries {
+			parts[i] = formatWhere(e, false)
+		}
+		if inAnd {
+			return "(" + strings.Join(parts, " || ") + ")"
+		}
+		return strings.Join(parts, " || ")
+	}
+	return fmt.Sprintf("%v", w)
+}
+
+func formatWhereDocument(w WhereDocument, inAnd bool) string {
+	switch w := w.(type) {
+	case WhereDocumentField:
+		op := "contains"
+		if w.Operator == DoesNotContain {
+			op = "not contains"
+		}
+		return FILTER_DOCUMENT + " " + op + " " + strconv.Quote(w.Value)
+	case WhereDocumentAnd:
+		if len(w.Entries) == 1 {
+			return formatWhereDocument(w.Entries[0], inAnd)
+		}
+		parts := make([]string, len(w.Entries))
+		for i, e := range w.Entries {
+			parts[i] = formatWhereDocument(e, true)
+		}
+		return strings.Join(parts, " && ")
+	case WhereDocumentOr:
+		if len(w.Entries) == 1 {
+			return formatWhereDocument(w.Entries[0], inAnd)
+		}
+		parts := make([]string, len(w.Entries))
+		for i, e := range w.Entries {
+			parts[i] = formatWhereDocument(e, false)
+		}
+		if inAnd {
+			return "(" + strings.Join(parts, " || ") + ")"
+		}
+		return strings.Join(parts, " || ")
+	}
+	return fmt.Sprintf("%v", w)
+}
+
+func formatFilterName(name string) string {
+	if isFilterKeyword(name) || isFilterIdent(name) == false {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return name
+}
+
+func formatFilterOperator(op Operator) string {
+	switch op {
+	case Equal:
+		return "=="
+	case NotEqual:
+		return "!="
+	case GreaterThan:
+		return ">"
+	case GreaterThanOrEqual:
+		return ">="
+	case LessThan:
+		return "<"
+	case LessThanOrEqual:
+		return "<="
+	case In:
+		return "in"
+	case NotIn:
+		return "not in"
+	}
+	return string(op)
+}
+
+func formatFilterValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case float32:
+		return formatFilterFloat(float64(v))
+	case float64:
+		return formatFilterFloat(v)
+	}
+	if values, ok := whereList(v); ok {
+		parts := make([]string, len(values))
+		for i, value := range values {
+			parts[i] = formatFilterValue(value)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Floats always have a decimal point or an exponent,
+// so they're not parsed back as ints.
+func formatFilterFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if strings.ContainsAny(s, ".eEn") == false { // n: NaN, Inf
+		s += ".0"
+	}
+	return s
+}
+
+func isFilterKeyword(s string) bool {
+	switch s {
+	case FILTER_DOCUMENT, "and", "or", "not", "in", "contains", "true", "false":
+		return true
+	}
+	return false
+}
+
+func isFilterIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if isFilterIdentRune(r, i == 0) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func isFilterIdentRune(r rune, first bool) bool {
+	if r == '_' || unicode.IsLetter(r) {
+		return true
+	}
+	if first {
+		return false
+	}
+	return unicode.IsDigit(r) || r == '.' || r == ':'
+}
+
+// Parser
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterIdent
+	filterQuotedIdent // `name`
+	filterString
+	filterNumber
+	filterSymbol // == != > >= < <= && || ( ) [ ] ,
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string // identifier, symbol, or literal as written
+	pos  int
+}
+
+func (t filterToken) String() string {
+	if t.kind == filterEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (t filterToken) is(kind filterTokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+type filterLexer struct {
+	src string
+	pos int
+}
+
+func (l *filterLexer) next() (filterToken, error) {
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if unicode.IsSpace(r) == false {
+			break
+		}
+		l.pos += size
+	}
+
+	start := l.pos
+	if start >= len(l.src) {
+		return filterToken{kind: filterEOF, pos: start}, nil
+	}
+
+	rest := l.src[start:]
+	r, size := utf8.DecodeRuneInString(rest)
+
+	switch {
+	case r == '"':
+		// finds closing quote, skipping escaped characters
+		i := 1
+		for i < len(rest) && rest[i] != '"' {
+			if rest[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(rest) {
+			return filterToken{}, newFilterError(l.src, start, "unterminated string")
+		}
+		l.pos += i + 1
+		return filterToken{kind: filterString, text: rest[:i+1], pos: start}, nil
+
+	case r == '`':
+		// finds closing backtick, doubled backticks are part of the name
+		i := 1
+		for {
+			end := strings.IndexByte(rest[i:], '`')
+			if end < 0 {
+				return filterToken{}, newFilterError(l.src, start, "unterminated quoted field name")
+			}
+			i += end
+			if i+1 < len(rest) && rest[i+1] == '`' {
+				i += 2
+				continue
+			}
+			break
+		}
+		l.pos += i + 1
+		name := strings.ReplaceAll(rest[1:i], "``", "`")
+		return filterToken{kind: filterQuotedIdent, text: name, pos: start}, nil
+
+	case r == '-' || r == '.' || unicode.IsDigit(r):
+		i := 0
+		if r == '-' {
+			i++
+		}
+		for i < len(rest) {
+			c := rest[i]
+			if (c >= '0' && c <= '9') || c == '.' {
+				i++
+			} else if (c == 'e' || c == 'E') && i+1 < len(rest) {
+				i++
+				if rest[i] == '+' || rest[i] == '-' {
+					i++
+				}
+			} else {
+				break
+			}
+		}
+		l.pos += i
+		return filterToken{kind: filterNumber, text: rest[:i], pos: start}, nil
+
+	case isFilterIdentRune(r, true):
+		i := size
+		for i < len(rest) {
+			r, size := utf8.DecodeRuneInString(rest[i:])
+			if isFilterIdentRune(r, false) == false {
+				break
+			}
+			i += size
+		}
+		l.pos += i
+		return filterToken{kind: filterIdent, text: rest[:i], pos: start}, nil
+	}
+
+	for _, symbol := range []string{"==", "!=", ">=", "<=", "&&", "||", ">", "<", "(", ")", "[", "]", ","} {
+		if strings.HasPrefix(rest, symbol) {
+			l.pos += len(symbol)
+			return filterToken{kind: filterSymbol, text: symbol, pos: start}, nil
+		}
+	}
+
+	if r == '=' {
+		return filterToken{}, newFilterError(l.src, start, `unexpected "=", use "==" for equality`)
+	}
+	return filterToken{}, newFilterError(l.src, start, fmt.Sprintf("unexpected character %q", r))
+}
+
+type filterParser struct {
+	lexer filterLexer
+	tok   filterToken
+}
+
+// Parsed expression: metadata and/or document filters
+// (both only when combined with &&)
+type filterNode struct {
+	pos   int
+	where Where
+	doc   WhereDocument
+}
+
+func (p *filterParser) next() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *filterParser) errorf(pos int, format string, args ...any) error {
+	return newFilterError(p.lexer.src, pos, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) isOr() bool {
+	return p.tok.is(filterSymbol, "||") || p.tok.is(filterIdent, "or")
+}
+
+func (p *filterParser) isAnd() bool {
+	return p.tok.is(filterSymbol, "&&") || p.tok.is(filterIdent, "and")
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return first, err
+	}
+	if p.isOr() == false {
+		return first, nil
+	}
+
+	nodes := []filterNode{first}
+	for p.isOr() {
+		err = p.next()
+		if err != nil {
+			return first, err
+		}
+		node, err := p.parseAnd()
+		if err != nil {
+			return first, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	// all operands must be of the same kind
+	var wheres []Where
+	var docs []WhereDocument
+	for _, node := range nodes {
+		if node.where != nil && node.doc != nil {
+			return first, p.errorf(node.pos, "document and metadata conditions can't be mixed in a || group")
+		}
+		if node.where != nil {
+			wheres = appendWhere(wheres, node.where, false)
+		} else {
+			docs = appendWhereDocument(docs, node.doc, false)
+		}
+		if len(wheres) > 0 && len(docs) > 0 {
+			return first, p.errorf(node.pos, "document and metadata conditions can't be mixed in a || group")
+		}
+	}
+
+	if len(wheres) > 0 {
+		return filterNode{pos: first.pos, where: WhereOr{Entries: wheres}}, nil
+	}
+	return filterNode{pos: first.pos, doc: WhereDocumentOr{Entries: docs}}, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	first, err := p.parsePrimary()
+	if err != nil {
+		return first, err
+	}
+	if p.isAnd() == false {
+		return first, nil
+	}
+
+	nodes := []filterNode{first}
+	for p.isAnd() {
+		err = p.next()
+		if err != nil {
+			return first, err
+		}
+		node, err := p.parsePrimary()
+		if err != nil {
+			return first, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	var wheres []Where
+	var docs []WhereDocument
+	for _, node := range nodes {
+		if node.where != nil {
+			wheres = appendWhere(wheres, node.where, true)
+		}
+		if node.doc != nil {
+			docs = appendWhereDocument(docs, node.doc, true)
+		}
+	}
+
+	result := filterNode{pos: first.pos}
+	if len(wheres) == 1 {
+		result.where = wheres[0]
+	} else if len(wheres) > 1 {
+		result.where = WhereAnd{Entries: wheres}
+	}
+	if len(docs) == 1 {
+		result.doc = docs[0]
+	} else if len(docs) > 1 {
+		result.doc = WhereDocumentAnd{Entries: docs}
+	}
+	return result, nil
+}
+
+// Appends entry to list, flattening groups of the same kind:
+// (a && b) && c -> a && b && c
+func appendWhere(list []Where, entry Where, and bool) []Where {
+	switch group := entry.(type) {
+	case WhereAnd:
+		if and {
+			return append(list, group.Entries...)
+		}
+	case WhereOr:
+		if and == false {
+			return append(list, group.Entries...)
+		}
+	}
+	return append(list, entry)
+}
+
+func appendWhereDocument(list []WhereDocument, entry WhereDocument, and bool) []WhereDocument {
+	switch group := entry.(type) {
+	case WhereDocumentAnd:
+		if and {
+			return append(list, group.Entries...)
+		}
+	case WhereDocumentOr:
+		if and == false {
+			return append(list, group.Entries...)
+		}
+	}
+	return append(list, entry)
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	tok := p.tok
+
+	if tok.is(filterSymbol, "(") {
+		err := p.next()
+		if err != nil {
+			return filterNode{}, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return node, err
+		}
+		if p.tok.is(filterSymbol, ")") == false {
+			return node, p.errorf(p.tok.pos, "expected \")\", found %s", p.tok)
+		}
+		node.pos = tok.pos
+		return node, p.next()
+	}
+
+	if tok.is(filterIdent, FILTER_DOCUMENT) {
+		return p.parseDocumentCondition()
+	}
+
+	if tok.kind != filterQuotedIdent && (tok.kind != filterIdent || isFilterKeyword(tok.text)) {
+		return filterNode{}, p.errorf(tok.pos, "expected field name, %s or \"(\", found %s", FILTER_DOCUMENT, tok)
+	}
+	if tok.text == "" {
+		return filterNode{}, p.errorf(tok.pos, "field name can't be empty")
+	}
+
+	err := p.next()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	opTok := p.tok
+	var op Operator
+	switch {
+	case opTok.is(filterSymbol, "=="):
+		op = Equal
+	case opTok.is(filterSymbol, "!="):
+		op = NotEqual
+	case opTok.is(filterSymbol, ">"):
+		op = GreaterThan
+	case opTok.is(filterSymbol, ">="):
+		op = GreaterThanOrEqual
+	case opTok.is(filterSymbol, "<"):
+		op = LessThan
+	case opTok.is(filterSymbol, "<="):
+		op = LessThanOrEqual
+	case opTok.is(filterIdent, "in"):
+		op = In
+	case opTok.is(filterIdent, "not"):
+		err = p.next()
+		if err != nil {
+			return filterNode{}, err
+		}
+		if p.tok.is(filterIdent, "in") == false {
+			return filterNode{}, p.errorf(p.tok.pos, "expected \"in\" after \"not\", found %s", p.tok)
+		}
+		op = NotIn
+	default:
+		return filterNode{}, p.errorf(opTok.pos, "expected operator (==, !=, >, >=, <, <=, in, not in) after %s, found %s", tok, opTok)
+	}
+
+	err = p.next()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	valueTok := p.tok
+	var value any
+	if op == In || op == NotIn {
+		value, err = p.parseList()
+	} else {
+		value, err = p.parseValue()
+	}
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	field := WhereField{Name: tok.text, Operator: op, Value: value}
+	err = field.validate()
+	if err != nil {
+		// e.g. comparing strings with >
+		return filterNode{}, p.errorf(valueTok.pos, "%s", strings.TrimPrefix(err.Error(), errWhere.Error()+": "))
+	}
+
+	return filterNode{pos: tok.pos, where: field}, nil
+}
+
+// doc contains "..." / doc not contains "..."
+func (p *filterParser) parseDocumentCondition() (filterNode, error) {
+	pos := p.tok.pos
+
+	err := p.next()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	op := Contains
+	if p.tok.is(filterIdent, "not") {
+		op = DoesNotContain
+		err = p.next()
+		if err != nil {
+			return filterNode{}, err
+		}
+	}
+	if p.tok.is(filterIdent, "contains") == false {
+		return filterNode{}, p.errorf(p.tok.pos, "expected \"contains\" or \"not contains\" after %s, found %s", FILTER_DOCUMENT, p.tok)
+	}
+
+	err = p.next()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	if p.tok.kind != filterString {
+		return filterNode{}, p.errorf(p.tok.pos, "expected string, found %s", p.tok)
+	}
+	valuePos := p.tok.pos
+	value, err := p.parseValue()
+	if err != nil {
+		return filterNode{}, err
+	}
+	if value == "" {
+		return filterNode{}, p.errorf(valuePos, "%s value can't be empty", op)
+	}
+
+	return filterNode{pos: pos, doc: WhereDocumentField{Operator: op, Value: value.(string)}}, nil
+}
+
+// string, number or boolean
+func (p *filterParser) parseValue() (any, error) {
+	tok := p.tok
+
+	var value any
+	switch {
+	case tok.kind == filterString:
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok.pos, "invalid string: %s", tok.text)
+		}
+		value = s
+	case tok.kind == filterNumber:
+		if i, err := strconv.Atoi(tok.text); err == nil {
+			value = i
+		} else if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			value = f
+		} else {
+			return nil, p.errorf(tok.pos, "invalid number: %s", tok.text)
+		}
+	case tok.is(filterIdent, "true"):
+		value = true
+	case tok.is(filterIdent, "false"):
+		value = false
+	default:
+		return nil, p.errorf(tok.pos, "expected value (string, number, true or false), found %s", tok)
+	}
+
+	return value, p.next()
+}
+
+// [value, value, ...]
+func (p *filterParser) parseList() (any, error) {
+	if p.tok.is(filterSymbol, "[") == false {
+		return nil, p.errorf(p.tok.pos, "expected list (e.g. [\"a\", \"b\"]), found %s", p.tok)
+	}
+
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]any, 0)
+	for p.tok.is(filterSymbol, "]") == false {
+		if len(values) > 0 {
+			if p.tok.is(filterSymbol, ",") == false {
+				return nil, p.errorf(p.tok.pos, "expected \",\" or \"]\", found %s", p.tok)
+			}
+			err = p.next()
+			if err != nil {
+				return nil, err
+			}
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, p.next()
+}
+
+func newFilterError(src string, offset int, msg string) *FilterError {
+	before := src[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return &FilterError{
+		Offset: offset,
+		Line:   line,
+		Column: column,
+		Msg:    msg,
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilterRoundTrip(t *testing.T) {
+	tests := []string{
+		``,
+		`sender == "bob"`,
+		`sender != "bob"`,
+		`importance > 3`,
+		`importance >= 3 && importance <= 7`,
+		`gameTime < 12.5`,
+		`sender in ["bob", "alice"]`,
+		`importance not in [1, 2.5]`,
+		`done == true || done == false`,
+		`sender == "bob" && (location == "forge" || location == "tavern")`,
+		`(sender == "bob" || sender == "alice") && importance > 5`,
+		`doc contains "sword"`,
+		`doc not contains "sword" && doc contains "shield"`,
+		`doc contains "sword" || doc contains "shield"`,
+		`sender == "bob" && doc contains "sword"`,
+		`sender == "bob" && (doc contains "sword" || doc contains "shield")`,
+		"`doc` == 1",
+		"`my key` == \"a \\\"quoted\\\" value\"",
+		"`back``tick` == 1 && ```` in [\"`\"]",
+		`hnsw:space == "cosine"`,
+	}
+
+	for _, expr := range tests {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", expr, err)
+			continue
+		}
+		str := f.String()
+		if str != expr {
+			t.Errorf("ParseFilter(%q).String() = %q", expr, str)
+		}
+		again, err := ParseFilter(str)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", str, err)
+			continue
+		}
+		if reflect.DeepEqual(f, again) == false {
+			t.Errorf("ParseFilter(%q) = %#v, parsed again: %#v", expr, f, again)
+		}
+	}
+}
+
+func TestParseFilterPrecedence(t *testing.T) {
+	a := WhereField{Name: "a", Operator: Equal, Value: 1}
+	b := WhereField{Name: "b", Operator: Equal, Value: 2}
+	c := WhereField{Name: "c", Operator: Equal, Value: 3}
+
+	tests := []struct {
+		expr  string
+		where Where
+	}{
+		{`a == 1 || b == 2 && c == 3`, WhereOr{Entries: []Where{a, WhereAnd{Entries: []Where{b, c}}}}},
+		{`a == 1 && b == 2 || c == 3`, WhereOr{Entries: []Where{WhereAnd{Entries: []Where{a, b}}, c}}},
+		{`a == 1 and b == 2 or c == 3`, WhereOr{Entries: []Where{WhereAnd{Entries: []Where{a, b}}, c}}},
+		{`(a == 1 || b == 2) && c == 3`, WhereAnd{Entries: []Where{WhereOr{Entries: []Where{a, b}}, c}}},
+		{`a == 1 && (b == 2 || c == 3)`, WhereAnd{Entries: []Where{a, WhereOr{Entries: []Where{b, c}}}}},
+		{`((a == 1))`, a},
+		// groups of the same kind are flattened
+		{`(a == 1 && b == 2) && c == 3`, WhereAnd{Entries: []Where{a, b, c}}},
+		{`a == 1 || (b == 2 || c == 3)`, WhereOr{Entries: []Where{a, b, c}}},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		if reflect.DeepEqual(f.Where, test.where) == false {
+			t.Errorf("ParseFilter(%q).Where = %#v, want %#v", test.expr, f.Where, test.where)
+		}
+		if f.WhereDocument != nil {
+			t.Errorf("ParseFilter(%q).WhereDocument = %#v, want nil", test.expr, f.WhereDocument)
+		}
+	}
+}
+
+func TestParseFilterQuotedNames(t *testing.T) {
+	tests := []struct {
+		expr string
+		name string
+	}{
+		{"`doc` == 1", "doc"},
+		{"`my key` == 1", "my key"},
+		{"`back``tick` == 1", "back`tick"},
+		{"```` == 1", "`"},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		field, ok := f.Where.(WhereField)
+		if ok == false || field.Name != test.name {
+			t.Errorf("ParseFilter(%q).Where = %#v, want field %q", test.expr, f.Where, test.name)
+		}
+	}
+}
+
+func TestParseFilterLiterals(t *testing.T) {
+	tests := []struct {
+		expr  string
+		value any
+	}{
+		{`n == 3`, 3},
+		{`n == -3`, -3},
+		{`n == 3.0`, 3.0},
+		{`n == 3.5`, 3.5},
+		{`n == 1e3`, 1000.0},
+		{`n == "3"`, "3"},
+		{`n == true`, true},
+		{`n in [1, 2.5, "x"]`, []any{1, 2.5, "x"}},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		field, ok := f.Where.(WhereField)
+		if ok == false {
+			t.Errorf("ParseFilter(%q).Where = %#v, want WhereField", test.expr, f.Where)
+			continue
+		}
+		if reflect.DeepEqual(field.Value, test.value) == false {
+			t.Errorf("ParseFilter(%q) value = %#v (%T), want %#v (%T)", test.expr, field.Value, field.Value, test.value, test.value)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		line   int
+		column int
+	}{
+		{`sender ==`, 1, 10},
+		{`sender = "bob"`, 1, 8},
+		{`sender == "bob" &&`, 1, 19},
+		{`(sender == "bob"`, 1, 17},
+		{`sender == "bob")`, 1, 16},
+		{`sender == bob`, 1, 11},
+		{`sender in "bob"`, 1, 11},
+		{`sender in ["bob" "alice"]`, 1, 18},
+		{"sender == \"bob\" &&\n  location ==", 2, 14},
+		{"é == 1 &&\n\tdoc ~ \"x\"", 2, 6},
+		// document and metadata conditions can't be mixed in a || group
+		{`sender == "bob" || doc contains "sword"`, 1, 20},
+		{`doc contains "sword" || sender == "bob"`, 1, 25},
+		{`a == 1 && (b == 2 || doc contains "x")`, 1, 22},
+		{`(a == 1 && doc contains "x") || b == 2`, 1, 1},
+		{"a == 1 && `b``", 1, 11},
+		{"`a`` == 1", 1, 1},
+	}
+
+	for _, test := range tests {
+		_, err := ParseFilter(test.expr)
+		if err == nil {
+			t.Errorf("ParseFilter(%q): expected error", test.expr)
+			continue
+		}
+		if errors.Is(err, ErrInvalidArgument) == false {
+			t.Errorf("ParseFilter(%q): error %v is not ErrInvalidArgument", test.expr, err)
+		}
+		var filterErr *FilterError
+		if errors.As(err, &filterErr) == false {
+			t.Errorf("ParseFilter(%q): error %v is not a FilterError", test.expr, err)
+			continue
+		}
+		if filterErr.Line != test.line || filterErr.Column != test.column {
+			t.Errorf("ParseFilter(%q): error at %d:%d (%s), want %d:%d", test.expr, filterErr.Line, filterErr.Column, filterErr.Msg, test.line, test.column)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	ollama "github.com/ollama/ollama/api"
+	"net/http"
+	"net/url"
+)
+
+const (
+	LLM_BACKEND_OLLAMA = "ollama"
+	LLM_BACKEND_OPENAI = "openai" // OpenAI compatible API (llama.cpp server, vLLM, LM Studio...)
+)
+
+var (
+	// available text generation backends, indexed by name
+	llmBackends map[string]TextGenerator
+
+	errUnknownBackend = errors.New("unknown LLM backend")
+)
+
+type GenerateRequest struct {
+	Model  string // backend's default model is used when empty
+	System string
+	Prompt string
+	Format string // "json" forces the model to reply with valid JSON
+	Stream bool
+	// context window, in tokens (backend's default when 0)
+	ContextSize int
+}
+
+// Text generation backend.
+// Responses are ollama.GenerateResponse values, whatever the backend,
+// so API handlers can forward them without knowing where they come from.
+type TextGenerator interface {
+	// Calls fn for each generated chunk when streaming,
+	// only once with the complete response otherwise.
+	Generate(ctx context.Context, req GenerateRequest, fn func(ollama.GenerateResponse) error) error
+	DefaultModel() string
+}
+
+// Returns backend and model to be used by given agent
+func agentGenerator(agent *Agent) (TextGenerator, string, error) {
+	backend := agent.Backend
+	if backend == "" {
+		backend = config.LLM.Backend
+	}
+
+	generator, exists := llmBackends[backend]
+	if exists == false {
+		return nil, "", errors.New(errUnknownBackend.Error() + ": " + backend)
+	}
+
+	model := agent.Model
+	if model == "" {
+		model = generator.DefaultModel()
+	}
+
+	return generator, model, nil
+}
+
+// Returns an error if given backend name is not supported.
+// Empty name is valid, it means default backend.
+func checkBackend(backend string) error {
+	if backend == "" {
+		return nil
+	}
+	if _, exists := llmBackends[backend]; exists == false {
+		return errors.New(errUnknownBackend.Error() + ": " + backend)
+	}
+	return nil
+}
+
+// Creates Ollama client, using config.Ollama.Host when defined,
+// OLLAMA_HOST env var otherwise.
+func newOllamaClient() (*ollama.Client, error) {
+	if config.Ollama.Host == "" {
+		return ollama.ClientFromEnvironment()
+	}
+	base, err := url.Parse(config.Ollama.Host)
+	if err != nil {
+		return nil, err
+	}
+	return ollama.NewClient(base, http.DefaultClient), nil
+}
+
+type OllamaGenerator struct {
+	client *ollama.Client
+	model  string
+}
+
+func NewOllamaGenerator(client *ollama.Client, model string) *OllamaGenerator {
+	return &OllamaGenerator{
+		client: client,
+		model:  model,
+	}
+}
+
+func (g *OllamaGenerator) DefaultModel() string {
+	return g.model
+}
+
+func (g *OllamaGenerator) Generate(ctx context.Context, req GenerateRequest, fn func(ollama.GenerateResponse) error) error {
+	model := req.Model
+	if model == "" {
+		model = g.model
+	}
+
+	stream := req.Stream
+
+	// Ollama silently truncates prompts exceeding num_ctx
+	// (2048 tokens by default, whatever the model supports)
+	var options map[string]interface{}
+	if req.ContextSize > 0 {
+		options = map[string]interface{}{"num_ctx": req.ContextSize}
+	}
+
+	return g.client.Generate(ctx, &ollama.GenerateRequest{
+		Model:   model,
+		System:  req.System,
+		Prompt:  req.Prompt,
+		Format:  req.Format,
+		Stream:  &stream,
+		Options: options,
+	}, fn)
+}
@@ -1,13 +1,27 @@
 package main
 
-const (
-	CHROMA_DB_HOST_ADDR = "http://localhost:9999"
-	CHROMA_DB_TENANT    = "npcs"
-	CHROMA_DB_DATABASE  = "npcs"
-	DEBUG               = true
+import (
+	"fmt"
+	"os"
 )
 
 func main() {
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println("❌", err.Error())
+		os.Exit(1)
+	}
+
 	// serveChatCLI()
-	serveAPI(":7777")
+	serveAPI(config.Port)
+
+	// in-memory store writes changes in the background
+	if memoryStore != nil {
+		err = memoryStore.Close()
+		if err != nil {
+			fmt.Println("❌ can't save memories:", err.Error())
+			os.Exit(1)
+		}
+	}
 }
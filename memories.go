@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Metadata keys of agent memories.
+// Empty values are not stored (Chroma doesn't accept null metadata).
+const (
+	MEMORY_CREATED_AT      = "createdAt"      // wall clock, unix seconds (microsecond precision)
+	MEMORY_GAME_TIME       = "gameTime"       // game clock, in seconds (when provided by the game)
+	MEMORY_SENDER          = "sender"         // who the agent was talking to
+	MEMORY_AGENT           = "agent"          // agent ID
+	MEMORY_CONVERSATION_ID = "conversationId" // provided by the game
+	MEMORY_LOCATION        = "location"       // provided by the game
+	MEMORY_KIND            = "kind"
+	MEMORY_IMPORTANCE      = "importance" // 1 to 10, rated by the agent's model
+	// IDs of the memories a reflection or summary comes from, comma separated
+	// (Chroma metadata values can't be lists)
+	MEMORY_SOURCES = "sources"
+	// creation time (unix seconds) and ID of the last memory considered by
+	// a reflection, next reflection starts after it (see memoriesSinceLastReflection)
+	MEMORY_REFLECTED_UNTIL    = "reflectedUntil"
+	MEMORY_REFLECTED_UNTIL_ID = "reflectedUntilId"
+
+	// Memory kinds
+	MEMORY_KIND_CONVERSATION = "conversation" // exchange with another entity
+	MEMORY_KIND_REFLECTION   = "reflection"   // insight derived from other memories
+	MEMORY_KIND_SUMMARY      = "summary"      // replaces consolidated memories
+)
+
+// Agent memory, as stored in its collection
+type Memory struct {
+	ID             string    `json:"id"`
+	Document       string    `json:"document"`
+	CreatedAt      time.Time `json:"created-at"` // zero when unknown, see MarshalJSON
+	GameTime       *float64  `json:"game-time,omitempty"`
+	Sender         string    `json:"sender,omitempty"`
+	AgentID        string    `json:"agent,omitempty"`
+	ConversationID string    `json:"conversation-id,omitempty"`
+	Location       string    `json:"location,omitempty"`
+	Kind           string    `json:"kind,omitempty"`
+	Importance     int       `json:"importance,omitempty"` // 0 when not rated
+	Sources        []string  `json:"sources,omitempty"`    // memory IDs, for reflections & summaries
+	// set when memory is recalled with a query
+	Distance float64 `json:"distance,omitempty"`
+	// retrieval score (see rankMemories)
+	Score float64 `json:"score,omitempty"`
+	// metadata not listed above
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// Leaves out unknown creation times (memories stored before they were
+// recorded), omitempty has no effect on time.Time.
+func (m Memory) MarshalJSON() ([]byte, error) {
+	type memory Memory // without MarshalJSON
+	var createdAt *time.Time
+	if m.CreatedAt.IsZero() == false {
+		createdAt = &m.CreatedAt
+	}
+	return json.Marshal(struct {
+		memory
+		CreatedAt *time.Time `json:"created-at,omitempty"`
+	}{memory(m), createdAt})
+}
+
+// Returns a unique memory ID: creation time (hex nanoseconds, so
+// IDs sort by time) followed by random bytes.
+func newMemoryID(createdAt time.Time) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%016x", createdAt.UnixNano()) + hex.EncodeToString(b)
+}
+
+// Returns time in unix seconds, with microsecond precision
+// (memories stored in the same second can be told apart)
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+func timeFromUnixSeconds(seconds float64) time.Time {
+	return time.UnixMicro(int64(math.Round(seconds * 1e6)))
+}
+
+// Returns metadata to store with memory
+func (m Memory) metadata() map[string]any {
+	metadata := make(map[string]any)
+	for k, v := range m.Metadata {
+		metadata[k] = v
+	}
+	if m.CreatedAt.IsZero() == false {
+		metadata[MEMORY_CREATED_AT] = unixSeconds(m.CreatedAt)
+	}
+	if m.GameTime != nil {
+		metadata[MEMORY_GAME_TIME] = *m.GameTime
+	}
+	if m.Importance > 0 {
+		metadata[MEMORY_IMPORTANCE] = m.Importance
+	}
+	if len(m.Sources) > 0 {
+		metadata[MEMORY_SOURCES] = strings.Join(m.Sources, ",")
+	}
+	for key, value := range map[string]string{
+		MEMORY_SENDER:          m.Sender,
+		MEMORY_AGENT:           m.AgentID,
+		MEMORY_CONVERSATION_ID: m.ConversationID,
+		MEMORY_LOCATION:        m.Location,
+		MEMORY_KIND:            m.Kind,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// Builds memory from collection entry.
+// Memories stored before metadata was introduced only have a document.
+func memoryFromEntry(entry ChromaCollectionEntry) Memory {
+	m := Memory{
+		ID:       entry.ID,
+		Document: entry.Document,
+		Distance: entry.Distance,
+	}
+
+	strs := map[string]*string{
+		MEMORY_SENDER:          &m.Sender,
+		MEMORY_AGENT:           &m.AgentID,
+		MEMORY_CONVERSATION_ID: &m.ConversationID,
+		MEMORY_LOCATION:        &m.Location,
+		MEMORY_KIND:            &m.Kind,
+	}
+
+	for key, value := range entry.Metadatas {
+		if str, exists := strs[key]; exists {
+			*str, _ = value.(string)
+			continue
+		}
+		switch key {
+		case MEMORY_CREATED_AT:
+			if f, ok := whereFloat(value); ok {
+				m.CreatedAt = timeFromUnixSeconds(f)
+			}
+		case MEMORY_GAME_TIME:
+			if f, ok := whereFloat(value); ok {
+				m.GameTime = &f
+			}
+		case MEMORY_IMPORTANCE:
+			if f, ok := whereFloat(value); ok {
+				m.Importance = int(f)
+			}
+		case MEMORY_SOURCES:
+			if s, ok := value.(string); ok && s != "" {
+				m.Sources = strings.Split(s, ",")
+			}
+		default:
+			if m.Metadata == nil {
+				m.Metadata = make(map[string]any)
+			}
+			m.Metadata[key] = value
+		}
+	}
+
+	return m
+}
+
+func memoriesFromEntries(entries []ChromaCollectionEntry) []Memory {
+	memories := make([]Memory, len(entries))
+	for i, entry := range entries {
+		memories[i] = memoryFromEntry(entry)
+	}
+	return memories
+}
+
+// Line describing memory in prompts, e.g.
+// "- (yesterday, at the tavern) Bob said: ..."
+// "- (insight, 2 hours ago) Bob seems to distrust the mayor"
+// now & gameTime describe current time, game time being used for
+// relative times when both the request and the memory have one.
+func (m Memory) promptLine(now time.Time, gameTime *float64) string {
+	details := make([]string, 0, 3)
+
+	if m.Kind == MEMORY_KIND_REFLECTION {
+		details = append(details, "insight")
+	}
+	if age, known := m.age(now, gameTime); known {
+		details = append(details, relativeTime(age))
+	}
+
+	if m.Location != "" {
+		details = append(details, "at "+m.Location)
+	}
+
+	line := "- "
+	if len(details) > 0 {
+		line += "(" + strings.Join(details, ", ") + ") "
+	}
+	return line + m.Document + "\n"
+}
+
+// Returns time elapsed since memory was created, using game time
+// when both the memory and the current request have one.
+// known is false for memories with no time.
+func (m Memory) age(now time.Time, gameTime *float64) (age time.Duration, known bool) {
+	if m.GameTime != nil && gameTime != nil {
+		return time.Duration((*gameTime - *m.GameTime) * float64(time.Second)), true
+	}
+	if m.CreatedAt.IsZero() == false {
+		return now.Sub(m.CreatedAt), true
+	}
+	return 0, false
+}
+
+func (m Memory) importanceOrDefault() int {
+	if m.Importance > 0 {
+		return m.Importance
+	}
+	return DEFAULT_IMPORTANCE
+}
+
+// Describes how long ago something happened: "just now", "5 minutes ago",
+// "yesterday"... Negative durations (clock changes) are considered as "just now".
+func relativeTime(d time.Duration) string {
+	plural := func(n float64, unit string) string {
+		i := int(math.Floor(n))
+		if i <= 1 {
+			return "a " + unit + " ago"
+		}
+		return fmt.Sprintf("%d %ss ago", i, unit)
+	}
+
+	const day = 24 * time.Hour
+
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(d.Minutes(), "minute")
+	case d < day:
+		if d < 2*time.Hour {
+			return "an hour ago"
+		}
+		return plural(d.Hours(), "hour")
+	case d < 2*day:
+		return "yesterday"
+	case d < 7*day:
+		return plural(d.Hours()/24, "day")
+	case d < 30*day:
+		return plural(d.Hours()/24/7, "week")
+	case d < 365*day:
+		return plural(d.Hours()/24/30, "month")
+	}
+	return plural(d.Hours()/24/365, "year")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryMetadataRoundTrip(t *testing.T) {
+	gameTime := 3600.5
+	m := Memory{
+		ID:             "m1",
+		Document:       "Alice said: hello",
+		CreatedAt:      time.Unix(1700000000, 0),
+		GameTime:       &gameTime,
+		Sender:         "Alice",
+		AgentID:        "bob",
+		ConversationID: "c1",
+		Location:       "tavern",
+		Kind:           MEMORY_KIND_CONVERSATION,
+		Metadata:       map[string]any{"mood": "happy"},
+	}
+
+	// stored metadata goes through JSON, numbers come back as float64
+	data, err := json.Marshal(m.metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata map[string]any
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := memoryFromEntry(ChromaCollectionEntry{ID: m.ID, Document: m.Document, Metadatas: metadata})
+	if got.CreatedAt.Equal(m.CreatedAt) == false {
+		t.Errorf("got created at %v, want %v", got.CreatedAt, m.CreatedAt)
+	}
+	got.CreatedAt = m.CreatedAt
+	if reflect.DeepEqual(got, m) == false {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+}
+
+func TestMemoryMetadataEmptyValues(t *testing.T) {
+	// Chroma doesn't accept null metadata, empty values are left out
+	metadata := Memory{ID: "m1", Document: "hello", Sender: "Alice"}.metadata()
+	want := map[string]any{MEMORY_SENDER: "Alice"}
+	if reflect.DeepEqual(metadata, want) == false {
+		t.Errorf("got %v, want %v", metadata, want)
+	}
+
+	// memories stored before metadata was introduced
+	got := memoryFromEntry(ChromaCollectionEntry{ID: "m1", Document: "hello", Distance: 0.5})
+	wantMemory := Memory{ID: "m1", Document: "hello", Distance: 0.5}
+	if reflect.DeepEqual(got, wantMemory) == false {
+		t.Errorf("got %+v, want %+v", got, wantMemory)
+	}
+}
+
+func TestMemoryJSON(t *testing.T) {
+	tests := []struct {
+		memory Memory
+		json   string
+	}{
+		// stored before creation times were recorded
+		{Memory{ID: "m1", Document: "hello"}, `{"id":"m1","document":"hello"}`},
+		{
+			Memory{ID: "m2", Document: "hello", CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Importance: 3},
+			`{"id":"m2","document":"hello","importance":3,"created-at":"2024-05-01T12:00:00Z"}`,
+		},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.memory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.json {
+			t.Errorf("got %s, want %s", data, test.json)
+		}
+		// also when listed
+		data, err = json.Marshal([]Memory{test.memory})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "["+test.json+"]" {
+			t.Errorf("got %s, want [%s]", data, test.json)
+		}
+	}
+}
+
+func TestMemoryPromptLine(t *testing.T) {
+	now := time.Now()
+	gameTime := 100000.0
+	memoryGameTime := gameTime - 3*3600
+
+	tests := []struct {
+		name     string
+		memory   Memory
+		gameTime *float64
+		want     string
+	}{
+		{"no time", Memory{Document: "hello"}, nil, "- hello\n"},
+		{"wall clock", Memory{Document: "hello", CreatedAt: now.Add(-10 * time.Minute)}, nil, "- (10 minutes ago) hello\n"},
+		{"game time", Memory{Document: "hello", CreatedAt: now, GameTime: &memoryGameTime}, &gameTime, "- (3 hours ago) hello\n"},
+		{"game time unknown", Memory{Document: "hello", CreatedAt: now, GameTime: &memoryGameTime}, nil, "- (just now) hello\n"},
+		{"location", Memory{Document: "hello", CreatedAt: now.Add(-30 * time.Hour), Location: "the tavern"}, nil, "- (yesterday, at the tavern) hello\n"},
+	}
+
+	for _, test := range tests {
+		got := test.memory.promptLine(now, test.gameTime)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Hour, "just now"},
+		{30 * time.Second, "just now"},
+		{time.Minute, "a minute ago"},
+		{5 * time.Minute, "5 minutes ago"},
+		{90 * time.Minute, "an hour ago"},
+		{5 * time.Hour, "5 hours ago"},
+		{36 * time.Hour, "yesterday"},
+		{3 * day, "3 days ago"},
+		{10 * day, "a week ago"},
+		{60 * day, "2 months ago"},
+		{400 * day, "a year ago"},
+		{800 * day, "2 years ago"},
+	}
+
+	for _, test := range tests {
+		got := relativeTime(test.d)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.d, got, test.want)
+		}
+	}
+}
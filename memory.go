@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	MEMORY_STORE_CHROMA   = "chroma"
+	MEMORY_STORE_INMEMORY = "memory" // pure Go, optionally persisted to a file
+)
+
+// Where agents store their memories.
+// Implemented by ChromaClient (through chromaStore) and InMemoryStore.
+type MemoryStore interface {
+	// Gets collection, creating it if not found
+	// (using config.Memory.Distance as distance function)
+	GetCollection(ctx context.Context, name string) (MemoryCollection, error)
+	ListCollections(ctx context.Context) ([]MemoryCollection, error)
+	RemoveCollection(ctx context.Context, name string) error
+	// Writes pending changes, store shouldn't be used after that
+	Close() error
+}
+
+type MemoryCollection interface {
+	GetName() string
+	GetMetadata() map[string]any
+	// Replaces collection metadata
+	SetMetadata(ctx context.Context, metadata map[string]any) error
+	Add(ctx context.Context, entries []ChromaCollectionEntry) error
+	Upsert(ctx context.Context, entries []ChromaCollectionEntry) error
+	Update(ctx context.Context, entries []ChromaCollectionEntry) error
+	Get(ctx context.Context, get ChromaCollectionGet) ([]ChromaCollectionEntry, error)
+	Peek(ctx context.Context, limit int) ([]ChromaCollectionEntry, error)
+	Delete(ctx context.Context, del ChromaCollectionDelete) ([]string, error)
+	Count(ctx context.Context) (int, error)
+	Query(ctx context.Context, query ChromaCollectionQuery) ([]ChromaCollectionEntry, error)
+}
+
+func NewMemoryStore(kind string) (MemoryStore, error) {
+	switch kind {
+	case MEMORY_STORE_CHROMA:
+		client, err := newChromaClient()
+		if err != nil {
+			return nil, err
+		}
+		return chromaStore{client}, nil
+	case MEMORY_STORE_INMEMORY:
+		return NewInMemoryStore(config.Memory.File)
+	}
+	return nil, errors.New("unknown memory store: " + kind)
+}
+
+// Chroma client configured with timeout, retries & auth from config
+func newChromaClient() (*ChromaClient, error) {
+	options := ChromaClientOptions{
+		Timeout:      config.Chroma.Timeout,
+		MaxRetries:   config.Chroma.MaxRetries,
+		RetryBackoff: config.Chroma.RetryBackoff,
+		APIVersion:   config.Chroma.APIVersion,
+	}
+	if config.Chroma.Token != "" {
+		options.Auth = ChromaTokenAuth{Token: config.Chroma.Token, Header: config.Chroma.AuthHeader}
+	} else if config.Chroma.Username != "" {
+		options.Auth = ChromaBasicAuth{Username: config.Chroma.Username, Password: config.Chroma.Password}
+	}
+	return NewChromaClientWithOptions(config.Chroma.Host, config.Chroma.Tenant, config.Chroma.Database, options)
+}
+
+// Adapts ChromaClient to the MemoryStore interface
+type chromaStore struct {
+	*ChromaClient
+}
+
+func (s chromaStore) GetCollection(ctx context.Context, name string) (MemoryCollection, error) {
+	collection, err := s.ChromaClient.GetCollectionWithMetadataContext(ctx, name, map[string]any{
+		HNSW_SPACE_KEY: config.Memory.Distance,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chromaCollection{collection}, nil
+}
+
+func (s chromaStore) ListCollections(ctx context.Context) ([]MemoryCollection, error) {
+	collections, err := s.ChromaClient.ListCollectionsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]MemoryCollection, len(collections))
+	for i, collection := range collections {
+		list[i] = chromaCollection{collection}
+	}
+	return list, nil
+}
+
+func (s chromaStore) RemoveCollection(ctx context.Context, name string) error {
+	return s.ChromaClient.RemoveCollectionContext(ctx, name)
+}
+
+// Nothing to write, Chroma stores changes when requests are made
+func (s chromaStore) Close() error {
+	return nil
+}
+
+// Adapts ChromaCollection to the MemoryCollection interface
+type chromaCollection struct {
+	*ChromaCollection
+}
+
+func (c chromaCollection) GetName() string {
+	return c.Name
+}
+
+func (c chromaCollection) GetMetadata() map[string]any {
+	return c.Metadata
+}
+
+func (c chromaCollection) SetMetadata(ctx context.Context, metadata map[string]any) error {
+	return c.SetMetadataContext(ctx, metadata)
+}
+
+func (c chromaCollection) Add(ctx context.Context, entries []ChromaCollectionEntry) error {
+	return c.AddContext(ctx, entries)
+}
+
+func (c chromaCollection) Upsert(ctx context.Context, entries []ChromaCollectionEntry) error {
+	return c.UpsertContext(ctx, entries)
+}
+
+func (c chromaCollection) Update(ctx context.Context, entries []ChromaCollectionEntry) error {
+	return c.UpdateContext(ctx, entries)
+}
+
+func (c chromaCollection) Get(ctx context.Context, get ChromaCollectionGet) ([]ChromaCollectionEntry, error) {
+	return c.GetContext(ctx, get)
+}
+
+func (c chromaCollection) Peek(ctx context.Context, limit int) ([]ChromaCollectionEntry, error) {
+	return c.PeekContext(ctx, limit)
+}
+
+func (c chromaCollection) Delete(ctx context.Context, del ChromaCollectionDelete) ([]string, error) {
+	return c.DeleteContext(ctx, del)
+}
+
+func (c chromaCollection) Count(ctx context.Context) (int, error) {
+	return c.CountContext(ctx)
+}
+
+func (c chromaCollection) Query(ctx context.Context, query ChromaCollectionQuery) ([]ChromaCollectionEntry, error) {
+	return c.QueryContext(ctx, query)
+}
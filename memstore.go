@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// In-process memory store, with brute force distance search
+// (same distance functions as Chroma: l2, cosine & ip).
+// Good enough for small games and CI, no Chroma server needed.
+// Collections are written to a JSON file in the background after changes
+// when a path is provided (see save).
+type InMemoryStore struct {
+	path        string // no persistence if empty
+	mutex       sync.RWMutex
+	collections map[string]*InMemoryCollection
+	version     uint64 // incremented with each change
+
+	// pending write (1 slot), changes made
+	// while writing are written next
+	pendingWrite chan struct{}
+	writeDone    chan struct{} // closed when writeLoop returns
+	closed       bool          // changes aren't written after Close
+	writeMutex   sync.Mutex    // one write at a time, protects written
+	// collections as written last time, indexed by name
+	// (collections that didn't change are not encoded again)
+	written map[string]inMemoryCollectionWritten
+}
+
+type InMemoryCollection struct {
+	store    *InMemoryStore
+	name     string
+	metadata map[string]any
+	entries  []ChromaCollectionEntry // entries keep their embedding
+	version  uint64                  // store's version when last changed
+}
+
+type inMemoryCollectionWritten struct {
+	version uint64
+	data    json.RawMessage // inMemoryCollectionFile
+}
+
+// serialized version of InMemoryStore
+type inMemoryStoreFile struct {
+	Collections map[string]inMemoryCollectionFile `json:"collections"`
+}
+
+type inMemoryCollectionFile struct {
+	Metadata map[string]any          `json:"metadata,omitempty"`
+	Entries  []ChromaCollectionEntry `json:"entries"`
+}
+
+func NewInMemoryStore(path string) (*InMemoryStore, error) {
+	s := &InMemoryStore{
+		path:         path,
+		collections:  make(map[string]*InMemoryCollection),
+		pendingWrite: make(chan struct{}, 1),
+		writeDone:    make(chan struct{}),
+		written:      make(map[string]inMemoryCollectionWritten),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// started once loaded, so it doesn't leak when loading fails
+	go s.writeLoop()
+
+	return s, nil
+}
+
+// Loads collections from file, if it exists
+func (s *InMemoryStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var f inMemoryStoreFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return errors.New("can't parse " + s.path + ": " + err.Error())
+	}
+
+	for name, c := range f.Collections {
+		// entries are added with embeddings, a file without them
+		// has been edited and can't be searched
+		for _, entry := range c.Entries {
+			if entry.Embedding == nil || len(*entry.Embedding) == 0 {
+				return errors.New("can't parse " + s.path + ": entry without embedding: " + name + "/" + entry.ID)
+			}
+		}
+		// collections written before distance functions were supported
+		// don't have one, they were always searched with cosine distance
+		metadata := c.Metadata
+		if _, exists := metadata[HNSW_SPACE_KEY]; exists == false {
+			if metadata == nil {
+				metadata = make(map[string]any)
+			}
+			metadata[HNSW_SPACE_KEY] = HNSW_SPACE_COSINE
+		}
+		s.collections[name] = &InMemoryCollection{
+			store:    s,
+			name:     name,
+			metadata: metadata,
+			entries:  c.Entries,
+		}
+	}
+
+	return nil
+}
+
+func (s *InMemoryStore) GetCollection(ctx context.Context, name string) (MemoryCollection, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: collection name can't be empty", ErrInvalidArgument)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	collection, exists := s.collections[name]
+	if exists {
+		return collection, nil
+	}
+
+	collection = &InMemoryCollection{
+		store:    s,
+		name:     name,
+		metadata: map[string]any{HNSW_SPACE_KEY: config.Memory.Distance},
+	}
+	s.collections[name] = collection
+
+	s.save(collection)
+	return collection, nil
+}
+
+func (s *InMemoryStore) ListCollections(ctx context.Context) ([]MemoryCollection, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]MemoryCollection, 0, len(s.collections))
+	for _, collection := range s.collections {
+		list = append(list, collection)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].GetName() < list[j].GetName()
+	})
+
+	return list, nil
+}
+
+func (s *InMemoryStore) RemoveCollection(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.collections[name]; exists == false {
+		return fmt.Errorf("%w: collection %s does not exist", ErrNotFound, name)
+	}
+
+	delete(s.collections, name)
+
+	s.save(nil)
+	return nil
+}
+
+// Records a change of collection (nil when a collection is removed),
+// and schedules a write. Store mutex should be locked by caller.
+func (s *InMemoryStore) save(c *InMemoryCollection) {
+	s.version++
+	if c != nil {
+		c.version = s.version
+	}
+	if s.path == "" || s.closed {
+		return
+	}
+	select {
+	case s.pendingWrite <- struct{}{}:
+	default: // already pending
+	}
+}
+
+// Writes collections to file when they change, in the background,
+// so callers don't wait for encoding and disk writes.
+func (s *InMemoryStore) writeLoop() {
+	defer close(s.writeDone)
+	for range s.pendingWrite {
+		err := s.write()
+		if err != nil {
+			fmt.Println("❌ can't save memories:", err.Error())
+		}
+	}
+}
+
+// Waits for the background write, then writes
+// remaining changes. Changes made after that aren't written.
+func (s *InMemoryStore) Close() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.pendingWrite)
+	s.mutex.Unlock()
+
+	<-s.writeDone
+	return s.write()
+}
+
+// Writes all collections to file, encoding only the ones
+// that changed since the previous write.
+func (s *InMemoryStore) write() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	type snapshot struct {
+		version  uint64
+		metadata map[string]any
+		entries  []ChromaCollectionEntry
+	}
+
+	// entries & metadata are replaced, never modified in place,
+	// copying lists is enough to encode them without the lock
+	s.mutex.RLock()
+	changed := make(map[string]snapshot)
+	names := make([]string, 0, len(s.collections))
+	for name, c := range s.collections {
+		names = append(names, name)
+		if w, exists := s.written[name]; exists && w.version == c.version {
+			continue
+		}
+		changed[name] = snapshot{
+			version:  c.version,
+			metadata: c.metadata,
+			entries:  append([]ChromaCollectionEntry(nil), c.entries...),
+		}
+	}
+	s.mutex.RUnlock()
+
+	// no change since previous write
+	// (collections are never renamed)
+	if len(changed) == 0 && len(names) == len(s.written) {
+		return nil
+	}
+
+	written := make(map[string]inMemoryCollectionWritten, len(names))
+	for _, name := range names {
+		c, exists := changed[name]
+		if exists == false {
+			written[name] = s.written[name]
+			continue
+		}
+		data, err := json.Marshal(inMemoryCollectionFile{Metadata: c.metadata, Entries: c.entries})
+		if err != nil {
+			return err
+		}
+		written[name] = inMemoryCollectionWritten{version: c.version, data: data}
+	}
+
+	// same format as inMemoryStoreFile
+	f := struct {
+		Collections map[string]json.RawMessage `json:"collections"`
+	}{
+		Collections: make(map[string]json.RawMessage, len(written)),
+	}
+	for name, w := range written {
+		f.Collections[name] = w.data
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(s.path, data)
+	if err != nil {
+		return err
+	}
+	s.written = written
+	return nil
+}
+
+func (c *InMemoryCollection) GetName() string {
+	return c.name
+}
+
+func (c *InMemoryCollection) GetMetadata() map[string]any {
+	c.store.mutex.RLock()
+	defer c.store.mutex.RUnlock()
+	return c.metadata
+}
+
+func (c *InMemoryCollection) SetMetadata(ctx context.Context, metadata map[string]any) error {
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+	// like Chroma, HNSW settings (distance) can't be modified
+	c.metadata = withHNSWSettings(metadata, c.metadata)
+	c.store.save(c)
+	return nil
+}
+
+func (c *InMemoryCollection) Add(ctx context.Context, entries []ChromaCollectionEntry) error {
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	ids := make(map[string]bool)
+	for _, e := range c.entries {
+		ids[e.ID] = true
+	}
+
+	// validating all entries first, nothing is added if one is invalid
+	for _, entry := range entries {
+		if ids[entry.ID] {
+			return fmt.Errorf("%w: entry ID %s", ErrAlreadyExists, entry.ID)
+		}
+		ids[entry.ID] = true
+	}
+
+	err := c.validate(entries)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		c.entries = append(c.entries, copyEntry(entry))
+	}
+
+	c.store.save(c)
+	return nil
+}
+
+func (c *InMemoryCollection) Upsert(ctx context.Context, entries []ChromaCollectionEntry) error {
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	err := c.validate(entries)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		i := c.indexOf(entry.ID)
+		if i < 0 {
+			c.entries = append(c.entries, copyEntry(entry))
+		} else {
+			c.entries[i] = copyEntry(entry)
+		}
+	}
+
+	c.store.save(c)
+	return nil
+}
+
+// Updates existing entries, only replacing provided fields
+// (non nil embedding, non empty document). Like Chroma, provided
+// metadata keys are merged into existing ones (nil values remove keys),
+// and unknown IDs are ignored.
+func (c *InMemoryCollection) Update(ctx context.Context, entries []ChromaCollectionEntry) error {
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	dimension := c.dimension()
+
+	for _, entry := range entries {
+		if entry.Embedding != nil && dimension > 0 && len(*entry.Embedding) != dimension {
+			return errDimensionMismatch
+		}
+	}
+
+	for _, entry := range entries {
+		i := c.indexOf(entry.ID)
+		if i < 0 {
+			continue
+		}
+		updated := c.entries[i]
+		if entry.Embedding != nil {
+			updated.Embedding = copyEntry(entry).Embedding
+		}
+		if entry.Document != "" {
+			updated.Document = entry.Document
+		}
+		if entry.Metadatas != nil {
+			updated.Metadatas = mergeMetadatas(updated.Metadatas, entry.Metadatas)
+		}
+		c.entries[i] = updated
+	}
+
+	c.store.save(c)
+	return nil
+}
+
+func (c *InMemoryCollection) Get(ctx context.Context, get ChromaCollectionGet) ([]ChromaCollectionEntry, error) {
+	err := validateFilters(get.Where, get.WhereDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	include := get.Include
+	if include == nil {
+		include = []string{INCLUDE_DOCUMENTS, INCLUDE_METADATAS}
+	}
+	includes := make(map[string]bool)
+	for _, i := range include {
+		includes[i] = true
+	}
+
+	c.store.mutex.RLock()
+	defer c.store.mutex.RUnlock()
+
+	var ids map[string]bool
+	if len(get.IDs) > 0 {
+		ids = make(map[string]bool)
+		for _, id := range get.IDs {
+			ids[id] = true
+		}
+	}
+
+	results := make([]ChromaCollectionEntry, 0)
+	skipped := 0
+	for _, e := range c.entries {
+		if ids != nil && ids[e.ID] == false {
+			continue
+		}
+		if matchFilters(e, get.Where, get.WhereDocument) == false {
+			continue
+		}
+		if skipped < get.Offset {
+			skipped++
+			continue
+		}
+		if get.Limit > 0 && len(results) >= get.Limit {
+			break
+		}
+
+		entry := ChromaCollectionEntry{ID: e.ID}
+		if includes[INCLUDE_EMBEDDINGS] {
+			entry.Embedding = copyEntry(e).Embedding
+		}
+		if includes[INCLUDE_DOCUMENTS] {
+			entry.Document = e.Document
+		}
+		if includes[INCLUDE_METADATAS] {
+			entry.Metadatas = copyMetadatas(e.Metadatas)
+		}
+		results = append(results, entry)
+	}
+
+	return results, nil
+}
+
+func (c *InMemoryCollection) Peek(ctx context.Context, limit int) ([]ChromaCollectionEntry, error) {
+	if limit <= 0 {
+		limit = 10 // same default as Chroma
+	}
+	return c.Get(ctx, ChromaCollectionGet{
+		Limit:   limit,
+		Include: []string{INCLUDE_EMBEDDINGS, INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+	})
+}
+
+func (c *InMemoryCollection) Delete(ctx context.Context, del ChromaCollectionDelete) ([]string, error) {
+	if len(del.IDs) == 0 && del.Where == nil && del.WhereDocument == nil {
+		// would delete everything
+		return nil, fmt.Errorf("%w: Delete: IDs or filter required", ErrInvalidArgument)
+	}
+	err := validateFilters(del.Where, del.WhereDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	// when both IDs and filters are provided,
+	// entries have to match both
+	var ids map[string]bool
+	if len(del.IDs) > 0 {
+		ids = make(map[string]bool)
+		for _, id := range del.IDs {
+			ids[id] = true
+		}
+	}
+
+	deleted := make([]string, 0)
+	kept := make([]ChromaCollectionEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if (ids == nil || ids[e.ID]) && matchFilters(e, del.Where, del.WhereDocument) {
+			deleted = append(deleted, e.ID)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	c.entries = kept
+
+	c.store.save(c)
+	return deleted, nil
+}
+
+func (c *InMemoryCollection) Count(ctx context.Context) (int, error) {
+	c.store.mutex.RLock()
+	defer c.store.mutex.RUnlock()
+	return len(c.entries), nil
+}
+
+// Checks entries before adding them.
+// Store mutex should be locked by caller.
+func (c *InMemoryCollection) validate(entries []ChromaCollectionEntry) error {
+	dimension := c.dimension()
+	for _, entry := range entries {
+		if entry.ID == "" {
+			return fmt.Errorf("%w: entry ID can't be empty", ErrInvalidArgument)
+		}
+		if entry.Embedding == nil || len(*entry.Embedding) == 0 {
+			return fmt.Errorf("%w: entry embedding is required: %s", ErrInvalidArgument, entry.ID)
+		}
+		if dimension == 0 {
+			dimension = len(*entry.Embedding)
+		} else if len(*entry.Embedding) != dimension {
+			return errDimensionMismatch
+		}
+	}
+	return nil
+}
+
+// Returns dimension of embeddings in collection, 0 if empty
+func (c *InMemoryCollection) dimension() int {
+	if len(c.entries) == 0 {
+		return 0
+	}
+	return len(*c.entries[0].Embedding)
+}
+
+func (c *InMemoryCollection) indexOf(id string) int {
+	for i, e := range c.entries {
+		if e.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Copies entry, so stored embeddings & metadatas can't be modified by callers
+func copyEntry(entry ChromaCollectionEntry) ChromaCollectionEntry {
+	if entry.Embedding != nil {
+		embedding := append([]float64(nil), *entry.Embedding...)
+		entry.Embedding = &embedding
+	}
+	entry.Metadatas = copyMetadatas(entry.Metadatas)
+	entry.Distance = 0
+	return entry
+}
+
+// Metadata values are scalars, copying the map is enough
+func copyMetadatas(metadatas map[string]any) map[string]any {
+	if metadatas == nil {
+		return nil
+	}
+	c := make(map[string]any, len(metadatas))
+	for k, v := range metadatas {
+		c[k] = v
+	}
+	return c
+}
+
+// Returns a copy of metadatas with update's keys,
+// keys with nil values are removed.
+func mergeMetadatas(metadatas map[string]any, update map[string]any) map[string]any {
+	merged := copyMetadatas(metadatas)
+	if merged == nil {
+		merged = make(map[string]any, len(update))
+	}
+	for k, v := range update {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func (c *InMemoryCollection) Query(ctx context.Context, query ChromaCollectionQuery) ([]ChromaCollectionEntry, error) {
+	if len(query.Embeddings) < 1 {
+		return nil, fmt.Errorf("%w: query embedding is required", ErrInvalidArgument)
+	}
+	err := validateFilters(query.Where, query.WhereDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	nResults := query.NResults
+	if nResults <= 0 {
+		nResults = 10 // same default as Chroma
+	}
+
+	c.store.mutex.RLock()
+	defer c.store.mutex.RUnlock()
+
+	// like Chroma, only considering first query embedding
+	embedding := query.Embeddings[0]
+
+	// like Chroma, l2 when distance is not set
+	// (loaded collections always have one, see load)
+	distance := l2Distance
+	switch c.metadata[HNSW_SPACE_KEY] {
+	case HNSW_SPACE_COSINE:
+		distance = cosineDistance
+	case HNSW_SPACE_IP:
+		distance = ipDistance
+	}
+
+	results := make([]ChromaCollectionEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if len(*e.Embedding) != len(embedding) {
+			return nil, errDimensionMismatch
+		}
+		if matchFilters(e, query.Where, query.WhereDocument) == false {
+			continue
+		}
+		results = append(results, ChromaCollectionEntry{
+			ID:        e.ID,
+			Document:  e.Document,
+			Metadatas: copyMetadatas(e.Metadatas),
+			Distance:  distance(embedding, *e.Embedding),
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Distance < results[j].Distance
+	})
+
+	if len(results) > nResults {
+		results = results[:nResults]
+	}
+
+	return results, nil
+}
+
+// Squared L2 distance
+func l2Distance(a, b []float64) float64 {
+	d := 0.0
+	for i := range a {
+		d += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return d
+}
+
+// Returns 1 - inner product
+func ipDistance(a, b []float64) float64 {
+	dot := 0.0
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return 1 - dot
+}
+
+// Returns 1 - cosine similarity, between 0 and 2
+func cosineDistance(a, b []float64) float64 {
+	dot, normA, normB := 0.0, 0.0, 0.0
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 1
+	}
+	return 1 - dot/(math.Sqrt(normA)*math.Sqrt(normB))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Returns entries embedded with a HashEmbedder, IDs are the documents
+func hashEmbeddedEntries(t *testing.T, documents ...string) []ChromaCollectionEntry {
+	t.Helper()
+	embedder := NewHashEmbedder(256)
+	entries := make([]ChromaCollectionEntry, len(documents))
+	for i, document := range documents {
+		embedding, err := embedder.Embed(context.Background(), document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[i] = ChromaCollectionEntry{ID: document, Document: document, Embedding: &embedding}
+	}
+	return entries
+}
+
+func TestInMemoryStoreWrite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "memories.json")
+
+	store, err := NewInMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	entries := hashEmbeddedEntries(t, "bob sells swords", "alice likes apples")
+	for _, name := range []string{"bob", "alice"} {
+		collection, err := store.GetCollection(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = collection.Add(ctx, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// written collections are only encoded again when they change
+	check := func(want map[string][]string) {
+		t.Helper()
+		err := store.write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewInMemoryStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer loaded.Close()
+		got := make(map[string][]string)
+		for name, c := range loaded.collections {
+			ids := make([]string, len(c.entries))
+			for i, e := range c.entries {
+				ids[i] = e.ID
+			}
+			got[name] = ids
+			if c.metadata[HNSW_SPACE_KEY] != config.Memory.Distance {
+				t.Errorf("collection %s metadata: %v", name, c.metadata)
+			}
+		}
+		if reflect.DeepEqual(got, want) == false {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	check(map[string][]string{
+		"bob":   {"bob sells swords", "alice likes apples"},
+		"alice": {"bob sells swords", "alice likes apples"},
+	})
+
+	collection, err := store.GetCollection(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = collection.Delete(ctx, ChromaCollectionDelete{IDs: []string{"alice likes apples"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(map[string][]string{
+		"bob":   {"bob sells swords"},
+		"alice": {"bob sells swords", "alice likes apples"},
+	})
+
+	err = store.RemoveCollection(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(map[string][]string{
+		"bob": {"bob sells swords"},
+	})
+}
+
+func TestInMemoryCollectionMetadatas(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := hashEmbeddedEntries(t, "bob sells swords")
+	entries[0].Metadatas = map[string]any{"sender": "alice", "importance": 3.0}
+	err = collection.Add(ctx, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored metadatas can't be changed by callers
+	entries[0].Metadatas["sender"] = "eve"
+	got, err := collection.Get(ctx, ChromaCollectionGet{IDs: []string{"bob sells swords"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[0].Metadatas["importance"] = 10.0
+
+	// like Chroma, updated keys are merged, nil removes keys
+	err = collection.Update(ctx, []ChromaCollectionEntry{{
+		ID:        "bob sells swords",
+		Metadatas: map[string]any{"context": "market", "sender": nil},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = collection.Get(ctx, ChromaCollectionGet{IDs: []string{"bob sells swords"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"importance": 3.0, "context": "market"}
+	if reflect.DeepEqual(got[0].Metadatas, want) == false {
+		t.Errorf("got %v, want %v", got[0].Metadatas, want)
+	}
+}
+
+func TestInMemoryCollectionDefaultDistance(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// collection created without distance function
+	collection.(*InMemoryCollection).metadata = nil
+
+	// "far" has the query's direction (closest with cosine),
+	// "near" is closest with l2 (Chroma's default)
+	err = collection.Add(ctx, []ChromaCollectionEntry{
+		{ID: "near", Embedding: &[]float64{1, 0}},
+		{ID: "far", Embedding: &[]float64{10, 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := collection.Query(ctx, ChromaCollectionQuery{Embeddings: [][]float64{{1, 1}}, NResults: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "near" {
+		t.Errorf("got %v, want near", results)
+	}
+}
+
+func TestInMemoryStoreLoadDistance(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "memories.json")
+
+	// "far" has the query's direction (closest with cosine),
+	// "near" is closest with l2. Collections written before distance
+	// functions were supported don't have one, they used cosine.
+	err := os.WriteFile(path, []byte(`{"collections":{
+		"old": {"metadata": {"embedding_dimension": 2}, "entries": [
+			{"id": "near", "embedding": [1, 0]}, {"id": "far", "embedding": [10, 10]}]},
+		"older": {"entries": [
+			{"id": "near", "embedding": [1, 0]}, {"id": "far", "embedding": [10, 10]}]},
+		"l2": {"metadata": {"hnsw:space": "l2"}, "entries": [
+			{"id": "near", "embedding": [1, 0]}, {"id": "far", "embedding": [10, 10]}]}
+	}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewInMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	for name, want := range map[string]string{"old": "far", "older": "far", "l2": "near"} {
+		collection, err := store.GetCollection(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := collection.Query(ctx, ChromaCollectionQuery{Embeddings: [][]float64{{1, 1}}, NResults: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].ID != want {
+			t.Errorf("%s: got %v, want %s", name, results, want)
+		}
+	}
+
+	// other metadata is kept
+	collection, err := store.GetCollection(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{EMBEDDING_DIMENSION_KEY: 2.0, HNSW_SPACE_KEY: HNSW_SPACE_COSINE}
+	if reflect.DeepEqual(collection.GetMetadata(), want) == false {
+		t.Errorf("metadata %v, want %v", collection.GetMetadata(), want)
+	}
+}
+
+func TestInMemoryStoreClose(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "memories.json")
+
+	store, err := NewInMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	collection, err := store.GetCollection(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = collection.Add(ctx, hashEmbeddedEntries(t, "bob sells swords"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pending changes are written
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewInMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if c := loaded.collections["bob"]; c == nil || len(c.entries) != 1 {
+		t.Errorf("collection not written: %v", loaded.collections)
+	}
+
+	// entries loaded without embedding can't be searched
+	err = os.WriteFile(path, []byte(`{"collections":{"bob":{"entries":[{"id":"a","document":"a"}]}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewInMemoryStore(path)
+	if err == nil {
+		t.Error("expected error loading entry without embedding")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	ollama "github.com/ollama/ollama/api"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Text generation using an OpenAI compatible chat completions API.
+// Works with OpenAI, but also llama.cpp server, vLLM, LM Studio...
+type OpenAIGenerator struct {
+	baseURL    *url.URL // e.g. http://localhost:8080/v1
+	apiKey     string   // optional
+	model      string
+	httpClient *http.Client
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIResponseFormat struct {
+	Type string `json:"type"`
+}
+
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Stream         bool                  `json:"stream"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      *openAIMessage `json:"message,omitempty"`
+		Delta        *openAIMessage `json:"delta,omitempty"`
+		FinishReason *string        `json:"finish_reason,omitempty"`
+	} `json:"choices"`
+	// set when generation fails after streaming started
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func NewOpenAIGenerator(baseURLStr, apiKey, model string) (*OpenAIGenerator, error) {
+	baseURL, err := url.Parse(baseURLStr)
+	if err != nil {
+		return nil, errors.New("Error parsing base URL:" + err.Error())
+	}
+
+	return &OpenAIGenerator{
+		baseURL:    baseURL,
+		apiKey:     apiKey,
+		model:      model,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+func (g *OpenAIGenerator) DefaultModel() string {
+	return g.model
+}
+
+func (g *OpenAIGenerator) Generate(ctx context.Context, req GenerateRequest, fn func(ollama.GenerateResponse) error) error {
+	model := req.Model
+	if model == "" {
+		model = g.model
+	}
+
+	chatReq := openAIChatRequest{
+		Model:  model,
+		Stream: req.Stream,
+	}
+	if req.System != "" {
+		chatReq.Messages = append(chatReq.Messages, openAIMessage{Role: "system", Content: req.System})
+	}
+	chatReq.Messages = append(chatReq.Messages, openAIMessage{Role: "user", Content: req.Prompt})
+	if req.Format == "json" {
+		chatReq.ResponseFormat = &openAIResponseFormat{Type: "json_object"}
+	}
+
+	payload, err := json.Marshal(chatReq)
+	if err != nil {
+		return err
+	}
+
+	url := *g.baseURL
+	url.Path = path.Join(url.Path, "chat", "completions")
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url.String(), bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+
+	resp, err := g.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("chat completion failed, HTTP status:" + strconv.Itoa(resp.StatusCode) + " " + string(body))
+	}
+
+	if req.Stream == false {
+		var chatResp openAIChatResponse
+		err = json.NewDecoder(resp.Body).Decode(&chatResp)
+		if err != nil {
+			return err
+		}
+		if len(chatResp.Choices) < 1 || chatResp.Choices[0].Message == nil {
+			return errors.New("chat completion returned no choice")
+		}
+		return fn(ollama.GenerateResponse{
+			Model:     chatResp.Model,
+			CreatedAt: time.Now(),
+			Response:  chatResp.Choices[0].Message.Content,
+			Done:      true,
+		})
+	}
+
+	// Streamed responses are Server-Sent Events:
+	// data: {...}
+	// data: [DONE]
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "data:") == false {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return fn(ollama.GenerateResponse{
+				Model:     model,
+				CreatedAt: time.Now(),
+				Done:      true,
+			})
+		}
+
+		var chunk openAIChatResponse
+		err = json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			return err
+		}
+		if chunk.Error != nil {
+			return errors.New("chat completion failed: " + chunk.Error.Message)
+		}
+		if len(chunk.Choices) < 1 || chunk.Choices[0].Delta == nil || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		err = fn(ollama.GenerateResponse{
+			Model:     chunk.Model,
+			CreatedAt: time.Now(),
+			Response:  chunk.Choices[0].Delta.Content,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("chat completion stream ended unexpectedly")
+}
+
+// Embeddings using an OpenAI compatible /v1/embeddings API
+type OpenAIEmbedder struct {
+	baseURL    *url.URL
+	apiKey     string // optional
+	model      string
+	httpClient *http.Client
+}
+
+type openAIEmbeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+}
+
+func NewOpenAIEmbedder(baseURLStr, apiKey, model string) (*OpenAIEmbedder, error) {
+	baseURL, err := url.Parse(baseURLStr)
+	if err != nil {
+		return nil, errors.New("Error parsing base URL:" + err.Error())
+	}
+
+	return &OpenAIEmbedder{
+		baseURL:    baseURL,
+		apiKey:     apiKey,
+		model:      model,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+func (e *OpenAIEmbedder) Model() string {
+	return e.model
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	payload, err := json.Marshal(openAIEmbeddingRequest{
+		Model: e.model,
+		Input: text,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := *e.baseURL
+	url.Path = path.Join(url.Path, "embeddings")
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url.String(), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := e.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("embeddings failed, HTTP status:" + strconv.Itoa(resp.StatusCode) + " " + string(body))
+	}
+
+	var embeddingResp openAIEmbeddingResponse
+	err = json.NewDecoder(resp.Body).Decode(&embeddingResp)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddingResp.Data) < 1 || len(embeddingResp.Data[0].Embedding) == 0 {
+		return nil, errors.New("embeddings returned no data")
+	}
+
+	return embeddingResp.Data[0].Embedding, nil
+}
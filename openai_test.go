@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	ollama "github.com/ollama/ollama/api"
+)
+
+// Starts a fake OpenAI compatible server replying with status and body,
+// calls check with each request's path, headers and decoded payload.
+func newTestOpenAIServer(t *testing.T, status int, body string, check func(path string, header http.Header, payload map[string]any)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var payload map[string]any
+		err = json.Unmarshal(data, &payload)
+		if err != nil {
+			t.Errorf("%s: can't decode payload: %v", r.URL.Path, err)
+		}
+		if check != nil {
+			check(r.URL.Path, r.Header, payload)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenAIGenerator(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    bool
+		status    int
+		body      string
+		responses []string // ollama.GenerateResponse.Response, last one is done
+		err       string   // expected error (substring)
+	}{
+		{
+			"stream",
+			true,
+			http.StatusOK,
+			": keep-alive\n\n" +
+				`data: {"model":"m","choices":[{"delta":{"role":"assistant","content":""}}]}` + "\n\n" +
+				`data: {"model":"m","choices":[{"delta":{"content":"Hel"}}]}` + "\n\n" +
+				`data:{"model":"m","choices":[{"delta":{"content":"lo"}}]}` + "\n\n" +
+				`data: {"model":"m","choices":[{"delta":{},"finish_reason":"stop"}]}` + "\n\n" +
+				"data: [DONE]\n\n",
+			[]string{"Hel", "lo", ""},
+			"",
+		},
+		{
+			"stream error",
+			true,
+			http.StatusOK,
+			`data: {"model":"m","choices":[{"delta":{"content":"Hel"}}]}` + "\n\n" +
+				`data: {"error":{"message":"model unloaded"}}` + "\n\n",
+			[]string{"Hel"},
+			"chat completion failed: model unloaded",
+		},
+		{
+			"stream without done",
+			true,
+			http.StatusOK,
+			`data: {"model":"m","choices":[{"delta":{"content":"Hel"}}]}` + "\n\n",
+			[]string{"Hel"},
+			"chat completion stream ended unexpectedly",
+		},
+		{
+			"invalid chunk",
+			true,
+			http.StatusOK,
+			"data: {\n\n",
+			nil,
+			"unexpected end of JSON input",
+		},
+		{
+			"complete",
+			false,
+			http.StatusOK,
+			`{"model":"m","choices":[{"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`,
+			[]string{"Hello"},
+			"",
+		},
+		{
+			"no choice",
+			false,
+			http.StatusOK,
+			`{"model":"m","choices":[]}`,
+			nil,
+			"chat completion returned no choice",
+		},
+		{
+			"HTTP error",
+			true,
+			http.StatusServiceUnavailable,
+			`{"error":{"message":"overloaded"}}`,
+			nil,
+			`HTTP status:503 {"error":{"message":"overloaded"}}`,
+		},
+	}
+
+	for _, test := range tests {
+		server := newTestOpenAIServer(t, test.status, test.body, func(path string, header http.Header, payload map[string]any) {
+			if path != "/v1/chat/completions" {
+				t.Errorf("%s: path %s", test.name, path)
+			}
+			if auth := header.Get("Authorization"); auth != "Bearer key" {
+				t.Errorf("%s: authorization %q", test.name, auth)
+			}
+			want := map[string]any{
+				"model": "model",
+				"messages": []any{
+					map[string]any{"role": "system", "content": "You're Bob."},
+					map[string]any{"role": "user", "content": "Hi!"},
+				},
+				"stream":          test.stream,
+				"response_format": map[string]any{"type": "json_object"},
+			}
+			if reflect.DeepEqual(payload, want) == false {
+				t.Errorf("%s: payload %v, want %v", test.name, payload, want)
+			}
+		})
+
+		generator, err := NewOpenAIGenerator(server.URL+"/v1", "key", "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var responses []string
+		done := false
+		err = generator.Generate(context.Background(), GenerateRequest{
+			Model:  "model",
+			System: "You're Bob.",
+			Prompt: "Hi!",
+			Format: "json",
+			Stream: test.stream,
+		}, func(r ollama.GenerateResponse) error {
+			if done {
+				t.Errorf("%s: response after done", test.name)
+			}
+			responses = append(responses, r.Response)
+			done = r.Done
+			return nil
+		})
+
+		if test.err != "" {
+			if err == nil || strings.Contains(err.Error(), test.err) == false {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if done == false {
+			t.Errorf("%s: last response not done", test.name)
+		}
+		if reflect.DeepEqual(responses, test.responses) == false {
+			t.Errorf("%s: responses %q, want %q", test.name, responses, test.responses)
+		}
+	}
+}
+
+func TestOpenAIGeneratorCallbackError(t *testing.T) {
+	server := newTestOpenAIServer(t, http.StatusOK,
+		`data: {"model":"m","choices":[{"delta":{"content":"Hel"}}]}`+"\n\n"+
+			`data: {"model":"m","choices":[{"delta":{"content":"lo"}}]}`+"\n\n"+
+			"data: [DONE]\n\n", nil)
+
+	generator, err := NewOpenAIGenerator(server.URL, "", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stream stops when the callback fails
+	stop := errors.New("client gone")
+	calls := 0
+	err = generator.Generate(context.Background(), GenerateRequest{Prompt: "Hi!", Stream: true}, func(r ollama.GenerateResponse) error {
+		calls++
+		return stop
+	})
+	if errors.Is(err, stop) == false || calls != 1 {
+		t.Errorf("got error %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
+
+func TestOpenAIEmbedder(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		embedding []float64
+		err       string
+	}{
+		{"embedding", http.StatusOK, `{"data":[{"embedding":[0.5,-1,2]}]}`, []float64{0.5, -1, 2}, ""},
+		{"no data", http.StatusOK, `{"data":[]}`, nil, "embeddings returned no data"},
+		{"HTTP error", http.StatusUnauthorized, `invalid key`, nil, "HTTP status:401 invalid key"},
+	}
+
+	for _, test := range tests {
+		server := newTestOpenAIServer(t, test.status, test.body, func(path string, header http.Header, payload map[string]any) {
+			want := map[string]any{"model": "embedder", "input": "bob sells swords"}
+			if path != "/v1/embeddings" || reflect.DeepEqual(payload, want) == false {
+				t.Errorf("%s: %s %v, want /v1/embeddings %v", test.name, path, payload, want)
+			}
+			if auth := header.Get("Authorization"); auth != "" {
+				t.Errorf("%s: authorization %q without API key", test.name, auth)
+			}
+		})
+
+		embedder, err := NewOpenAIEmbedder(server.URL+"/v1", "", "embedder")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		embedding, err := embedder.Embed(context.Background(), "bob sells swords")
+		if test.err != "" {
+			if err == nil || strings.Contains(err.Error(), test.err) == false {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if reflect.DeepEqual(embedding, test.embedding) == false {
+			t.Errorf("%s: got %v, want %v", test.name, embedding, test.embedding)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Prompt assembly: prompt templates (see templates.go) are filled by priority,
+// within the model's context window minus tokens reserved for the answer (config.LLM):
+// 1. template text, agent's name, sender, message & world state (always included)
+// 2. persona (agent's system prompt)
+// 3. behavior code
+// 4. conversation with the sender (oldest turns dropped first)
+// 5. recalled memories (lowest-ranked dropped first)
+// Token counts are estimates, see estimateTokens.
+
+const (
+	// rough estimate for English text, good enough for budgets
+	CHARS_PER_TOKEN = 4
+)
+
+// Describes what didn't fit in the prompt
+type promptReport struct {
+	Budget          int      // tokens available for the prompt
+	Tokens          int      // estimated prompt tokens
+	DroppedSections []string // "persona", "behavior code"
+	DroppedTurns    []ConversationTurn
+	DroppedMemories []Memory
+}
+
+// Estimates the number of tokens in text
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + CHARS_PER_TOKEN - 1) / CHARS_PER_TOKEN
+}
+
+// Returns the context window of given model, in tokens.
+// Tags are ignored when the model is not listed with its tag
+// ("llama3:8b" uses "llama3" context size).
+func modelContextSize(model string) int {
+	if size, exists := config.LLM.ContextSizes[model]; exists {
+		return size
+	}
+	name, _, _ := strings.Cut(model, ":")
+	if size, exists := config.LLM.ContextSizes[name]; exists {
+		return size
+	}
+	return config.LLM.ContextSize
+}
+
+// Returns the number of tokens available for agent's prompts
+func agentPromptBudget(agent *Agent) (int, error) {
+	_, model, err := agentGenerator(agent)
+	if err != nil {
+		return 0, err
+	}
+	return modelContextSize(model) - config.LLM.ResponseTokens, nil
+}
+
+// Renders template with data, followed by suffix (e.g. JSON schema),
+// by priority within budget (tokens, see above). The template is rendered
+// to measure each addition, so budgets don't depend on its layout.
+// Required parts are included even if they exceed the budget.
+func assemblePrompt(t *PromptTemplate, data PromptData, suffix string, budget int) (string, promptReport, error) {
+	report := promptReport{Budget: budget}
+
+	d := data
+	d.Agent.System = ""
+	d.Agent.BehaviorCode = ""
+	d.BehaviorCode = ""
+	d.Conversation = nil
+	d.Memories = nil
+
+	measure := func() (int, error) {
+		text, err := t.render(d)
+		return estimateTokens(text + suffix), err
+	}
+
+	used, err := measure()
+	if err != nil {
+		return "", report, err
+	}
+
+	// optional sections, included when they fit entirely
+	for _, section := range []struct {
+		name  string
+		empty bool
+		add   func()
+		drop  func()
+	}{
+		{
+			"persona",
+			data.Agent.System == "",
+			func() { d.Agent.System = data.Agent.System },
+			func() { d.Agent.System = "" },
+		},
+		{
+			"behavior code",
+			data.Agent.BehaviorCode == "" && data.BehaviorCode == "",
+			func() { d.Agent.BehaviorCode, d.BehaviorCode = data.Agent.BehaviorCode, data.BehaviorCode },
+			func() { d.Agent.BehaviorCode, d.BehaviorCode = "", "" },
+		},
+	} {
+		if section.empty {
+			continue
+		}
+		section.add()
+		tokens, err := measure()
+		if err != nil {
+			return "", report, err
+		}
+		if tokens > budget {
+			section.drop()
+			report.DroppedSections = append(report.DroppedSections, section.name)
+			continue
+		}
+		used = tokens
+	}
+
+	// conversation, newest turns first
+	withoutConversation := used
+	turns := data.Conversation
+	for i := len(turns) - 1; i >= 0; i-- {
+		d.Conversation = turns[i:]
+		tokens, err := measure()
+		if err != nil {
+			return "", report, err
+		}
+		maxTokens := config.Memory.Conversation.MaxTokens
+		if tokens > budget || (maxTokens > 0 && tokens-withoutConversation > maxTokens) {
+			d.Conversation = turns[i+1:]
+			break
+		}
+		used = tokens
+	}
+	report.DroppedTurns = turns[:len(turns)-len(d.Conversation)]
+
+	// recalled memories already part of the conversation are skipped,
+	// unless the template doesn't show the conversation
+	inConversation := make(map[string]bool)
+	if used > withoutConversation {
+		for _, turn := range d.Conversation {
+			inConversation[turn.MemoryID] = true
+		}
+	}
+
+	d.Memories = make([]PromptMemory, 0, len(data.Memories))
+	for _, m := range data.Memories {
+		if inConversation[m.ID] {
+			continue
+		}
+		// once a memory doesn't fit, lower-ranked ones are
+		// dropped too, even if they're shorter
+		if len(report.DroppedMemories) > 0 {
+			report.DroppedMemories = append(report.DroppedMemories, m.Memory)
+			continue
+		}
+		d.Memories = append(d.Memories, m)
+		tokens, err := measure()
+		if err != nil {
+			return "", report, err
+		}
+		if tokens > budget {
+			d.Memories = d.Memories[:len(d.Memories)-1]
+			report.DroppedMemories = append(report.DroppedMemories, m.Memory)
+			continue
+		}
+		used = tokens
+	}
+
+	text, err := t.render(d)
+	if err != nil {
+		return "", report, err
+	}
+	prompt := text + suffix
+	report.Tokens = estimateTokens(prompt)
+
+	return prompt, report, nil
+}
+
+// Prints prompt size, and what was dropped, in debug mode
+func (r promptReport) print(agent *Agent) {
+	if config.Debug == false {
+		return
+	}
+
+	fmt.Printf("📏 Prompt for %s: ~%d/%d tokens\n", agent.Name, r.Tokens, r.Budget)
+
+	if len(r.DroppedSections) == 0 && len(r.DroppedTurns) == 0 && len(r.DroppedMemories) == 0 {
+		return
+	}
+
+	fmt.Println("✂️ Dropped to fit in context window:")
+	for _, section := range r.DroppedSections {
+		fmt.Println("-", section)
+	}
+	if len(r.DroppedTurns) > 0 {
+		fmt.Println("-", len(r.DroppedTurns), "oldest conversation turn(s)")
+	}
+	for _, m := range r.DroppedMemories {
+		fmt.Printf("- memory (score %.2f): %s\n", m.Score, m.Document)
+	}
+}
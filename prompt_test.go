@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const test_prompt_template = `{{.Agent.Name}}
+{{.Agent.System}}
+{{range .Conversation}}{{.Message}} / {{.Answer}}
+{{end}}{{range .Memories}}{{.Document}}
+{{end}}{{.Message}}`
+
+func testPromptData() PromptData {
+	now := time.Now()
+	return PromptData{
+		Agent: Agent{
+			Name:   "Bob",
+			System: strings.Repeat("You're the village blacksmith. ", 10),
+		},
+		Sender:  "Alice",
+		Message: "Can you fix my sword?",
+		Conversation: []ConversationTurn{
+			{Message: "turn 1, oldest", Answer: "what do you want?", MemoryID: "t1", CreatedAt: now.Add(-3 * time.Minute)},
+			{Message: "turn 2", Answer: "hmm", MemoryID: "t2", CreatedAt: now.Add(-2 * time.Minute)},
+			{Message: "turn 3, newest", Answer: "hey!", MemoryID: "t3", CreatedAt: now.Add(-time.Minute)},
+		},
+		// best first
+		Memories: promptMemories([]Memory{
+			{ID: "m1", Document: "memory 1, best ranked"},
+			{ID: "m2", Document: "memory 2"},
+			{ID: "t3", Document: "already in the conversation"},
+			{ID: "m3", Document: "memory 3, lowest ranked"},
+		}),
+		Now: now,
+	}
+}
+
+func TestAssemblePrompt(t *testing.T) {
+	tmpl, err := parsePromptTemplate("test", test_prompt_template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// estimated tokens of data rendered with persona (or not),
+	// the last turns and the first memories
+	tokens := func(persona bool, turns int, memories int) int {
+		d := testPromptData()
+		if persona == false {
+			d.Agent.System = ""
+		}
+		d.Conversation = d.Conversation[len(d.Conversation)-turns:]
+		all := d.Memories
+		d.Memories = nil
+		for _, m := range all {
+			if len(d.Memories) == memories {
+				break
+			}
+			if m.ID != "t3" {
+				d.Memories = append(d.Memories, m)
+			}
+		}
+		text, err := tmpl.render(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return estimateTokens(text)
+	}
+
+	tests := []struct {
+		name     string
+		budget   int
+		sections []string
+		turns    []string // dropped
+		memories []string // dropped
+	}{
+		{"everything fits", tokens(true, 3, 3), nil, nil, nil},
+		{"lowest-ranked memory dropped", tokens(true, 3, 2), nil, nil, []string{"m3"}},
+		{"all memories dropped", tokens(true, 3, 0), nil, nil, []string{"m1", "m2", "m3"}},
+		{"oldest turn dropped", tokens(true, 2, 0), nil, []string{"t1"}, []string{"m1", "m2", "m3"}},
+		// memories of dropped turns can be recalled
+		{"all turns dropped", tokens(true, 0, 0), nil, []string{"t1", "t2", "t3"}, []string{"m1", "m2", "t3", "m3"}},
+		// persona comes first, but it's dropped when it doesn't fit entirely
+		{"persona dropped", tokens(false, 3, 3), []string{"persona"}, nil, nil},
+		{"required parts only", 1, []string{"persona"}, []string{"t1", "t2", "t3"}, []string{"m1", "m2", "t3", "m3"}},
+	}
+
+	for _, test := range tests {
+		data := testPromptData()
+		prompt, report, err := assemblePrompt(tmpl, data, "", test.budget)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if reflect.DeepEqual(report.DroppedSections, test.sections) == false {
+			t.Errorf("%s: dropped sections %v, want %v", test.name, report.DroppedSections, test.sections)
+		}
+		var turns []string
+		for _, turn := range report.DroppedTurns {
+			turns = append(turns, turn.MemoryID)
+		}
+		if reflect.DeepEqual(turns, test.turns) == false {
+			t.Errorf("%s: dropped turns %v, want %v", test.name, turns, test.turns)
+		}
+		var memories []string
+		for _, m := range report.DroppedMemories {
+			memories = append(memories, m.ID)
+		}
+		if reflect.DeepEqual(memories, test.memories) == false {
+			t.Errorf("%s: dropped memories %v, want %v", test.name, memories, test.memories)
+		}
+
+		// required parts are always included
+		for _, required := range []string{data.Agent.Name, data.Message} {
+			if strings.Contains(prompt, required) == false {
+				t.Errorf("%s: prompt doesn't include %q", test.name, required)
+			}
+		}
+		if strings.Contains(prompt, "already in the conversation") && len(turns) < len(data.Conversation) {
+			t.Errorf("%s: memory already in the conversation included", test.name)
+		}
+		if report.Tokens != estimateTokens(prompt) {
+			t.Errorf("%s: report tokens %d, prompt tokens %d", test.name, report.Tokens, estimateTokens(prompt))
+		}
+		if test.budget > 1 && report.Tokens > test.budget {
+			t.Errorf("%s: %d tokens, budget %d", test.name, report.Tokens, test.budget)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reflection: once enough new memories accumulated, the agent's model
+// derives higher-level insights from them ("Bob seems to distrust the mayor").
+// Insights are stored as MEMORY_KIND_REFLECTION memories, with the IDs
+// of the memories they come from, and they're included first in prompts.
+
+const (
+	// max number of recent memories considered when reflecting
+	MAX_REFLECTION_MEMORIES = 100
+
+	// delay before trying to reflect again after a failure,
+	// doubled after each consecutive failure
+	REFLECTION_RETRY_BACKOFF     = time.Minute
+	REFLECTION_MAX_RETRY_BACKOFF = time.Hour
+
+	reflection_prompt_format = `You're %s, a game entity.
+Here are things you remember, most recent last:
+
+%s
+What are the %d most salient high-level insights you can infer from these memories
+(about other entities, relationships, what's going on around you...)?
+Respond with a JSON object, using this schema:
+
+{
+  "insights": [
+    {
+      "insight": string, // short sentence, e.g. "Bob seems to distrust the mayor"
+      "sources": [number] // numbers of the memories supporting the insight
+    }
+  ]
+}
+`
+)
+
+var (
+	// agents currently reflecting, only one reflection at a time per agent
+	reflecting = make(map[string]bool)
+	// indexed by agent ID, to avoid counting memories on every exchange
+	reflectionStates = make(map[string]*reflectionState)
+	// protects reflecting & reflectionStates
+	reflectingMutex sync.Mutex
+)
+
+// Automatic reflection state of an agent (see maybeReflect)
+type reflectionState struct {
+	// memories stored since last reflection,
+	// counted from the collection when unknown
+	pending      int
+	pendingKnown bool
+	// consecutive failures, and when to try again
+	failures int
+	retryAt  time.Time
+}
+
+type reflectionResponse struct {
+	Insights []struct {
+		Insight string `json:"insight"`
+		Sources []int  `json:"sources"`
+	} `json:"insights"`
+}
+
+// Starts a reflection in the background if agent accumulated enough
+// memories since its last reflection (config.Memory.Reflection.Threshold).
+// Should be called each time a memory is stored. After a failure, the
+// next attempt is delayed (REFLECTION_RETRY_BACKOFF, doubled each time).
+func maybeReflect(agent *Agent, collection MemoryCollection) {
+	threshold := config.Memory.Reflection.Threshold
+	if threshold <= 0 {
+		return
+	}
+
+	reflectingMutex.Lock()
+	state := reflectionStates[agent.ID]
+	if state == nil {
+		state = &reflectionState{}
+		reflectionStates[agent.ID] = state
+	}
+	state.pending++
+	if reflecting[agent.ID] ||
+		(state.pendingKnown && state.pending < threshold) ||
+		time.Now().Before(state.retryAt) {
+		reflectingMutex.Unlock()
+		return
+	}
+	reflecting[agent.ID] = true
+	reflectingMutex.Unlock()
+
+	go func() {
+		defer stopReflecting(agent.ID)
+
+		// not using request's context, canceled once agent responded
+		ctx := context.Background()
+
+		memories, err := memoriesSinceLastReflection(ctx, collection)
+		if err != nil {
+			fmt.Println("❌ reflection:", err.Error())
+			reflectionDone(agent.ID, 0, err)
+			return
+		}
+
+		reflectingMutex.Lock()
+		state.pending = len(memories)
+		state.pendingKnown = true
+		reflectingMutex.Unlock()
+
+		if len(memories) < threshold {
+			return
+		}
+
+		_, err = reflectOnMemories(ctx, agent, collection, memories)
+		if err != nil {
+			fmt.Println("❌ reflection:", err.Error())
+		}
+		reflectionDone(agent.ID, len(memories), err)
+	}()
+}
+
+// Updates agent's reflection state once it reflected on given number
+// of memories, or failed to (err not nil)
+func reflectionDone(agentID string, memories int, err error) {
+	reflectingMutex.Lock()
+	defer reflectingMutex.Unlock()
+
+	state := reflectionStates[agentID]
+	if state == nil {
+		state = &reflectionState{}
+		reflectionStates[agentID] = state
+	}
+
+	if err != nil {
+		backoff := REFLECTION_RETRY_BACKOFF << min(state.failures, 10)
+		state.failures++
+		state.retryAt = time.Now().Add(min(backoff, REFLECTION_MAX_RETRY_BACKOFF))
+		return
+	}
+
+	state.failures = 0
+	state.retryAt = time.Time{}
+	// memories stored while reflecting remain pending
+	state.pending = max(state.pending-memories, 0)
+}
+
+func startReflecting(agentID string) bool {
+	reflectingMutex.Lock()
+	defer reflectingMutex.Unlock()
+	if reflecting[agentID] {
+		return false
+	}
+	reflecting[agentID] = true
+	return true
+}
+
+func stopReflecting(agentID string) {
+	reflectingMutex.Lock()
+	defer reflectingMutex.Unlock()
+	delete(reflecting, agentID)
+}
+
+// Position of a memory in creation order,
+// memories created at the same time are ordered by ID
+type memoryCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+func memoryCursorOf(m Memory) memoryCursor {
+	return memoryCursor{createdAt: m.CreatedAt, id: m.ID}
+}
+
+func (c memoryCursor) before(other memoryCursor) bool {
+	if c.createdAt.Equal(other.createdAt) {
+		return c.id < other.id
+	}
+	return c.createdAt.Before(other.createdAt)
+}
+
+// Returns cursor of the last memory considered by reflection
+func reflectionCursor(reflection Memory) memoryCursor {
+	if f, ok := whereFloat(reflection.Metadata[MEMORY_REFLECTED_UNTIL]); ok {
+		id, _ := reflection.Metadata[MEMORY_REFLECTED_UNTIL_ID].(string)
+		return memoryCursor{createdAt: timeFromUnixSeconds(f), id: id}
+	}
+	// reflections stored without cursor are dated like their last memory,
+	// in seconds: memories from that second have been considered
+	end := reflection.CreatedAt.Truncate(time.Second).Add(time.Second - time.Microsecond)
+	return memoryCursor{createdAt: end}
+}
+
+// Returns memories (other than reflections) created after the last memory
+// considered by agent's last reflection, sorted by creation time.
+// Memories with no creation time are ignored.
+func memoriesSinceLastReflection(ctx context.Context, collection MemoryCollection) ([]Memory, error) {
+	entries, err := collection.Get(ctx, ChromaCollectionGet{
+		Where:   WhereField{Name: MEMORY_KIND, Operator: Equal, Value: MEMORY_KIND_REFLECTION},
+		Include: []string{INCLUDE_METADATAS},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var last memoryCursor
+	for _, m := range memoriesFromEntries(entries) {
+		if cursor := reflectionCursor(m); last.before(cursor) {
+			last = cursor
+		}
+	}
+
+	// memories created at the same time as the last
+	// considered one are filtered using their ID
+	entries, err = collection.Get(ctx, ChromaCollectionGet{
+		Where: WhereAnd{Entries: []Where{
+			WhereField{Name: MEMORY_KIND, Operator: NotEqual, Value: MEMORY_KIND_REFLECTION},
+			WhereField{Name: MEMORY_CREATED_AT, Operator: GreaterThanOrEqual, Value: unixSeconds(last.createdAt)},
+		}},
+		Include: []string{INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	memories := make([]Memory, 0, len(entries))
+	for _, m := range memoriesFromEntries(entries) {
+		if m.CreatedAt.IsZero() == false && last.before(memoryCursorOf(m)) {
+			memories = append(memories, m)
+		}
+	}
+	sort.Slice(memories, func(i, j int) bool {
+		return memoryCursorOf(memories[i]).before(memoryCursorOf(memories[j]))
+	})
+
+	return memories, nil
+}
+
+// Asks agent's model for insights about given memories, and stores them.
+// Returns stored reflections.
+func reflectOnMemories(ctx context.Context, agent *Agent, collection MemoryCollection, memories []Memory) ([]Memory, error) {
+	if len(memories) == 0 {
+		return nil, errors.New("no memories to reflect on")
+	}
+	if len(memories) > MAX_REFLECTION_MEMORIES {
+		memories = memories[len(memories)-MAX_REFLECTION_MEMORIES:]
+	}
+
+	now := time.Now()
+
+	// reflections record the last memory they consider, memories
+	// stored while reflecting are left for the next reflection
+	// (see memoriesSinceLastReflection)
+	last := memories[len(memories)-1]
+
+	list := ""
+	for i, m := range memories {
+		list += strconv.Itoa(i+1) + ". " + strings.TrimPrefix(m.promptLine(now, nil), "- ")
+	}
+
+	prompt := fmt.Sprintf(reflection_prompt_format, agent.Name, list, config.Memory.Reflection.MaxInsights)
+
+	text, err := generate(ctx, agent, prompt, "json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var r reflectionResponse
+	err = json.Unmarshal([]byte(text), &r)
+	if err != nil {
+		return nil, errors.New("invalid JSON response: " + err.Error())
+	}
+
+	// models may repeat an insight: IDs are derived from documents,
+	// repeated insights are merged (Chroma rejects duplicate IDs)
+	reflections := make([]Memory, 0, len(r.Insights))
+	indexes := make(map[string]int) // in reflections, by ID
+
+	for _, insight := range r.Insights {
+		document := strings.TrimSpace(insight.Insight)
+		if document == "" {
+			continue
+		}
+
+		sources := make([]string, 0, len(insight.Sources))
+		for _, n := range insight.Sources {
+			// models may refer to memories that don't exist
+			if n >= 1 && n <= len(memories) {
+				sources = append(sources, memories[n-1].ID)
+			}
+		}
+
+		hash := md5.New()
+		io.WriteString(hash, MEMORY_KIND_REFLECTION+document)
+		id := hex.EncodeToString(hash.Sum(nil))
+
+		if i, exists := indexes[id]; exists {
+			reflections[i].Sources = mergeSources(reflections[i].Sources, sources)
+			continue
+		}
+		if len(reflections) >= config.Memory.Reflection.MaxInsights {
+			break
+		}
+
+		indexes[id] = len(reflections)
+		reflections = append(reflections, Memory{
+			ID:        id,
+			Document:  document,
+			CreatedAt: now,
+			GameTime:  last.GameTime, // game's clock is only known from memories
+			AgentID:   agent.ID,
+			Kind:      MEMORY_KIND_REFLECTION,
+			Sources:   mergeSources(nil, sources),
+			Metadata: map[string]any{
+				MEMORY_REFLECTED_UNTIL:    unixSeconds(last.CreatedAt),
+				MEMORY_REFLECTED_UNTIL_ID: last.ID,
+			},
+		})
+	}
+
+	if len(reflections) == 0 {
+		return nil, errors.New("model didn't provide any insight")
+	}
+
+	// same insight as a previous reflection: its sources are kept
+	ids := make([]string, len(reflections))
+	for i, reflection := range reflections {
+		ids[i] = reflection.ID
+	}
+	existing, err := collection.Get(ctx, ChromaCollectionGet{
+		IDs:     ids,
+		Include: []string{INCLUDE_METADATAS},
+	})
+	if err != nil {
+		return nil, err
+	}
+	rated := make(map[string]int)
+	for _, m := range memoriesFromEntries(existing) {
+		i := indexes[m.ID]
+		reflections[i].Sources = mergeSources(m.Sources, reflections[i].Sources)
+		rated[m.ID] = m.Importance
+	}
+
+	entries := make([]ChromaCollectionEntry, 0, len(reflections))
+
+	for i := range reflections {
+		reflection := &reflections[i]
+
+		embedding, err := embedder.Embed(ctx, reflection.Document)
+		if err != nil {
+			return nil, err
+		}
+
+		reflection.Importance = rated[reflection.ID]
+		if config.Memory.RateImportance && reflection.Importance == 0 {
+			reflection.Importance, err = rateImportance(ctx, agent, reflection.Document)
+			if err != nil {
+				fmt.Println("⚠️ can't rate reflection importance:", err.Error())
+			}
+		}
+
+		entries = append(entries, ChromaCollectionEntry{
+			ID:        reflection.ID,
+			Embedding: &embedding,
+			Document:  reflection.Document,
+			Metadatas: reflection.metadata(),
+		})
+	}
+
+	err = collection.Upsert(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Debug {
+		fmt.Println("💭 Agent", agent.Name, "reflected:")
+		for _, reflection := range reflections {
+			fmt.Println("-", reflection.Document)
+		}
+	}
+
+	return reflections, nil
+}
+
+// Returns sources followed by added ones, without duplicates
+func mergeSources(sources []string, added []string) []string {
+	merged := make([]string, 0, len(sources)+len(added))
+	seen := make(map[string]bool)
+	for _, list := range [][]string{sources, added} {
+		for _, id := range list {
+			if seen[id] == false {
+				seen[id] = true
+				merged = append(merged, id)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Collection rejecting upserts with duplicate IDs, like Chroma
+type uniqueUpsertCollection struct {
+	MemoryCollection
+}
+
+func (c uniqueUpsertCollection) Upsert(ctx context.Context, entries []ChromaCollectionEntry) error {
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		if ids[entry.ID] {
+			return fmt.Errorf("%w: duplicate ID %s", ErrInvalidArgument, entry.ID)
+		}
+		ids[entry.ID] = true
+	}
+	return c.MemoryCollection.Upsert(ctx, entries)
+}
+
+func TestMemoriesSinceLastReflection(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// memories stored in the same second
+	second := time.Unix(1700000000, 0)
+	add := func(memories ...Memory) {
+		t.Helper()
+		documents := make([]string, len(memories))
+		for i, m := range memories {
+			documents[i] = m.Document
+		}
+		entries := hashEmbeddedEntries(t, documents...)
+		for i, m := range memories {
+			if m.Kind == "" {
+				m.Kind = MEMORY_KIND_CONVERSATION
+			}
+			entries[i].ID = m.ID
+			entries[i].Metadatas = m.metadata()
+		}
+		err := collection.Add(ctx, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	since := func(want ...string) {
+		t.Helper()
+		memories, err := memoriesSinceLastReflection(ctx, collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(memories))
+		for i, m := range memories {
+			got[i] = m.ID
+		}
+		if len(want) == 0 {
+			want = []string{}
+		}
+		if reflect.DeepEqual(got, want) == false {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	add(
+		Memory{ID: "b", Document: "alice sells apples", CreatedAt: second.Add(100 * time.Millisecond)},
+		Memory{ID: "a", Document: "alice likes swords", CreatedAt: second},
+	)
+	since("a", "b")
+
+	// reflecting on "a" only
+	add(Memory{
+		ID:        "r1",
+		Document:  "alice is a merchant",
+		Kind:      MEMORY_KIND_REFLECTION,
+		CreatedAt: second.Add(time.Hour),
+		Metadata: map[string]any{
+			MEMORY_REFLECTED_UNTIL:    unixSeconds(second),
+			MEMORY_REFLECTED_UNTIL_ID: "a",
+		},
+	})
+	since("b")
+
+	// same time as the last considered memory, ordered by ID
+	add(
+		Memory{ID: "c", Document: "alice left the market", CreatedAt: second},
+		Memory{ID: "0", Document: "alice came back", CreatedAt: second},
+	)
+	since("c", "b")
+
+	// reflections stored without cursor considered their whole second
+	add(Memory{ID: "r2", Document: "alice travels", Kind: MEMORY_KIND_REFLECTION, CreatedAt: second})
+	since()
+}
+
+func TestReflectOnMemories(t *testing.T) {
+	generator := &stubGenerator{}
+	setupTestAPI(t, generator)
+	config.Memory.Reflection.MaxInsights = 2
+	ctx := context.Background()
+	agent := &Agent{ID: "bob", Name: "Bob"}
+
+	c, err := memoryStore.GetCollection(ctx, agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := uniqueUpsertCollection{c}
+
+	start := time.Unix(1700000000, 0)
+	memories := []Memory{
+		{ID: "m1", Document: "Alice said: apples for sale!", CreatedAt: start},
+		{ID: "m2", Document: "Alice said: swords for sale!", CreatedAt: start.Add(time.Minute)},
+		{ID: "m3", Document: "Mayor said: pay your taxes", CreatedAt: start.Add(2 * time.Minute)},
+	}
+
+	reflectOn := func(response string) ([]Memory, error) {
+		t.Helper()
+		generator.chunks = []string{response}
+		generator.prompts = nil
+		return reflectOnMemories(ctx, agent, collection, memories)
+	}
+
+	// stored reflections, by document
+	stored := func() map[string]Memory {
+		t.Helper()
+		entries, err := collection.Get(ctx, ChromaCollectionGet{
+			Where:   WhereField{Name: MEMORY_KIND, Operator: Equal, Value: MEMORY_KIND_REFLECTION},
+			Include: []string{INCLUDE_DOCUMENTS, INCLUDE_METADATAS},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reflections := make(map[string]Memory)
+		for _, m := range memoriesFromEntries(entries) {
+			reflections[m.Document] = m
+		}
+		return reflections
+	}
+
+	for _, response := range []string{`{"insights": [`, `{"insights": [{"insight": " "}]}`} {
+		_, err = reflectOn(response)
+		if err == nil {
+			t.Errorf("%s: expected error", response)
+		}
+	}
+
+	// repeated insights are merged, sources out of range are
+	// ignored, insights after MaxInsights are dropped
+	reflections, err := reflectOn(`{"insights": [
+		{"insight": "Alice is a merchant", "sources": [1, 7, 0]},
+		{"insight": " Alice is a merchant ", "sources": [2, 1]},
+		{"insight": "Bob distrusts the mayor", "sources": [3]},
+		{"insight": "Taxes are high", "sources": [3]}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reflections) != 2 {
+		t.Fatalf("got %d reflections, want 2", len(reflections))
+	}
+
+	prompt := generator.prompts[0]
+	for _, want := range []string{"You're Bob", "1. ", "Alice said: apples for sale!", "3. ", "Mayor said: pay your taxes", "the 2 most salient"} {
+		if strings.Contains(prompt, want) == false {
+			t.Errorf("prompt doesn't include %q:\n%s", want, prompt)
+		}
+	}
+
+	got := stored()
+	want := map[string][]string{
+		"Alice is a merchant":     {"m1", "m2"},
+		"Bob distrusts the mayor": {"m3"},
+	}
+	if len(got) != len(want) {
+		t.Errorf("got reflections %v, want %v", got, want)
+	}
+	for document, sources := range want {
+		m := got[document]
+		if reflect.DeepEqual(m.Sources, sources) == false {
+			t.Errorf("%q: sources %v, want %v", document, m.Sources, sources)
+		}
+		if m.AgentID != agent.ID || m.CreatedAt.IsZero() {
+			t.Errorf("%q: agent %q, created at %v", document, m.AgentID, m.CreatedAt)
+		}
+		// last considered memory
+		if cursor := reflectionCursor(m); cursor.id != "m3" || cursor.createdAt.Equal(memories[2].CreatedAt) == false {
+			t.Errorf("%q: reflected until %v, want m3", document, cursor)
+		}
+	}
+
+	// same insight later, earlier sources are kept
+	memories = []Memory{{ID: "m4", Document: "Alice said: pears for sale!", CreatedAt: start.Add(time.Hour)}}
+	_, err = reflectOn(`{"insights": [{"insight": "Alice is a merchant", "sources": [1]}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = stored()
+	if sources := got["Alice is a merchant"].Sources; reflect.DeepEqual(sources, []string{"m1", "m2", "m4"}) == false {
+		t.Errorf("sources %v, want [m1 m2 m4]", sources)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d reflections, want 2", len(got))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// Version of the agents file format.
+	// Bump it when making non backward compatible changes to Agent,
+	// and add a migration step in loadAgents.
+	AGENTS_SCHEMA_VERSION = 2
+)
+
+type agentsFile struct {
+	Version int               `json:"version"`
+	Agents  map[string]*Agent `json:"agents"`
+}
+
+// Loads agents from file at given path.
+// Returns an empty map if the file doesn't exist yet.
+func loadAgents(path string) (map[string]*Agent, error) {
+	agents := make(map[string]*Agent)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return agents, nil
+		}
+		return nil, err
+	}
+
+	var f agentsFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, errors.New("can't parse " + path + ": " + err.Error())
+	}
+
+	if f.Version > AGENTS_SCHEMA_VERSION {
+		return nil, errors.New("unsupported agents file version: " + strconv.Itoa(f.Version))
+	}
+
+	for id, agent := range f.Agents {
+		if agent == nil {
+			continue
+		}
+		// migrations from older versions
+		if f.Version < 2 {
+			// version 1 doesn't tell if behavior code was set when the agent
+			// was created or added later with PATCH, so agents don't update it
+			agent.BehaviorCodeUpdates = false
+		}
+		// ID is the map key, make sure both are in sync
+		agent.ID = id
+		agents[id] = agent
+	}
+
+	return agents, nil
+}
+
+// Writes agents to file at given path.
+func saveAgents(path string, agents map[string]*Agent) error {
+	data, err := json.MarshalIndent(agentsFile{
+		Version: AGENTS_SCHEMA_VERSION,
+		Agents:  agents,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(path, data)
+	if err != nil {
+		return err
+	}
+
+	if config.Debug {
+		fmt.Println("💾 Agents saved (" + strconv.Itoa(len(agents)) + ")")
+	}
+
+	return nil
+}
+
+// Writes data to a temporary file first, then renames it,
+// so the file is never left half-written if the server crashes.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
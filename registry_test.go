@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveLoadAgents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+
+	// file doesn't exist yet
+	loaded, err := loadAgents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 0 {
+		t.Errorf("got %v, want no agents", loaded)
+	}
+
+	agents := map[string]*Agent{
+		"bob":   {ID: "bob", Name: "Bob", System: "You sell swords."},
+		"alice": {ID: "alice", Name: "Alice"},
+	}
+	err = saveAgents(path, agents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err = loadAgents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(loaded, agents) == false {
+		t.Errorf("got %v, want %v", loaded, agents)
+	}
+
+	// no temporary file left behind
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files, want 1", len(files))
+	}
+}
+
+func TestLoadAgentsFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		agents map[string]*Agent // nil when loading fails
+	}{
+		{
+			"IDs are keys",
+			`{"version": 1, "agents": {"bob": {"id": "robert", "name": "Bob"}, "none": null}}`,
+			map[string]*Agent{"bob": {ID: "bob", Name: "Bob"}},
+		},
+		{"newer version", `{"version": 1000, "agents": {}}`, nil},
+		{"invalid JSON", `{"version": 1, "agents": [`, nil},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "agents.json")
+		err := os.WriteFile(path, []byte(test.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		agents, err := loadAgents(path)
+		if test.agents == nil {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if reflect.DeepEqual(agents, test.agents) == false {
+			t.Errorf("%s: got %v, want %v", test.name, agents, test.agents)
+		}
+	}
+}
+
+func TestLoadAgentsV1(t *testing.T) {
+	agents, err := loadAgents(filepath.Join("testdata", "agents_v1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// behavior code may have been added with PATCH, agents don't update it
+	want := map[string]*Agent{
+		"bob": {
+			ID:           "bob",
+			Name:         "Bob",
+			System:       "You're the village blacksmith.",
+			BehaviorCode: "follow(nil)",
+		},
+		"alice": {ID: "alice", Name: "Alice"},
+	}
+	if reflect.DeepEqual(agents, want) == false {
+		t.Errorf("got %v, want %v", agents, want)
+	}
+}
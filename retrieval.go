@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Memory retrieval, inspired by "Generative Agents" (Park et al. 2023):
+// memories are over-fetched by vector distance, then reranked with
+// a score combining relevance, recency and importance.
+
+const (
+	MIN_IMPORTANCE     = 1
+	MAX_IMPORTANCE     = 10
+	DEFAULT_IMPORTANCE = 5 // for memories stored before importance was rated
+
+	// memories rated at the same time, in the background (see rateMemoryImportance)
+	MAX_IMPORTANCE_RATINGS    = 4
+	IMPORTANCE_RATING_TIMEOUT = time.Minute
+
+	importance_prompt_format = `On a scale of 1 to 10, where 1 is purely mundane (e.g., small talk, greetings)
+and 10 is extremely poignant (e.g., a betrayal, a death, a life-changing promise),
+rate the likely poignancy of the following memory for %s.
+Respond with a single number.
+
+Memory:
+%s
+`
+)
+
+// Retrieval settings, defined in config (memory.retrieval)
+// and optionally overridden per agent (see RetrievalOverrides).
+type RetrievalSettings struct {
+	// number of memories included in prompts
+	Results int `json:"results" yaml:"results"`
+	// Results * OverFetch memories are fetched by distance before reranking
+	OverFetch int `json:"over-fetch" yaml:"over-fetch"`
+	// score weights
+	Relevance  float64 `json:"relevance" yaml:"relevance"`
+	Recency    float64 `json:"recency" yaml:"recency"`
+	Importance float64 `json:"importance" yaml:"importance"`
+	// recency is halved every RecencyHalfLife hours
+	// (game hours when the game provides game time)
+	RecencyHalfLife float64 `json:"recency-half-life" yaml:"recency-half-life"`
+}
+
+// Retrieval settings overridden by an agent, nil fields use config's
+// values. Only overridden fields are saved with the agent, so config
+// changes apply to the others.
+type RetrievalOverrides struct {
+	Results         *int     `json:"results,omitempty"`
+	OverFetch       *int     `json:"over-fetch,omitempty"`
+	Relevance       *float64 `json:"relevance,omitempty"`
+	Recency         *float64 `json:"recency,omitempty"`
+	Importance      *float64 `json:"importance,omitempty"`
+	RecencyHalfLife *float64 `json:"recency-half-life,omitempty"`
+}
+
+// Returns settings with overridden fields replaced
+func (o RetrievalOverrides) apply(settings RetrievalSettings) RetrievalSettings {
+	if o.Results != nil {
+		settings.Results = *o.Results
+	}
+	if o.OverFetch != nil {
+		settings.OverFetch = *o.OverFetch
+	}
+	if o.Relevance != nil {
+		settings.Relevance = *o.Relevance
+	}
+	if o.Recency != nil {
+		settings.Recency = *o.Recency
+	}
+	if o.Importance != nil {
+		settings.Importance = *o.Importance
+	}
+	if o.RecencyHalfLife != nil {
+		settings.RecencyHalfLife = *o.RecencyHalfLife
+	}
+	return settings
+}
+
+// Validates settings resulting from overrides, with current config
+func (o RetrievalOverrides) validate() error {
+	return o.apply(config.Memory.Retrieval).validate()
+}
+
+func (s RetrievalSettings) validate() error {
+	if s.Results < 1 || s.OverFetch < 1 {
+		return fmt.Errorf("%w: retrieval results and over-fetch should be positive", ErrInvalidArgument)
+	}
+	if s.Relevance < 0 || s.Recency < 0 || s.Importance < 0 {
+		return fmt.Errorf("%w: retrieval weights can't be negative", ErrInvalidArgument)
+	}
+	if s.Relevance+s.Recency+s.Importance == 0 {
+		return fmt.Errorf("%w: at least one retrieval weight should be positive", ErrInvalidArgument)
+	}
+	if s.RecencyHalfLife <= 0 {
+		return fmt.Errorf("%w: retrieval recency-half-life should be positive", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// Returns agent's retrieval settings, config's when not overridden
+func agentRetrieval(agent *Agent) RetrievalSettings {
+	if agent.Retrieval != nil {
+		return agent.Retrieval.apply(config.Memory.Retrieval)
+	}
+	return config.Memory.Retrieval
+}
+
+// Returns memories relevant to given embedding, best ones first.
+// Reflections (up to config.Memory.Reflection.Results) come first,
+// they're queried separately so they're not crowded out by raw memories.
+func recallMemories(ctx context.Context, agent *Agent, collection MemoryCollection, embedding []float64, now time.Time, gameTime *float64) ([]Memory, error) {
+	filter, err := agentMemoryFilter(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	retrieval := agentRetrieval(agent)
+
+	// over-fetching, memories are then reranked
+	entries, err := collection.Query(ctx, ChromaCollectionQuery{
+		Embeddings:    [][]float64{embedding},
+		NResults:      retrieval.Results * retrieval.OverFetch,
+		Where:         filter.Where,
+		WhereDocument: filter.WhereDocument,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	memories := make([]Memory, 0, len(entries))
+	for _, m := range memoriesFromEntries(entries) {
+		if m.Kind != MEMORY_KIND_REFLECTION {
+			memories = append(memories, m)
+		}
+	}
+
+	var reflections []Memory
+	nReflections := min(config.Memory.Reflection.Results, retrieval.Results)
+	if nReflections > 0 {
+		var where Where = WhereField{Name: MEMORY_KIND, Operator: Equal, Value: MEMORY_KIND_REFLECTION}
+		if filter.Where != nil {
+			where = WhereAnd{Entries: []Where{filter.Where, where}}
+		}
+		entries, err = collection.Query(ctx, ChromaCollectionQuery{
+			Embeddings:    [][]float64{embedding},
+			NResults:      nReflections * retrieval.OverFetch,
+			Where:         where,
+			WhereDocument: filter.WhereDocument,
+		})
+		if err != nil {
+			return nil, err
+		}
+		settings := retrieval
+		settings.Results = nReflections
+		reflections = rankMemories(memoriesFromEntries(entries), settings, now, gameTime)
+	}
+
+	settings := retrieval
+	settings.Results = retrieval.Results - len(reflections)
+	return append(reflections, rankMemories(memories, settings, now, gameTime)...), nil
+}
+
+// Scores memories (setting their Score), returning the best ones,
+// sorted by decreasing score.
+// Each component is min-max normalized across candidates, so weights
+// don't depend on the distance function or on the age of memories.
+func rankMemories(memories []Memory, settings RetrievalSettings, now time.Time, gameTime *float64) []Memory {
+	if len(memories) == 0 {
+		return memories
+	}
+
+	relevance := make([]float64, len(memories))
+	recency := make([]float64, len(memories))
+	importance := make([]float64, len(memories))
+
+	for i, m := range memories {
+		// lower distance means more relevant
+		relevance[i] = -m.Distance
+
+		age, known := m.age(now, gameTime)
+		if known {
+			hours := math.Max(age.Hours(), 0)
+			recency[i] = math.Pow(0.5, hours/settings.RecencyHalfLife)
+		}
+
+		importance[i] = float64(m.importanceOrDefault())
+	}
+
+	normalize(relevance)
+	normalize(recency)
+	normalize(importance)
+
+	for i := range memories {
+		memories[i].Score = settings.Relevance*relevance[i] +
+			settings.Recency*recency[i] +
+			settings.Importance*importance[i]
+	}
+
+	sort.SliceStable(memories, func(i, j int) bool {
+		return memories[i].Score > memories[j].Score
+	})
+
+	if len(memories) > settings.Results {
+		memories = memories[:settings.Results]
+	}
+
+	return memories
+}
+
+// Min-max normalization, in place.
+// Values are all set to 1 when they're all the same.
+func normalize(values []float64) {
+	lowest, highest := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lowest = math.Min(lowest, v)
+		highest = math.Max(highest, v)
+	}
+	for i, v := range values {
+		if highest == lowest {
+			values[i] = 1
+		} else {
+			values[i] = (v - lowest) / (highest - lowest)
+		}
+	}
+}
+
+// a single number, optionally followed by a period ("7", "7.")
+var importanceRegexp = regexp.MustCompile(`^\s*(\d+)\.?\s*$`)
+
+// memories being rated, one token per rating
+var importanceRatings = make(chan struct{}, MAX_IMPORTANCE_RATINGS)
+
+// Asks agent's model to rate memory importance (1 to 10)
+func rateImportance(ctx context.Context, agent *Agent, memory string) (int, error) {
+	prompt := fmt.Sprintf(importance_prompt_format, agent.Name, memory)
+
+	text, err := generate(ctx, agent, prompt, "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return parseImportance(text)
+}
+
+// Parses importance rated by a model. Responses that are not a single
+// number between 1 and 10 are rejected ("1 to 10" is not a rating).
+func parseImportance(text string) (int, error) {
+	match := importanceRegexp.FindStringSubmatch(text)
+	if match == nil {
+		return 0, errors.New("can't find importance in response: " + text)
+	}
+
+	importance, err := strconv.Atoi(match[1])
+	if err != nil || importance < MIN_IMPORTANCE || importance > MAX_IMPORTANCE {
+		return 0, errors.New("importance out of range in response: " + text)
+	}
+
+	return importance, nil
+}
+
+// Rates importance of a stored memory in the background, then updates
+// its metadata. Memories are stored unrated first, answers are not delayed.
+// Up to MAX_IMPORTANCE_RATINGS memories are rated at a time, others
+// keep the default importance.
+func rateMemoryImportance(agent *Agent, collection MemoryCollection, m Memory) {
+	select {
+	case importanceRatings <- struct{}{}:
+	default:
+		fmt.Println("⚠️ too many memories being rated, memory keeps default importance")
+		return
+	}
+
+	go func() {
+		defer func() { <-importanceRatings }()
+
+		// not using request's context, canceled once agent responded
+		ctx, cancel := context.WithTimeout(context.Background(), IMPORTANCE_RATING_TIMEOUT)
+		defer cancel()
+
+		importance, err := rateImportance(ctx, agent, m.Document)
+		if err != nil {
+			// memory keeps default importance
+			fmt.Println("⚠️ can't rate memory importance:", err.Error())
+			return
+		}
+
+		m.Importance = importance
+		err = collection.Update(ctx, []ChromaCollectionEntry{
+			{ID: m.ID, Metadatas: m.metadata()},
+		})
+		if err != nil {
+			fmt.Println("⚠️ can't store memory importance:", err.Error())
+		}
+	}()
+}
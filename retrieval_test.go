@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   []float64
+	}{
+		{[]float64{}, []float64{}},
+		{[]float64{3}, []float64{1}},
+		{[]float64{2, 2, 2}, []float64{1, 1, 1}},
+		{[]float64{0, 0}, []float64{1, 1}},
+		{[]float64{1, 3, 2}, []float64{0, 1, 0.5}},
+		{[]float64{-4, 0, -2}, []float64{0, 1, 0.5}},
+	}
+
+	for _, test := range tests {
+		values := append([]float64(nil), test.values...)
+		normalize(values)
+		if len(values) != len(test.want) {
+			t.Errorf("normalize(%v) = %v, want %v", test.values, values, test.want)
+			continue
+		}
+		for i := range values {
+			if values[i] != test.want[i] {
+				t.Errorf("normalize(%v) = %v, want %v", test.values, values, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRankMemories(t *testing.T) {
+	now := time.Now()
+	settings := RetrievalSettings{
+		Results:         10,
+		OverFetch:       1,
+		Relevance:       1,
+		Recency:         1,
+		Importance:      1,
+		RecencyHalfLife: 24,
+	}
+	only := func(relevance, recency, importance float64) RetrievalSettings {
+		s := settings
+		s.Relevance, s.Recency, s.Importance = relevance, recency, importance
+		return s
+	}
+
+	// close, old & mundane / far, recent & mundane / far, old & poignant
+	memories := []Memory{
+		{ID: "close", Distance: 0.1, CreatedAt: now.Add(-72 * time.Hour), Importance: 1},
+		{ID: "recent", Distance: 0.9, CreatedAt: now.Add(-time.Minute), Importance: 1},
+		{ID: "poignant", Distance: 0.9, CreatedAt: now.Add(-72 * time.Hour), Importance: 10},
+	}
+
+	tests := []struct {
+		name     string
+		settings RetrievalSettings
+		ids      []string
+	}{
+		{"relevance", only(1, 0, 0), []string{"close", "recent", "poignant"}},
+		{"recency", only(0, 1, 0), []string{"recent", "close", "poignant"}},
+		{"importance", only(0, 0, 1), []string{"poignant", "close", "recent"}},
+		{"relevance & recency", only(2, 1, 0), []string{"close", "recent", "poignant"}},
+		{"recency & importance", only(0, 1, 2), []string{"poignant", "recent", "close"}},
+		{"results", func() RetrievalSettings { s := only(0, 1, 0); s.Results = 2; return s }(), []string{"recent", "close"}},
+	}
+
+	for _, test := range tests {
+		ranked := rankMemories(append([]Memory(nil), memories...), test.settings, now, nil)
+		ids := make([]string, len(ranked))
+		for i, m := range ranked {
+			ids[i] = m.ID
+		}
+		if reflect.DeepEqual(ids, test.ids) == false {
+			t.Errorf("%s: got %v, want %v", test.name, ids, test.ids)
+		}
+		for i := 1; i < len(ranked); i++ {
+			if ranked[i].Score > ranked[i-1].Score {
+				t.Errorf("%s: memories not sorted by score: %v", test.name, ranked)
+				break
+			}
+		}
+	}
+}
+
+// Unrated memories use DEFAULT_IMPORTANCE, and equal values
+// don't change the order given by other criteria.
+func TestRankMemoriesEqualValues(t *testing.T) {
+	now := time.Now()
+	settings := RetrievalSettings{Results: 10, OverFetch: 1, Relevance: 1, Recency: 1, Importance: 1, RecencyHalfLife: 24}
+
+	memories := []Memory{
+		{ID: "far", Distance: 0.8, CreatedAt: now.Add(-time.Hour)},
+		{ID: "close", Distance: 0.2, CreatedAt: now.Add(-time.Hour), Importance: DEFAULT_IMPORTANCE},
+	}
+
+	ranked := rankMemories(memories, settings, now, nil)
+	if ranked[0].ID != "close" || ranked[1].ID != "far" {
+		t.Fatalf("got %s, %s, want close, far", ranked[0].ID, ranked[1].ID)
+	}
+	// relevance: 1 & 0, recency & importance: all 1
+	if ranked[0].Score != 3 || ranked[1].Score != 2 {
+		t.Errorf("scores: %v & %v, want 3 & 2", ranked[0].Score, ranked[1].Score)
+	}
+}
+
+func TestParseImportance(t *testing.T) {
+	tests := []struct {
+		text string
+		want int // 0 when invalid
+	}{
+		{"7", 7},
+		{" 10.\n", 10},
+		{"1", 1},
+		{"0", 0},
+		{"11", 0},
+		{"1 to 10", 0},
+		{"On a scale of 1 to 10: 8", 0},
+		{"seven", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		got, err := parseImportance(test.text)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("parseImportance(%q) = %d, expected error", test.text, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseImportance(%q): %s", test.text, err.Error())
+		} else if got != test.want {
+			t.Errorf("parseImportance(%q) = %d, want %d", test.text, got, test.want)
+		}
+	}
+}
+
+func TestRetrievalOverrides(t *testing.T) {
+	var overrides RetrievalOverrides
+	err := json.Unmarshal([]byte(`{"results": 3, "recency": 0}`), &overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only overridden fields are saved
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"results":3,"recency":0}`; string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+
+	settings := RetrievalSettings{Results: 10, OverFetch: 2, Relevance: 1, Recency: 1, Importance: 1, RecencyHalfLife: 24}
+	want := RetrievalSettings{Results: 3, OverFetch: 2, Relevance: 1, Recency: 0, Importance: 1, RecencyHalfLife: 24}
+	if got := overrides.apply(settings); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Number of extra attempts when the model returns invalid JSON,
+	// before falling back to plain text.
+	MAX_STRUCTURED_RETRIES = 2
+
+	structured_prompt_format = `
+Respond with a JSON object, using this schema:
+
+{
+  "say": string, // what you say out loud (can be empty if you only act)
+  "emotion": string, // one of: %s
+  "action": string, // optional, what you do (e.g. "wave", "walk", "attack", "give")%s
+  "target": string // optional, who or what the action is aimed at
+}
+`
+	structured_behavior_code_field = `
+  "behavior-code-update": string, // optional, complete updated behavior code, only if your behavior needs to change`
+)
+
+var (
+	emotions = []string{"neutral", "happy", "sad", "angry", "afraid", "surprised", "disgusted"}
+)
+
+// Response expected from the model in JSON mode
+type structuredResponse struct {
+	Say                string `json:"say"`
+	Emotion            string `json:"emotion,omitempty"`
+	Action             string `json:"action,omitempty"`
+	Target             string `json:"target,omitempty"`
+	BehaviorCodeUpdate string `json:"behavior-code-update,omitempty"`
+}
+
+// Returns instructions describing the JSON schema for given agent.
+// The behavior code field is only mentioned for agents updating their code.
+func structuredPrompt(agent *Agent) string {
+	behaviorCodeField := ""
+	if behaviorCodePrompt(agent, true) != "" {
+		behaviorCodeField = structured_behavior_code_field
+	}
+	return fmt.Sprintf(structured_prompt_format, strings.Join(emotions, ", "), behaviorCodeField)
+}
+
+// Parses and validates model response in JSON mode.
+// Unknown emotions are replaced by "neutral", it's not worth
+// asking the model again for that.
+func parseStructuredResponse(response string) (*structuredResponse, error) {
+	var r structuredResponse
+
+	// backends without JSON mode may wrap JSON in markdown blocks
+	err := json.Unmarshal([]byte(trimCodeFence(response)), &r)
+	if err != nil {
+		return nil, errors.New("invalid JSON response: " + err.Error())
+	}
+
+	r.Say = strings.TrimSpace(r.Say)
+	r.Action = strings.TrimSpace(r.Action)
+	r.Target = strings.TrimSpace(r.Target)
+	r.BehaviorCodeUpdate = strings.TrimSpace(r.BehaviorCodeUpdate)
+
+	if r.Say == "" && r.Action == "" {
+		return nil, errors.New("response should contain something to say or an action")
+	}
+
+	r.Emotion = strings.ToLower(strings.TrimSpace(r.Emotion))
+	if r.Emotion == "" {
+		r.Emotion = "neutral"
+	}
+	valid := false
+	for _, e := range emotions {
+		if e == r.Emotion {
+			valid = true
+			break
+		}
+	}
+	if valid == false {
+		r.Emotion = "neutral"
+	}
+
+	return &r, nil
+}
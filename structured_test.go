@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStructuredResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     *structuredResponse // nil when invalid
+	}{
+		{
+			"valid",
+			`{"say": " Hello! ", "emotion": "Happy", "action": "wave", "target": "alice"}`,
+			&structuredResponse{Say: "Hello!", Emotion: "happy", Action: "wave", Target: "alice"},
+		},
+		{
+			"behavior code update",
+			`{"say": "Follow me", "behavior-code-update": " follow(alice) "}`,
+			&structuredResponse{Say: "Follow me", Emotion: "neutral", BehaviorCodeUpdate: "follow(alice)"},
+		},
+		{
+			"action only",
+			`{"action": "attack", "target": "wolf"}`,
+			&structuredResponse{Emotion: "neutral", Action: "attack", Target: "wolf"},
+		},
+		{
+			"unknown emotion",
+			`{"say": "Hmm.", "emotion": "pensive"}`,
+			&structuredResponse{Say: "Hmm.", Emotion: "neutral"},
+		},
+		{
+			"fenced JSON",
+			"```json\n{\"say\": \"Hi\", \"emotion\": \"sad\"}\n```",
+			&structuredResponse{Say: "Hi", Emotion: "sad"},
+		},
+		{"nothing to say or do", `{"say": " ", "emotion": "happy"}`, nil},
+		{"missing fields", `{}`, nil},
+		{"not JSON", `Hello!`, nil},
+		{"truncated JSON", `{"say": "Hel`, nil},
+	}
+
+	for _, test := range tests {
+		got, err := parseStructuredResponse(test.response)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, expected error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if reflect.DeepEqual(got, test.want) == false {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Prompt templates (text/template), rendered with PromptData.
+// Built-in templates can be replaced, and new ones added, with *.tmpl files
+// in config.Prompts.Dir (named after the file, "guard.tmpl" -> "guard").
+// Agents pick a template by name, config.Prompts.Default otherwise.
+
+const (
+	DEFAULT_PROMPT_TEMPLATE = "default" // agents
+	CHAT_PROMPT_TEMPLATE    = "chat"    // chat CLI
+	PROMPT_TEMPLATE_EXT     = ".tmpl"
+
+	default_prompt_template = `You're game entity.
+Your name is {{.Agent.Name}}.
+You always give shortest possible answers, like when chatting on Discord. (never use emojis though)
+{{.Agent.System}}
+{{.BehaviorCode}}
+{{if .Location}}You're at {{.Location}}.
+{{end}}
+{{- if .World}}Current state of the world:
+{{range $key, $value := .World}}- {{$key}}: {{$value}}
+{{end}}
+{{end}}
+{{- if .Conversation}}Here's your conversation with {{.Sender}} so far (oldest first):
+
+{{range .Conversation}}{{.Sender}}: {{.Message}}
+You: {{.Answer}}
+{{if .Action}}(your action: {{.Action}}{{if .Target}}, {{.Target}}{{end}})
+{{end}}{{end}}
+{{end}}Here's a list of things you've heard from other entities (linked with your answers when relevant):
+
+{{range .Memories}}{{.Line}}{{end}}
+Here's a message from another entity ({{.Sender}}), what's your answer?
+
+{{.Message}}
+`
+
+	chat_prompt_template = `Using this data (provided by the user):
+{{range .Memories}}- {{.Document}}
+{{end}}
+Respond to this prompt:
+{{.Message}}`
+)
+
+var (
+	builtinPromptTemplates = map[string]string{
+		DEFAULT_PROMPT_TEMPLATE: default_prompt_template,
+		CHAT_PROMPT_TEMPLATE:    chat_prompt_template,
+	}
+
+	// loaded at startup, indexed by name
+	promptTemplates map[string]*PromptTemplate
+
+	promptTemplateFuncs = template.FuncMap{
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"trim":  strings.TrimSpace,
+	}
+)
+
+type PromptTemplate struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"` // empty for built-in templates
+	Text string `json:"text"`
+
+	template *template.Template
+}
+
+// Data available in prompt templates
+type PromptData struct {
+	Agent Agent `json:"agent"`
+	// behavior code section, with update instructions
+	// (empty for agents with no code)
+	BehaviorCode string `json:"behavior-code,omitempty"`
+	Sender       string `json:"sender,omitempty"`
+	Message      string `json:"message,omitempty"`
+	// provided by the game
+	ConversationID string         `json:"conversation-id,omitempty"`
+	Location       string         `json:"location,omitempty"`
+	World          map[string]any `json:"world,omitempty"`
+	// last exchanges with sender, oldest first
+	Conversation []ConversationTurn `json:"conversation,omitempty"`
+	// recalled memories, best first
+	Memories []PromptMemory `json:"memories,omitempty"`
+	Now      time.Time      `json:"now"`
+	GameTime *float64       `json:"game-time,omitempty"`
+}
+
+type PromptMemory struct {
+	Memory
+	// set when rendering
+	Line string `json:"-"` // e.g. "- (yesterday, at the tavern) Bob said: ...\n"
+	When string `json:"-"` // e.g. "yesterday", empty when unknown
+}
+
+func promptMemories(memories []Memory) []PromptMemory {
+	list := make([]PromptMemory, len(memories))
+	for i, m := range memories {
+		list[i] = PromptMemory{Memory: m}
+	}
+	return list
+}
+
+func parsePromptTemplate(name, text string) (*PromptTemplate, error) {
+	t, err := template.New(name).Funcs(promptTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidArgument, err.Error())
+	}
+	return &PromptTemplate{Name: name, Text: text, template: t}, nil
+}
+
+// Loads built-in templates, then templates from dir (if not empty)
+func loadPromptTemplates(dir string) (map[string]*PromptTemplate, error) {
+	templates := make(map[string]*PromptTemplate)
+
+	for name, text := range builtinPromptTemplates {
+		t, err := parsePromptTemplate(name, text)
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+
+	if dir == "" {
+		return templates, nil
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+PROMPT_TEMPLATE_EXT))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), PROMPT_TEMPLATE_EXT)
+		t, err := parsePromptTemplate(name, string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		t.File = file
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+// Returns prompt templates, sorted by name
+func sortedPromptTemplates() []*PromptTemplate {
+	list := make([]*PromptTemplate, 0, len(promptTemplates))
+	for _, t := range promptTemplates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Returns template with given name, config's default when name is empty
+func getPromptTemplate(name string) (*PromptTemplate, error) {
+	if name == "" {
+		name = config.Prompts.Default
+	}
+	t, exists := promptTemplates[name]
+	if exists == false {
+		return nil, fmt.Errorf("%w: unknown prompt template: %s", ErrNotFound, name)
+	}
+	return t, nil
+}
+
+// Returns an error if there's no template with given name.
+// Empty name is valid, it means default template.
+func checkPromptTemplate(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, exists := promptTemplates[name]; exists == false {
+		return fmt.Errorf("%w: unknown prompt template: %s", ErrInvalidArgument, name)
+	}
+	return nil
+}
+
+// Renders template, memory lines are built using data's time.
+// Execution errors are server errors (ErrServer): templates are parsed when
+// the server starts, data comes from agents and their memories.
+func (t *PromptTemplate) render(data PromptData) (string, error) {
+	memories := make([]PromptMemory, len(data.Memories))
+	for i, m := range data.Memories {
+		m.Line = m.promptLine(data.Now, data.GameTime)
+		m.When = ""
+		if age, known := m.age(data.Now, data.GameTime); known {
+			m.When = relativeTime(age)
+		}
+		memories[i] = m
+	}
+	data.Memories = memories
+
+	var b strings.Builder
+	err := t.template.Execute(&b, data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrServer, err.Error())
+	}
+	return b.String(), nil
+}
+
+// Data used to validate templates
+func samplePromptData() PromptData {
+	now := time.Now()
+	agent := Agent{
+		ID:                  "bob",
+		Name:                "Bob",
+		System:              "You're the village blacksmith, grumpy but fair.",
+		BehaviorCode:        "follow(nil)",
+		BehaviorCodeUpdates: true,
+	}
+	return PromptData{
+		Agent:          agent,
+		BehaviorCode:   behaviorCodePrompt(&agent, config.StructuredOutput),
+		Sender:         "Alice",
+		Message:        "Can you fix my sword before the tournament?",
+		ConversationID: "quest-42",
+		Location:       "the forge",
+		World:          map[string]any{"time-of-day": "evening", "weather": "rainy"},
+		Conversation: []ConversationTurn{
+			{Sender: "Alice", Message: "Hi Bob!", Answer: "What do you want?", CreatedAt: now.Add(-2 * time.Minute)},
+			{Sender: "Alice", Message: "Here, catch!", Answer: "Hey!", Action: "catch", Target: "sword", CreatedAt: now.Add(-time.Minute)},
+		},
+		Memories: promptMemories([]Memory{
+			{ID: "1", Document: "Alice seems to be in a hurry", Kind: MEMORY_KIND_REFLECTION, CreatedAt: now.Add(-time.Hour)},
+			{ID: "2", Document: "Alice said: the tournament is tomorrow\nYOUR ANSWER: Good luck.", Kind: MEMORY_KIND_CONVERSATION, CreatedAt: now.Add(-30 * time.Hour), Location: "the tavern"},
+		}),
+		Now: now,
+	}
+}
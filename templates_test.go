@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoadPromptTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"guard.tmpl":   "You guard {{.Location}}.",
+		"default.tmpl": "Custom default: {{.Message}}",
+		"notes.txt":    "{{ not a template",
+	}
+	for name, text := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	templates, err := loadPromptTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		file string
+		text string
+	}{
+		{"guard", filepath.Join(dir, "guard.tmpl"), files["guard.tmpl"]},
+		{DEFAULT_PROMPT_TEMPLATE, filepath.Join(dir, "default.tmpl"), files["default.tmpl"]},
+		{CHAT_PROMPT_TEMPLATE, "", chat_prompt_template},
+	}
+	for _, test := range tests {
+		tmpl, exists := templates[test.name]
+		if exists == false {
+			t.Errorf("%s: not loaded", test.name)
+			continue
+		}
+		if tmpl.File != test.file || tmpl.Text != test.text {
+			t.Errorf("%s: got file %q and text %q, want %q and %q", test.name, tmpl.File, tmpl.Text, test.file, test.text)
+		}
+	}
+	if len(templates) != len(tests) {
+		t.Errorf("got %d templates, want %d", len(templates), len(tests))
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{if .Message}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadPromptTemplates(dir)
+	if errors.Is(err, ErrInvalidArgument) == false || strings.Contains(err.Error(), "broken.tmpl") == false {
+		t.Errorf("broken template: got error %v, want %v mentioning the file", err, ErrInvalidArgument)
+	}
+
+	_, err = loadPromptTemplates(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Errorf("missing directory: got no error")
+	}
+}
+
+func TestValidatePromptTemplate(t *testing.T) {
+	previous := promptTemplates
+	defer func() { promptTemplates = previous }()
+	var err error
+	promptTemplates, err = loadPromptTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/prompt-templates/validate", validatePromptTemplate)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		prompt string // part of the rendered prompt
+	}{
+		{"text", `{"text":"Hi {{.Agent.Name}}, {{upper .Sender}} says: {{.Message}}"}`, http.StatusOK, "Hi Bob, ALICE says: Can you fix my sword"},
+		{"data", `{"text":"{{.Sender}}","data":{"sender":"Carl"}}`, http.StatusOK, "Carl"},
+		{"built-in", `{"name":"default"}`, http.StatusOK, "Your name is Bob."},
+		{"default", `{}`, http.StatusOK, "Your name is Bob."},
+		{"unknown name", `{"name":"nope"}`, http.StatusNotFound, ""},
+		{"parse error", `{"text":"{{.Agent.Name"}`, http.StatusBadRequest, ""},
+		{"unknown function", `{"text":"{{shout .Message}}"}`, http.StatusBadRequest, ""},
+		{"execution error", `{"text":"{{.Agent.Nope}}"}`, http.StatusBadRequest, ""},
+		{"invalid JSON", `{"text":`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/prompt-templates/validate", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d (%s)", test.name, w.Code, test.status, w.Body.String())
+			continue
+		}
+
+		var res struct {
+			Prompt string `json:"prompt"`
+			Tokens int    `json:"tokens"`
+			Error  string `json:"error"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.status != http.StatusOK {
+			if res.Error == "" {
+				t.Errorf("%s: got no error message", test.name)
+			}
+			continue
+		}
+		if strings.Contains(res.Prompt, test.prompt) == false {
+			t.Errorf("%s: got prompt %q, want it to contain %q", test.name, res.Prompt, test.prompt)
+		}
+		if res.Tokens != estimateTokens(res.Prompt) {
+			t.Errorf("%s: got %d tokens, want %d", test.name, res.Tokens, estimateTokens(res.Prompt))
+		}
+	}
+}
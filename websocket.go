@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	ollama "github.com/ollama/ollama/api"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebSocket protocol
+//
+// Clients connect to GET /ws. All messages, in both directions, are JSON
+// encoded WSMessage envelopes:
+//
+//	{ "type": "ask", "id": "42", "agent": "bob", "data": { "sender": "alice", "prompt": "hi" } }
+//
+// "id" is a correlation ID chosen by the client. The server copies it into
+// every message it sends in response to that request. Server-pushed events
+// don't have an ID.
+//
+// Client -> server:
+//   - "create-agent": data is an Agent. Responds with "agent" (new agent is selected).
+//   - "select-agent": "agent" is the agent ID. Responds with "agent".
+//     Selecting an agent subscribes to its events.
+//   - "ask": data is an AskAgentReq. "agent" is optional, defaults to selected agent.
+//     Responds with "chunk" messages (data: ollama.GenerateResponse),
+//     then a "response" message (data: AskAgentRes).
+//     Up to WS_MAX_ASKS asks are processed at a time per session,
+//     others get an "error" response.
+//   - "ping": responds with "pong".
+//
+// Server -> client:
+//   - "agent", "chunk", "response", "pong": see above.
+//   - "error": "error" field explains what went wrong.
+//   - "event": pushed for selected agents, without client request.
+//     data is a WSEvent. Events are raised when agents answer other
+//     sessions (WS_EVENT_AGENT_SAID), or by the game server or NPC scripts
+//     with POST /agents/:id/events (body is a WSEvent, kind is required).
+
+const (
+	WS_CREATE_AGENT = "create-agent"
+	WS_SELECT_AGENT = "select-agent"
+	WS_ASK          = "ask"
+	WS_PING         = "ping"
+
+	WS_AGENT    = "agent"
+	WS_CHUNK    = "chunk"
+	WS_RESPONSE = "response"
+	WS_PONG     = "pong"
+	WS_ERROR    = "error"
+	WS_EVENT    = "event"
+
+	// Event kinds
+	WS_EVENT_AGENT_SAID = "agent-said" // agent said something (data: AskAgentRes)
+
+	// messages waiting to be written, per session. Sessions that
+	// don't keep up (queue full) are closed, so they can't block others.
+	WS_SEND_QUEUE_SIZE = 256
+	WS_WRITE_TIMEOUT   = 10 * time.Second
+	// asks processed at the same time, per session
+	WS_MAX_ASKS = 4
+)
+
+type WSMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`    // correlation ID
+	AgentID string          `json:"agent,omitempty"` // agent ID
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Pushed by the server to sessions that selected an agent
+type WSEvent struct {
+	Kind string `json:"kind"`
+	Data any    `json:"data,omitempty"`
+}
+
+var (
+	wsUpgrader = websocket.Upgrader{
+		// game clients are not browsers, origin doesn't matter
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	wsSessions      = make(map[*wsSession]struct{})
+	wsSessionsMutex sync.Mutex
+
+	errWSSessionClosed = errors.New("websocket session closed")
+	errWSQueueFull     = errors.New("websocket send queue full, closing session")
+	errWSTooManyAsks   = fmt.Errorf("too many asks in progress (max %d)", WS_MAX_ASKS)
+)
+
+type wsSession struct {
+	conn *websocket.Conn
+	// messages are written by writeLoop, the only writer
+	queue     chan WSMessage
+	done      chan struct{} // closed with the session
+	closeOnce sync.Once
+	// one token per ask in progress
+	asks chan struct{}
+
+	mutex      sync.Mutex // protects fields below
+	agentID    string     // selected agent
+	subscribed map[string]bool
+}
+
+func serveWebSocket(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade already replied with an HTTP error
+		fmt.Println("❌", err.Error())
+		return
+	}
+
+	session := &wsSession{
+		conn:       conn,
+		queue:      make(chan WSMessage, WS_SEND_QUEUE_SIZE),
+		done:       make(chan struct{}),
+		asks:       make(chan struct{}, WS_MAX_ASKS),
+		subscribed: make(map[string]bool),
+	}
+	go session.writeLoop()
+
+	wsSessionsMutex.Lock()
+	wsSessions[session] = struct{}{}
+	wsSessionsMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+
+	defer func() {
+		cancel() // stops pending asks
+		wsSessionsMutex.Lock()
+		delete(wsSessions, session)
+		wsSessionsMutex.Unlock()
+		session.close()
+	}()
+
+	for {
+		var msg WSMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				fmt.Println("❌ websocket:", err.Error())
+			}
+			return
+		}
+		session.handle(ctx, msg)
+	}
+}
+
+func (s *wsSession) handle(ctx context.Context, msg WSMessage) {
+	switch msg.Type {
+	case WS_PING:
+		s.send(WSMessage{Type: WS_PONG, ID: msg.ID})
+
+	case WS_CREATE_AGENT:
+		var req Agent
+		err := json.Unmarshal(msg.Data, &req)
+		if err != nil {
+			s.sendError(msg.ID, err)
+			return
+		}
+		agent, err := addAgent(ctx, req)
+		if err != nil {
+			s.sendError(msg.ID, err)
+			return
+		}
+		s.selectAgent(agent.ID)
+		s.sendData(WSMessage{Type: WS_AGENT, ID: msg.ID, AgentID: agent.ID}, agent)
+
+	case WS_SELECT_AGENT:
+		agent := getAgentByID(msg.AgentID)
+		if agent == nil {
+			s.sendError(msg.ID, errors.New("unknown agent"))
+			return
+		}
+		s.selectAgent(agent.ID)
+		s.sendData(WSMessage{Type: WS_AGENT, ID: msg.ID, AgentID: agent.ID}, agent)
+
+	case WS_ASK:
+		var req AskAgentReq
+		err := json.Unmarshal(msg.Data, &req)
+		if err != nil {
+			s.sendError(msg.ID, err)
+			return
+		}
+
+		agentID := msg.AgentID
+		if agentID == "" {
+			s.mutex.Lock()
+			agentID = s.agentID
+			s.mutex.Unlock()
+		}
+
+		agent := getAgentByID(agentID)
+		if agent == nil {
+			s.sendError(msg.ID, errors.New("unknown agent"))
+			return
+		}
+
+		select {
+		case s.asks <- struct{}{}:
+		default:
+			s.sendError(msg.ID, errWSTooManyAsks)
+			return
+		}
+
+		// processed in the background, responses are
+		// matched with requests using correlation IDs.
+		go func() {
+			defer func() { <-s.asks }()
+
+			// waiting for the writer when chunks get ahead of it
+			res, err := ask(ctx, agent, req, func(r ollama.GenerateResponse) error {
+				chunk, err := messageWithData(WSMessage{Type: WS_CHUNK, ID: msg.ID, AgentID: agent.ID}, r)
+				if err != nil {
+					return err
+				}
+				return s.sendWait(chunk)
+			})
+			if err != nil {
+				s.sendError(msg.ID, err)
+				return
+			}
+			response, err := messageWithData(WSMessage{Type: WS_RESPONSE, ID: msg.ID, AgentID: agent.ID}, res)
+			if err != nil {
+				s.sendError(msg.ID, err)
+				return
+			}
+			s.sendWait(response)
+			_, err = pushEvent(agent.ID, WSEvent{Kind: WS_EVENT_AGENT_SAID, Data: res}, s)
+			if err != nil {
+				fmt.Println("❌ websocket:", err.Error())
+			}
+		}()
+
+	default:
+		s.sendError(msg.ID, errors.New("unknown message type: "+msg.Type))
+	}
+}
+
+func (s *wsSession) selectAgent(agentID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.agentID = agentID
+	s.subscribed[agentID] = true
+}
+
+func (s *wsSession) isSubscribed(agentID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.subscribed[agentID]
+}
+
+// Queues message, without blocking
+func (s *wsSession) send(msg WSMessage) error {
+	select {
+	case <-s.done:
+		return errWSSessionClosed
+	default:
+	}
+
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		s.close()
+		return errWSQueueFull
+	}
+}
+
+// Queues message, waiting up to WS_WRITE_TIMEOUT
+// when the queue is full (session is then closed)
+func (s *wsSession) sendWait(msg WSMessage) error {
+	timer := time.NewTimer(WS_WRITE_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case <-s.done:
+		return errWSSessionClosed
+	case s.queue <- msg:
+		return nil
+	case <-timer.C:
+		s.close()
+		return errWSQueueFull
+	}
+}
+
+// Writes queued messages until the session is closed
+func (s *wsSession) writeLoop() {
+	for {
+		select {
+		case msg := <-s.queue:
+			s.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+			err := s.conn.WriteJSON(msg)
+			if err != nil {
+				fmt.Println("❌ websocket:", err.Error())
+				s.close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Closes connection, the read loop in serveWebSocket
+// then returns and unregisters the session.
+func (s *wsSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *wsSession) sendError(id string, err error) error {
+	return s.send(WSMessage{Type: WS_ERROR, ID: id, Error: err.Error()})
+}
+
+// Queues message with v as data,
+// sends an error instead if v can't be marshaled
+func (s *wsSession) sendData(msg WSMessage, v any) error {
+	msg, err := messageWithData(msg, v)
+	if err != nil {
+		return s.sendError(msg.ID, err)
+	}
+	return s.send(msg)
+}
+
+// Returns message with v, JSON encoded, as data
+func messageWithData(msg WSMessage, v any) (WSMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return msg, err
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+// Pushes event to all sessions subscribed to given agent.
+// except can be used to skip the session that triggered the event.
+// Returns the number of sessions the event was sent to.
+func pushEvent(agentID string, event WSEvent, except *wsSession) (int, error) {
+	msg, err := messageWithData(WSMessage{Type: WS_EVENT, AgentID: agentID}, event)
+	if err != nil {
+		return 0, err
+	}
+
+	wsSessionsMutex.Lock()
+	sessions := make([]*wsSession, 0, len(wsSessions))
+	for s := range wsSessions {
+		if s != except && s.isSubscribed(agentID) {
+			sessions = append(sessions, s)
+		}
+	}
+	wsSessionsMutex.Unlock()
+
+	sent := 0
+	for _, s := range sessions {
+		err := s.send(msg)
+		if err != nil {
+			if errors.Is(err, errWSSessionClosed) == false {
+				fmt.Println("❌ websocket:", err.Error())
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Pushes an event, raised by the game server or an NPC script,
+// to sessions subscribed to the agent (POST /agents/:id/events).
+func postAgentEvent(c *gin.Context) {
+	var event WSEvent
+	if err := c.BindJSON(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if event.Kind == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event kind is required"})
+		return
+	}
+
+	agent := getAgentByID(c.Param("id"))
+	if agent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown agent"})
+		return
+	}
+
+	sent, err := pushEvent(agent.ID, event, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sent})
+}
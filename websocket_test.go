@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	ollama "github.com/ollama/ollama/api"
+)
+
+// Text generator sending one chunk per request, once release is closed
+type blockingGenerator struct {
+	release chan struct{}
+}
+
+func (g *blockingGenerator) Generate(ctx context.Context, req GenerateRequest, fn func(ollama.GenerateResponse) error) error {
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return fn(ollama.GenerateResponse{Response: "done", Done: true})
+}
+
+func (g *blockingGenerator) DefaultModel() string {
+	return "blocking"
+}
+
+// Starts API server (see setupTestAPI), closed when the test ends
+func newTestAPIServer(t *testing.T, generator TextGenerator) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(setupTestAPI(t, generator))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Opens WebSocket session, closed when the test ends
+func dialTestSession(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func writeWS(t *testing.T, conn *websocket.Conn, msg WSMessage) {
+	t.Helper()
+	err := conn.WriteJSON(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WSMessage
+	err := conn.ReadJSON(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// Reads next message, checking its type and correlation ID
+func expectWS(t *testing.T, conn *websocket.Conn, msgType string, id string) WSMessage {
+	t.Helper()
+	msg := readWS(t, conn)
+	if msg.Type != msgType || msg.ID != id {
+		t.Fatalf("got %s message (ID:%s, error:%q), want %s (ID:%s)", msg.Type, msg.ID, msg.Error, msgType, id)
+	}
+	return msg
+}
+
+// Checks that nothing else was received (a ping is answered first)
+func expectNoWS(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	writeWS(t, conn, WSMessage{Type: WS_PING, ID: "last"})
+	expectWS(t, conn, WS_PONG, "last")
+}
+
+func postTestEvent(t *testing.T, server *httptest.Server, agentID string, body string) (int, string) {
+	t.Helper()
+	res, err := http.Post(server.URL+"/agents/"+agentID+"/events", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var data json.RawMessage
+	err = json.NewDecoder(res.Body).Decode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func TestWebSocketSession(t *testing.T) {
+	server := newTestAPIServer(t, &stubGenerator{chunks: []string{"Hello ", "Alice!"}})
+	alice := dialTestSession(t, server)
+	guard := dialTestSession(t, server)
+
+	writeWS(t, alice, WSMessage{Type: WS_PING, ID: "1"})
+	expectWS(t, alice, WS_PONG, "1")
+
+	writeWS(t, alice, WSMessage{Type: "dance", ID: "2"})
+	if msg := expectWS(t, alice, WS_ERROR, "2"); msg.Error != "unknown message type: dance" {
+		t.Errorf("unknown type error: %q", msg.Error)
+	}
+
+	writeWS(t, alice, WSMessage{Type: WS_SELECT_AGENT, ID: "3", AgentID: "bob"})
+	expectWS(t, alice, WS_ERROR, "3")
+	writeWS(t, alice, WSMessage{Type: WS_ASK, ID: "4", Data: json.RawMessage(`{"prompt":"Hi!"}`)})
+	expectWS(t, alice, WS_ERROR, "4")
+
+	// created agent is selected
+	writeWS(t, alice, WSMessage{Type: WS_CREATE_AGENT, ID: "5", Data: json.RawMessage(`{"name":"Bob"}`)})
+	if msg := expectWS(t, alice, WS_AGENT, "5"); msg.AgentID != "bob" {
+		t.Fatalf("created agent %q, want bob", msg.AgentID)
+	}
+	writeWS(t, guard, WSMessage{Type: WS_SELECT_AGENT, ID: "6", AgentID: "bob"})
+	if msg := expectWS(t, guard, WS_AGENT, "6"); msg.AgentID != "bob" {
+		t.Fatalf("selected agent %q, want bob", msg.AgentID)
+	}
+
+	// asks selected agent by default, responses have the ask's ID
+	writeWS(t, alice, WSMessage{Type: WS_ASK, ID: "7", Data: json.RawMessage(`{"sender":"Alice","prompt":"Hi!"}`)})
+	for _, chunk := range []string{"Hello ", "Alice!"} {
+		msg := expectWS(t, alice, WS_CHUNK, "7")
+		var r ollama.GenerateResponse
+		err := json.Unmarshal(msg.Data, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Response != chunk || msg.AgentID != "bob" {
+			t.Errorf("chunk %q from %q, want %q from bob", r.Response, msg.AgentID, chunk)
+		}
+	}
+	msg := expectWS(t, alice, WS_RESPONSE, "7")
+	var res AskAgentRes
+	err := json.Unmarshal(msg.Data, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Say != "Hello Alice!" {
+		t.Errorf("response %q, want %q", res.Say, "Hello Alice!")
+	}
+
+	// other sessions subscribed to the agent hear it,
+	// not the one that asked
+	msg = expectWS(t, guard, WS_EVENT, "")
+	var event struct {
+		Kind string      `json:"kind"`
+		Data AskAgentRes `json:"data"`
+	}
+	err = json.Unmarshal(msg.Data, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.AgentID != "bob" || event.Kind != WS_EVENT_AGENT_SAID || event.Data.Say != "Hello Alice!" {
+		t.Errorf("event %s from %q, want %s from bob", msg.Data, msg.AgentID, WS_EVENT_AGENT_SAID)
+	}
+	expectNoWS(t, alice)
+
+	// events raised by the game server
+	tests := []struct {
+		agentID string
+		body    string
+		status  int
+		data    string
+	}{
+		{"bob", `{"kind":"door-opened","data":{"door":"forge"}}`, http.StatusOK, `{"sessions":2}`},
+		{"bob", `{"data":{"door":"forge"}}`, http.StatusBadRequest, `{"error":"event kind is required"}`},
+		{"alice", `{"kind":"door-opened"}`, http.StatusNotFound, `{"error":"unknown agent"}`},
+	}
+	for _, test := range tests {
+		status, data := postTestEvent(t, server, test.agentID, test.body)
+		if status != test.status || data != test.data {
+			t.Errorf("POST /agents/%s/events %s: %d %s, want %d %s", test.agentID, test.body, status, data, test.status, test.data)
+		}
+	}
+	for _, conn := range []*websocket.Conn{alice, guard} {
+		msg := expectWS(t, conn, WS_EVENT, "")
+		if string(msg.Data) != `{"kind":"door-opened","data":{"door":"forge"}}` {
+			t.Errorf("event data %s", msg.Data)
+		}
+		expectNoWS(t, conn)
+	}
+}
+
+func TestWebSocketTooManyAsks(t *testing.T) {
+	generator := &blockingGenerator{release: make(chan struct{})}
+	server := newTestAPIServer(t, generator)
+	conn := dialTestSession(t, server)
+
+	writeWS(t, conn, WSMessage{Type: WS_CREATE_AGENT, ID: "bob", Data: json.RawMessage(`{"name":"Bob"}`)})
+	expectWS(t, conn, WS_AGENT, "bob")
+
+	ids := []string{"a", "b", "c", "d", "e"}
+	for _, id := range ids {
+		writeWS(t, conn, WSMessage{Type: WS_ASK, ID: id, Data: json.RawMessage(`{"sender":"Alice","prompt":"Hi!"}`)})
+	}
+	msg := expectWS(t, conn, WS_ERROR, ids[WS_MAX_ASKS])
+	if msg.Error != errWSTooManyAsks.Error() {
+		t.Errorf("error %q, want %q", msg.Error, errWSTooManyAsks.Error())
+	}
+
+	// asks in progress complete
+	close(generator.release)
+	responses := make(map[string]bool)
+	for len(responses) < WS_MAX_ASKS {
+		msg := readWS(t, conn)
+		switch msg.Type {
+		case WS_CHUNK:
+		case WS_RESPONSE:
+			responses[msg.ID] = true
+		default:
+			t.Fatalf("unexpected %s message (ID:%s, error:%q)", msg.Type, msg.ID, msg.Error)
+		}
+	}
+	for _, id := range ids[:WS_MAX_ASKS] {
+		if responses[id] == false {
+			t.Errorf("no response for ask %s", id)
+		}
+	}
+
+	// token released, session accepts asks again
+	writeWS(t, conn, WSMessage{Type: WS_ASK, ID: "f", Data: json.RawMessage(`{"sender":"Alice","prompt":"Hi!"}`)})
+	expectWS(t, conn, WS_CHUNK, "f")
+	expectWS(t, conn, WS_RESPONSE, "f")
+}
+
+func TestWebSocketSessionClose(t *testing.T) {
+	// server side of the connections
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	newSession := func(queueSize int) (*wsSession, *websocket.Conn) {
+		client := dialTestSession(t, server)
+		return &wsSession{
+			conn:       <-conns,
+			queue:      make(chan WSMessage, queueSize),
+			done:       make(chan struct{}),
+			subscribed: make(map[string]bool),
+		}, client
+	}
+
+	// queued messages are written until the session is closed
+	session, client := newSession(WS_SEND_QUEUE_SIZE)
+	stopped := make(chan struct{})
+	go func() {
+		session.writeLoop()
+		close(stopped)
+	}()
+	err := session.send(WSMessage{Type: WS_PONG, ID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWS(t, client, WS_PONG, "1")
+
+	session.close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeLoop still running after session closed")
+	}
+	err = session.send(WSMessage{Type: WS_PONG, ID: "2"})
+	if errors.Is(err, errWSSessionClosed) == false {
+		t.Errorf("send after close: got error %v, want %v", err, errWSSessionClosed)
+	}
+	session.close() // can be closed more than once
+
+	// sessions that don't keep up are closed
+	session, _ = newSession(1)
+	err = session.send(WSMessage{Type: WS_PONG, ID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.send(WSMessage{Type: WS_PONG, ID: "2"})
+	if errors.Is(err, errWSQueueFull) == false {
+		t.Errorf("send with full queue: got error %v, want %v", err, errWSQueueFull)
+	}
+	select {
+	case <-session.done:
+	default:
+		t.Error("session with full queue not closed")
+	}
+}
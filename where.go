@@ -2,79 +2,119 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"reflect"
 )
 
 type Operator string
 
 const (
-	Equal              Operator = "$eq"  // string, int, float
-	NotEqual           Operator = "$ne"  // string, int, float
+	Equal              Operator = "$eq"  // string, bool, int, float
+	NotEqual           Operator = "$ne"  // string, bool, int, float
 	GreaterThan        Operator = "$gt"  // int, float
 	GreaterThanOrEqual Operator = "$gte" // int, float
 	LessThan           Operator = "$lt"  // int, float
 	LessThanOrEqual    Operator = "$lte" // int, float
-	In                 Operator = "$in"  // int, float
-	NotIn              Operator = "nin"
+	In                 Operator = "$in"  // list of strings, bools, ints or floats
+	NotIn              Operator = "$nin" // list of strings, bools, ints or floats
 )
 
-type Where struct{}
+// Metadata filter, implemented by WhereField, WhereAnd & WhereOr, e.g.
+//
+//	WhereAnd{Entries: []Where{
+//		WhereField{Name: "sender", Operator: Equal, Value: "bob"},
+//		WhereField{Name: "createdAt", Operator: GreaterThan, Value: 1700000000},
+//	}}
+//
+// Filters can be evaluated locally with Match (see wherematch.go).
+type Where interface {
+	json.Marshaler
+	// Indicates if entry metadata matches the filter
+	Match(metadata map[string]any) bool
+	validate() error
+}
+
+var errWhere = fmt.Errorf("%w: where", ErrInvalidArgument)
 
 type WhereField struct {
-	Where
 	Name     string
 	Operator Operator
 	Value    any
 }
 
 func (w WhereField) MarshalJSON() ([]byte, error) {
-
-	valueString, ok := w.Value.(string)
-	if ok {
-		return []byte(fmt.Sprintf("{ \"%s\": { \"%s\": \"%s\" }}", w.Name, w.Operator, valueString)), nil
-	}
-
-	valueInt, ok := w.Value.(int)
-	if ok {
-		return []byte(fmt.Sprintf("{ \"%s\": { \"%s\": %d }}", w.Name, w.Operator, valueInt)), nil
+	err := w.validate()
+	if err != nil {
+		return nil, err
 	}
+	return json.Marshal(map[string]map[Operator]any{
+		w.Name: {w.Operator: w.Value},
+	})
+}
 
-	valueFloat32, ok := w.Value.(float32)
-	if ok {
-		return []byte(fmt.Sprintf("{ \"%s\": { \"%s\": %f }}", w.Name, w.Operator, valueFloat32)), nil
+func (w WhereField) validate() error {
+	if w.Name == "" {
+		return fmt.Errorf("%w: field name can't be empty", errWhere)
 	}
 
-	valueFloat64, ok := w.Value.(float64)
-	if ok {
-		return []byte(fmt.Sprintf("{ \"%s\": { \"%s\": %f }}", w.Name, w.Operator, valueFloat64)), nil
+	switch w.Operator {
+	case Equal, NotEqual:
+		if isWhereScalar(w.Value) == false {
+			return fmt.Errorf("%w: %s %s: value should be string, bool, int or float", errWhere, w.Name, w.Operator)
+		}
+	case GreaterThan, GreaterThanOrEqual, LessThan, LessThanOrEqual:
+		if isWhereNumber(w.Value) == false {
+			return fmt.Errorf("%w: %s %s: value should be int or float", errWhere, w.Name, w.Operator)
+		}
+	case In, NotIn:
+		values, ok := whereList(w.Value)
+		if ok == false || len(values) == 0 {
+			return fmt.Errorf("%w: %s %s: value should be a non-empty list of strings, bools, ints or floats", errWhere, w.Name, w.Operator)
+		}
+	default:
+		return fmt.Errorf("%w: %s: unknown operator %q", errWhere, w.Name, w.Operator)
 	}
 
-	return nil, errors.New("value should be string, int or float")
+	return nil
 }
 
 type WhereOr struct {
-	Where
 	Entries []Where
 }
 
 func (w WhereOr) MarshalJSON() ([]byte, error) {
-	s := map[string][]Where{
-		"$or": w.Entries,
-	}
-	return json.Marshal(s)
+	return marshalWhereGroup("$or", w.Entries)
+}
+
+func (w WhereOr) validate() error {
+	return validateWhereGroup("$or", w.Entries)
 }
 
 type WhereAnd struct {
-	Where
 	Entries []Where
 }
 
 func (w WhereAnd) MarshalJSON() ([]byte, error) {
-	s := map[string][]Where{
-		"$and": w.Entries,
+	return marshalWhereGroup("$and", w.Entries)
+}
+
+func (w WhereAnd) validate() error {
+	return validateWhereGroup("$and", w.Entries)
+}
+
+// Chroma requires at least 2 entries for $and & $or,
+// a single entry is used as is.
+func marshalWhereGroup[T whereMarshaler](operator string, entries []T) ([]byte, error) {
+	err := validateWhereGroup(operator, entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 1 {
+		return entries[0].MarshalJSON()
 	}
-	return json.Marshal(s)
+	return json.Marshal(map[string][]T{
+		operator: entries,
+	})
 }
 
 type DocumentOperator string
@@ -84,11 +124,136 @@ const (
 	DoesNotContain DocumentOperator = "$not_contains"
 )
 
-type WhereDocument struct {
+// Document filter, implemented by WhereDocumentField,
+// WhereDocumentAnd & WhereDocumentOr.
+type WhereDocument interface {
+	json.Marshaler
+	// Indicates if entry document matches the filter
+	Match(document string) bool
+	validate() error
+}
+
+type WhereDocumentField struct {
 	Operator DocumentOperator
 	Value    string
 }
 
-func (w WhereDocument) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf("{ \"%s\": \"%s\" }", w.Operator, w.Value)), nil
+func (w WhereDocumentField) MarshalJSON() ([]byte, error) {
+	err := w.validate()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[DocumentOperator]string{
+		w.Operator: w.Value,
+	})
+}
+
+func (w WhereDocumentField) validate() error {
+	switch w.Operator {
+	case Contains, DoesNotContain:
+	default:
+		return fmt.Errorf("%w: unknown document operator %q", errWhere, w.Operator)
+	}
+	if w.Value == "" {
+		return fmt.Errorf("%w: %s: value can't be empty", errWhere, w.Operator)
+	}
+	return nil
+}
+
+type WhereDocumentOr struct {
+	Entries []WhereDocument
+}
+
+func (w WhereDocumentOr) MarshalJSON() ([]byte, error) {
+	return marshalWhereGroup("$or", w.Entries)
+}
+
+func (w WhereDocumentOr) validate() error {
+	return validateWhereGroup("$or", w.Entries)
+}
+
+type WhereDocumentAnd struct {
+	Entries []WhereDocument
+}
+
+func (w WhereDocumentAnd) MarshalJSON() ([]byte, error) {
+	return marshalWhereGroup("$and", w.Entries)
+}
+
+func (w WhereDocumentAnd) validate() error {
+	return validateWhereGroup("$and", w.Entries)
+}
+
+type whereValidator interface {
+	validate() error
+}
+
+type whereMarshaler interface {
+	json.Marshaler
+	whereValidator
+}
+
+func validateWhereGroup[T whereValidator](operator string, entries []T) error {
+	if len(entries) == 0 {
+		return fmt.Errorf("%w: %s needs at least one entry", errWhere, operator)
+	}
+	for _, entry := range entries {
+		if any(entry) == nil {
+			return fmt.Errorf("%w: %s entries can't be nil", errWhere, operator)
+		}
+		err := entry.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks filters before evaluating them locally,
+// Chroma reports the same errors. Both filters can be nil.
+func validateFilters(where Where, whereDocument WhereDocument) error {
+	if where != nil {
+		err := where.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if whereDocument != nil {
+		return whereDocument.validate()
+	}
+	return nil
+}
+
+func isWhereScalar(v any) bool {
+	switch v.(type) {
+	case string, bool:
+		return true
+	}
+	return isWhereNumber(v)
+}
+
+func isWhereNumber(v any) bool {
+	_, ok := whereFloat(v)
+	return ok
+}
+
+// Returns elements of given slice ([]string, []int, []any...),
+// false if v is not a slice or if one of its elements is not
+// a string, bool, int or float.
+func whereList(v any) ([]any, bool) {
+	if v == nil {
+		return nil, false
+	}
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, false
+	}
+	values := make([]any, value.Len())
+	for i := range values {
+		values[i] = value.Index(i).Interface()
+		if isWhereScalar(values[i]) == false {
+			return nil, false
+		}
+	}
+	return values, true
 }
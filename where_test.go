@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWhereMarshalJSON(t *testing.T) {
+	sender := WhereField{Name: "sender", Operator: Equal, Value: "bob"}
+	recent := WhereField{Name: "createdAt", Operator: GreaterThan, Value: 1700000000}
+
+	tests := []struct {
+		name  string
+		where Where
+		json  string
+	}{
+		{"field", sender, `{"sender":{"$eq":"bob"}}`},
+		{"bool", WhereField{Name: "done", Operator: NotEqual, Value: true}, `{"done":{"$ne":true}}`},
+		{
+			"quotes & backslashes",
+			WhereField{Name: `say "hi"\`, Operator: Equal, Value: `a "quoted" \ value`},
+			`{"say \"hi\"\\":{"$eq":"a \"quoted\" \\ value"}}`,
+		},
+		{"$in", WhereField{Name: "sender", Operator: In, Value: []string{"alice", `"bob"`}}, `{"sender":{"$in":["alice","\"bob\""]}}`},
+		{"$nin", WhereField{Name: "importance", Operator: NotIn, Value: []int{1, 2}}, `{"importance":{"$nin":[1,2]}}`},
+		{"$nin mixed", WhereField{Name: "x", Operator: NotIn, Value: []any{1.5, "a", false}}, `{"x":{"$nin":[1.5,"a",false]}}`},
+		{"single entry", WhereAnd{Entries: []Where{sender}}, `{"sender":{"$eq":"bob"}}`},
+		{"and", WhereAnd{Entries: []Where{sender, recent}}, `{"$and":[{"sender":{"$eq":"bob"}},{"createdAt":{"$gt":1700000000}}]}`},
+		{
+			"nested",
+			WhereOr{Entries: []Where{WhereAnd{Entries: []Where{sender, recent}}, WhereField{Name: "kind", Operator: Equal, Value: "reflection"}}},
+			`{"$or":[{"$and":[{"sender":{"$eq":"bob"}},{"createdAt":{"$gt":1700000000}}]},{"kind":{"$eq":"reflection"}}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		data, err := test.where.MarshalJSON()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if string(data) != test.json {
+			t.Errorf("%s: got %s, want %s", test.name, data, test.json)
+		}
+	}
+}
+
+func TestWhereMarshalJSONErrors(t *testing.T) {
+	sender := WhereField{Name: "sender", Operator: Equal, Value: "bob"}
+
+	tests := []struct {
+		name  string
+		where Where
+	}{
+		{"empty name", WhereField{Operator: Equal, Value: "bob"}},
+		{"unknown operator", WhereField{Name: "sender", Operator: "$like", Value: "bob"}},
+		{"number operator", WhereField{Name: "sender", Operator: GreaterThan, Value: "bob"}},
+		{"empty list", WhereField{Name: "sender", Operator: In, Value: []string{}}},
+		{"not a list", WhereField{Name: "sender", Operator: NotIn, Value: "bob"}},
+		{"empty group", WhereAnd{}},
+		{"nil entry", WhereOr{Entries: []Where{sender, nil}}},
+		{"single nil entry", WhereAnd{Entries: []Where{nil}}},
+		{"nested nil entry", WhereAnd{Entries: []Where{sender, WhereOr{Entries: []Where{nil, sender}}}}},
+		{"nested invalid entry", WhereOr{Entries: []Where{sender, WhereAnd{Entries: []Where{WhereField{Name: "x"}}}}}},
+	}
+
+	for _, test := range tests {
+		data, err := test.where.MarshalJSON()
+		if err == nil {
+			t.Errorf("%s: got %s, expected error", test.name, data)
+		} else if errors.Is(err, ErrInvalidArgument) == false {
+			t.Errorf("%s: error should be ErrInvalidArgument: %s", test.name, err.Error())
+		}
+	}
+}
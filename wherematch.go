@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+)
+
+// Local evaluation of Where & WhereDocument filters, following Chroma's
+// semantics, for memory stores that are not backed by Chroma:
+// - a condition on a missing metadata key never matches, whatever
+// the operator ($ne & $nin included)
+// - values of different types never match (a string is not equal to a number,
+// and it's not different from it either), ints & floats are both numbers
+// - $contains & $not_contains are case-sensitive substring searches
+// Filters should be valid (see validateFilters), nil entries
+// in invalid groups never match.
+
+func (w WhereField) Match(metadata map[string]any) bool {
+	value, exists := metadata[w.Name]
+	if exists == false || value == nil {
+		return false
+	}
+
+	switch w.Operator {
+	case Equal:
+		equal, comparable := whereEqual(value, w.Value)
+		return comparable && equal
+	case NotEqual:
+		equal, comparable := whereEqual(value, w.Value)
+		return comparable && equal == false
+	case GreaterThan, GreaterThanOrEqual, LessThan, LessThanOrEqual:
+		a, ok := whereFloat(value)
+		if ok == false {
+			return false
+		}
+		b, ok := whereFloat(w.Value)
+		if ok == false {
+			return false
+		}
+		switch w.Operator {
+		case GreaterThan:
+			return a > b
+		case GreaterThanOrEqual:
+			return a >= b
+		case LessThan:
+			return a < b
+		}
+		return a <= b
+	case In, NotIn:
+		values, _ := whereList(w.Value)
+		found := false
+		comparable := false
+		for _, v := range values {
+			equal, ok := whereEqual(value, v)
+			if ok {
+				comparable = true
+			}
+			if equal {
+				found = true
+				break
+			}
+		}
+		if w.Operator == In {
+			return found
+		}
+		return comparable && found == false
+	}
+
+	return false
+}
+
+func (w WhereAnd) Match(metadata map[string]any) bool {
+	for _, entry := range w.Entries {
+		if entry == nil || entry.Match(metadata) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (w WhereOr) Match(metadata map[string]any) bool {
+	for _, entry := range w.Entries {
+		if entry != nil && entry.Match(metadata) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w WhereDocumentField) Match(document string) bool {
+	switch w.Operator {
+	case Contains:
+		return strings.Contains(document, w.Value)
+	case DoesNotContain:
+		return strings.Contains(document, w.Value) == false
+	}
+	return false
+}
+
+func (w WhereDocumentAnd) Match(document string) bool {
+	for _, entry := range w.Entries {
+		if entry == nil || entry.Match(document) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (w WhereDocumentOr) Match(document string) bool {
+	for _, entry := range w.Entries {
+		if entry != nil && entry.Match(document) {
+			return true
+		}
+	}
+	return false
+}
+
+// Indicates if entry matches both filters (nil filters match everything)
+func matchFilters(entry ChromaCollectionEntry, where Where, whereDocument WhereDocument) bool {
+	if where != nil && where.Match(entry.Metadatas) == false {
+		return false
+	}
+	if whereDocument != nil && whereDocument.Match(entry.Document) == false {
+		return false
+	}
+	return true
+}
+
+// Compares metadata values. comparable is false when
+// values are not of the same type (string, bool or number).
+func whereEqual(a, b any) (equal bool, comparable bool) {
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		return ok && a == b, ok
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b, ok
+	}
+	fa, ok := whereFloat(a)
+	if ok == false {
+		return false, false
+	}
+	fb, ok := whereFloat(b)
+	if ok == false {
+		return false, false
+	}
+	return fa == fb, true
+}
+
+// Converts numbers to float64, metadata decoded from
+// JSON only contains float64 numbers.
+func whereFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWhereFieldMatch(t *testing.T) {
+	metadata := map[string]any{
+		"sender":     "bob",
+		"importance": 7,
+		"gameTime":   12.5,
+		"done":       true,
+	}
+
+	tests := []struct {
+		where WhereField
+		match bool
+	}{
+		{WhereField{Name: "sender", Operator: Equal, Value: "bob"}, true},
+		{WhereField{Name: "sender", Operator: Equal, Value: "alice"}, false},
+		{WhereField{Name: "importance", Operator: Equal, Value: 7.0}, true},
+		{WhereField{Name: "gameTime", Operator: GreaterThan, Value: 12}, true},
+		{WhereField{Name: "gameTime", Operator: LessThanOrEqual, Value: 12}, false},
+		{WhereField{Name: "sender", Operator: GreaterThan, Value: 1}, false},
+
+		// $ne: missing keys and type mismatches never match
+		{WhereField{Name: "sender", Operator: NotEqual, Value: "alice"}, true},
+		{WhereField{Name: "sender", Operator: NotEqual, Value: "bob"}, false},
+		{WhereField{Name: "location", Operator: NotEqual, Value: "forge"}, false},
+		{WhereField{Name: "sender", Operator: NotEqual, Value: 1}, false},
+		{WhereField{Name: "importance", Operator: NotEqual, Value: "7"}, false},
+		{WhereField{Name: "done", Operator: NotEqual, Value: 1}, false},
+		{WhereField{Name: "done", Operator: NotEqual, Value: false}, true},
+
+		// $in
+		{WhereField{Name: "sender", Operator: In, Value: []string{"alice", "bob"}}, true},
+		{WhereField{Name: "sender", Operator: In, Value: []string{"alice"}}, false},
+		{WhereField{Name: "importance", Operator: In, Value: []int{1, 7}}, true},
+		{WhereField{Name: "importance", Operator: In, Value: []float64{7.0}}, true},
+		{WhereField{Name: "importance", Operator: In, Value: []any{"7", 7}}, true},
+		{WhereField{Name: "importance", Operator: In, Value: []string{"7"}}, false},
+		{WhereField{Name: "location", Operator: In, Value: []string{"forge"}}, false},
+
+		// $nin: missing keys and lists with no value of the same type never match
+		{WhereField{Name: "sender", Operator: NotIn, Value: []string{"alice"}}, true},
+		{WhereField{Name: "sender", Operator: NotIn, Value: []string{"alice", "bob"}}, false},
+		{WhereField{Name: "sender", Operator: NotIn, Value: []int{1, 2}}, false},
+		{WhereField{Name: "sender", Operator: NotIn, Value: []any{1, "alice"}}, true},
+		{WhereField{Name: "importance", Operator: NotIn, Value: []int{1, 2}}, true},
+		{WhereField{Name: "location", Operator: NotIn, Value: []string{"forge"}}, false},
+	}
+
+	for _, test := range tests {
+		if match := test.where.Match(metadata); match != test.match {
+			t.Errorf("%s: Match = %t, want %t", FormatWhere(test.where), match, test.match)
+		}
+	}
+}
+
+func TestMatchFilters(t *testing.T) {
+	entry := ChromaCollectionEntry{
+		Document:  "Bob said: my sword is broken",
+		Metadatas: map[string]any{"sender": "bob", "importance": 3},
+	}
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{``, true},
+		{`sender == "bob"`, true},
+		{`sender != "bob"`, false},
+		{`location != "forge"`, false},
+		{`sender == "alice" || importance < 5`, true},
+		{`sender == "alice" || importance not in [3]`, false},
+		{`doc contains "sword"`, true},
+		{`doc contains "Sword"`, false},
+		{`doc not contains "shield"`, true},
+		{`sender == "bob" && doc contains "shield"`, false},
+		{`sender in ["bob"] && (doc contains "shield" || doc contains "sword")`, true},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		if match := matchFilters(entry, f.Where, f.WhereDocument); match != test.match {
+			t.Errorf("%q: matchFilters = %t, want %t", test.expr, match, test.match)
+		}
+	}
+}
+
+// Filters are applied the same way by in-memory collection queries
+func TestInMemoryCollectionQueryFilter(t *testing.T) {
+	ctx := context.Background()
+	embedder := NewHashEmbedder(64)
+
+	store, err := NewInMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := store.GetCollection(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memories := []struct {
+		id       string
+		document string
+		metadata map[string]any
+	}{
+		{"1", "Bob said: my sword is broken", map[string]any{"sender": "bob"}},
+		{"2", "Alice said: the sword is ready", map[string]any{"sender": "alice"}},
+		{"3", "Someone said: the tournament is tomorrow", map[string]any{}},
+	}
+	entries := make([]ChromaCollectionEntry, len(memories))
+	for i, m := range memories {
+		embedding, err := embedder.Embed(ctx, m.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[i] = ChromaCollectionEntry{ID: m.id, Embedding: &embedding, Document: m.document, Metadatas: m.metadata}
+	}
+	err = collection.Add(ctx, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedding, err := embedder.Embed(ctx, "sword")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		ids  []string
+	}{
+		{`sender != "bob"`, []string{"2"}},
+		{`sender not in ["alice"]`, []string{"1"}},
+		{`doc contains "sword"`, []string{"1", "2"}},
+		{`sender in ["alice", "bob"] && doc contains "broken"`, []string{"1"}},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		results, err := collection.Query(ctx, ChromaCollectionQuery{
+			Embeddings:    [][]float64{embedding},
+			NResults:      10,
+			Where:         f.Where,
+			WhereDocument: f.WhereDocument,
+		})
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		ids := make([]string, len(results))
+		for i, r := range results {
+			ids[i] = r.ID
+		}
+		if reflect.DeepEqual(ids, test.ids) == false {
+			t.Errorf("%q: got %v, want %v", test.expr, ids, test.ids)
+		}
+	}
+}
+
+// Invalid groups are rejected before evaluation,
+// and nil entries don't make Match panic
+func TestMatchNilEntries(t *testing.T) {
+	sender := WhereField{Name: "sender", Operator: Equal, Value: "bob"}
+	metadata := map[string]any{"sender": "bob"}
+
+	wheres := []Where{
+		WhereAnd{Entries: []Where{sender, nil}},
+		WhereOr{Entries: []Where{nil}},
+		WhereAnd{Entries: []Where{WhereOr{Entries: []Where{nil, nil}}}},
+	}
+	for _, where := range wheres {
+		if where.Match(metadata) {
+			t.Errorf("%#v should not match", where)
+		}
+		if err := validateFilters(where, nil); errors.Is(err, ErrInvalidArgument) == false {
+			t.Errorf("%#v: validateFilters: %v", where, err)
+		}
+	}
+
+	whereDocument := WhereDocumentOr{Entries: []WhereDocument{nil}}
+	if whereDocument.Match("sword") {
+		t.Errorf("%#v should not match", whereDocument)
+	}
+	if err := validateFilters(nil, whereDocument); errors.Is(err, ErrInvalidArgument) == false {
+		t.Errorf("%#v: validateFilters: %v", whereDocument, err)
+	}
+}